@@ -7,6 +7,7 @@ import android.content.Intent
 import android.os.Bundle
 import android.widget.Toast
 import androidx.activity.ComponentActivity
+import androidx.annotation.Keep
 import androidx.activity.compose.rememberLauncherForActivityResult
 import androidx.activity.compose.setContent
 import androidx.activity.result.contract.ActivityResultContracts
@@ -28,12 +29,44 @@ import androidx.compose.ui.text.font.FontFamily
 import androidx.compose.ui.unit.dp
 import androidx.compose.ui.unit.sp
 import appctr.Appctr
+import com.google.gson.Gson
+import com.google.gson.annotations.SerializedName
 import kotlinx.coroutines.Dispatchers
 import kotlinx.coroutines.delay
 import kotlinx.coroutines.launch
 import kotlinx.coroutines.withContext
+import java.io.File
 import java.io.OutputStreamWriter
 
+@Keep
+data class LogRecord(
+    @SerializedName("Time") val time: String,
+    @SerializedName("Level") val level: String,
+    @SerializedName("Source") val source: String,
+    @SerializedName("Msg") val msg: String,
+    @SerializedName("Attrs") val attrs: Map<String, String>?
+) {
+    // Тот же формат, что у Appctr.getLogs()
+    fun format(): String {
+        val sb = StringBuilder()
+        sb.append(if (time.length >= 19) time.substring(11, 19) else time)
+        sb.append(" [").append(level).append("] ")
+        if (source != "appctr") sb.append(source).append(": ")
+        sb.append(msg)
+        attrs?.toSortedMap()?.forEach { (k, v) -> sb.append(" ").append(k).append("=").append(v) }
+        return sb.toString()
+    }
+}
+
+@Keep
+data class LogPage(
+    @SerializedName("Records") val records: List<LogRecord>?,
+    @SerializedName("Next") val next: Long,
+    @SerializedName("Truncated") val truncated: Boolean
+)
+
+private const val MAX_UI_LOG_LINES = 10000
+
 class LogsActivity : ComponentActivity() {
     override fun onCreate(savedInstanceState: Bundle?) {
         super.onCreate(savedInstanceState)
@@ -54,6 +87,7 @@ fun LogsScreen(onBack: () -> Unit) {
     val coroutineScope = rememberCoroutineScope()
     
     var logs by remember { mutableStateOf<List<String>>(emptyList()) }
+    var cursor by remember { mutableLongStateOf(0L) }
     var isAutoScroll by remember { mutableStateOf(true) }
     var isRefreshing by remember { mutableStateOf(false) }
     
@@ -76,12 +110,35 @@ fun LogsScreen(onBack: () -> Unit) {
         }
     }
 
+    val saveBundleLauncher = rememberLauncherForActivityResult(ActivityResultContracts.CreateDocument("application/zip")) { uri ->
+        uri?.let {
+            coroutineScope.launch(Dispatchers.IO) {
+                // Go пишет только в файл, поэтому собираем bundle в cache и копируем в выбранный uri
+                val tmp = File(context.cacheDir, "debug_bundle.zip")
+                try {
+                    Appctr.createDebugBundle(tmp.absolutePath)
+                    context.contentResolver.openOutputStream(it)?.use { os -> tmp.inputStream().use { input -> input.copyTo(os) } }
+                    withContext(Dispatchers.Main) { Toast.makeText(context, "Debug bundle saved", Toast.LENGTH_SHORT).show() }
+                } catch (e: Exception) {
+                    withContext(Dispatchers.Main) { Toast.makeText(context, "Error: ${e.message}", Toast.LENGTH_LONG).show() }
+                } finally {
+                    tmp.delete()
+                }
+            }
+        }
+    }
+
     fun loadLogsData() {
         coroutineScope.launch(Dispatchers.IO) {
-            val logsString = try { Appctr.getLogs() } catch (e: Exception) { "" }
-            val logsList = if (logsString.isEmpty()) emptyList() else logsString.split("\n").filter { it.isNotEmpty() }
+            // Забираем только новые записи после курсора
+            val page = try { Gson().fromJson(Appctr.getLogsSince(cursor), LogPage::class.java) } catch (e: Exception) { null }
+            val newLines = page?.records.orEmpty().map { it.format() }
             withContext(Dispatchers.Main) {
-                logs = logsList
+                if (page != null) {
+                    val base = if (page.truncated) emptyList() else logs
+                    logs = (base + newLines).takeLast(MAX_UI_LOG_LINES)
+                    cursor = page.next
+                }
                 isRefreshing = false
             }
         }
@@ -121,6 +178,8 @@ fun LogsScreen(onBack: () -> Unit) {
                         }) { Icon(Icons.Default.List, contentDescription = "Copy") }
                         
                         IconButton(onClick = { saveFileLauncher.launch("tailscaled_logs_${System.currentTimeMillis()}.txt") }) { Icon(Icons.Default.Done, contentDescription = "Save File") }
+
+                        IconButton(onClick = { saveBundleLauncher.launch("tailscaled_debug_${System.currentTimeMillis()}.zip") }) { Icon(Icons.Default.Build, contentDescription = "Debug Bundle") }
                         
                         IconButton(onClick = {
                             val sendIntent = Intent().apply {
@@ -41,6 +41,7 @@ fun SettingsScreen(onBack: () -> Unit) {
     
     var socks5 by remember { mutableStateOf(prefs.getString("socks5", "127.0.0.1:1055") ?: "127.0.0.1:1055") }
     var httpProxy by remember { mutableStateOf(prefs.getString("httpproxy", "127.0.0.1:1057") ?: "127.0.0.1:1057") }
+    var socks5Users by remember { mutableStateOf(prefs.getString("socks5_users", "") ?: "") }
     
     var exitNodeIp by remember { mutableStateOf(prefs.getString("exit_node_ip", "") ?: "") }
     var exitNodeAllowLan by remember { mutableStateOf(prefs.getBoolean("exit_node_allow_lan", false)) }
@@ -48,10 +49,19 @@ fun SettingsScreen(onBack: () -> Unit) {
     var dnsFallback1 by remember { mutableStateOf(prefs.getString("dns_fallback1", "8.8.8.8:53") ?: "8.8.8.8:53") }
     var dnsFallback2 by remember { mutableStateOf(prefs.getString("dns_fallback2", "1.1.1.1:53") ?: "1.1.1.1:53") }
     var dohUrl by remember { mutableStateOf(prefs.getString("doh_url", "https://1.1.1.1/dns-query") ?: "https://1.1.1.1/dns-query") }
+    var dnsStrategy by remember { mutableStateOf(prefs.getString("dns_strategy", "sequential") ?: "sequential") }
+    var dnsViaExit by remember { mutableStateOf(prefs.getBoolean("dns_via_exit", false)) }
+    var dnssec by remember { mutableStateOf(prefs.getBoolean("dnssec", false)) }
+    var dohListen by remember { mutableStateOf(prefs.getString("doh_listen", "") ?: "") }
+    var dohTls by remember { mutableStateOf(prefs.getBoolean("doh_tls", true)) }
+    var dotListen by remember { mutableStateOf(prefs.getString("dot_listen", "") ?: "") }
+    var dnsTlsCert by remember { mutableStateOf(prefs.getString("dns_tls_cert", "") ?: "") }
+    var dnsTlsKey by remember { mutableStateOf(prefs.getString("dns_tls_key", "") ?: "") }
     
     var acceptRoutes by remember { mutableStateOf(prefs.getBoolean("accept_routes", false)) }
     var acceptDns by remember { mutableStateOf(prefs.getBoolean("accept_dns", true)) }
-    //var forceReset by remember { mutableStateOf(prefs.getBoolean("force_reset", false)) }
+    var forceReset by remember { mutableStateOf(prefs.getBoolean("force_reset", false)) }
+    var useTsnet by remember { mutableStateOf(prefs.getBoolean("use_tsnet", false)) }
     var extraArgs by remember { mutableStateOf(prefs.getString("extra_args_raw", "") ?: "") }
 
     var enableWebUi by remember { mutableStateOf(prefs.getBoolean("enable_webui", false)) }
@@ -135,6 +145,12 @@ fun SettingsScreen(onBack: () -> Unit) {
                     }
                 }
             }
+            item {
+                SettingsTextField("SOCKS5/HTTP Proxy Users (user:password, comma-separated; tsnet backend only)", socks5Users, "firefox:secret,telegram:secret2") {
+                    socks5Users = it
+                    save("socks5_users", it)
+                }
+            }
 
             item { SectionTitle("DNS Settings") }
             item {
@@ -150,6 +166,38 @@ fun SettingsScreen(onBack: () -> Unit) {
                     dohUrl = it
                     save("doh_url", it)
                 }
+                SettingsTextField("Upstream Strategy (sequential, parallel, roundrobin, fastest)", dnsStrategy, "sequential") {
+                    dnsStrategy = it
+                    save("dns_strategy", it)
+                }
+                SettingsSwitch("Route DNS Fallbacks via Exit Node", dnsViaExit) {
+                    dnsViaExit = it
+                    save("dns_via_exit", it)
+                }
+                SettingsSwitch("Validate DNSSEC for Public Names", dnssec) {
+                    dnssec = it
+                    save("dnssec", it)
+                }
+                SettingsTextField("Local DoH Listen (empty = off)", dohListen, "127.0.0.1:8053") {
+                    dohListen = it
+                    save("doh_listen", it)
+                }
+                SettingsSwitch("Serve DoH over HTTPS", dohTls) {
+                    dohTls = it
+                    save("doh_tls", it)
+                }
+                SettingsTextField("Local DoT Listen (empty = off)", dotListen, "127.0.0.1:853") {
+                    dotListen = it
+                    save("dot_listen", it)
+                }
+                SettingsTextField("DoH/DoT Certificate (PEM path, empty = self-signed)", dnsTlsCert, "/sdcard/dns.crt") {
+                    dnsTlsCert = it
+                    save("dns_tls_cert", it)
+                }
+                SettingsTextField("DoH/DoT Private Key (PEM path)", dnsTlsKey, "/sdcard/dns.key") {
+                    dnsTlsKey = it
+                    save("dns_tls_key", it)
+                }
                 SettingsSwitch("Accept DNS from Tailscale", acceptDns) {
                     acceptDns = it
                     save("accept_dns", it)
@@ -190,10 +238,14 @@ fun SettingsScreen(onBack: () -> Unit) {
                     acceptRoutes = it
                     save("accept_routes", it)
                 }
-                //SettingsSwitch("Force Hard Reset (--reset)", forceReset) {
-                //    forceReset = it
-                //    save("force_reset", it)
-                //}
+                SettingsSwitch("Force Hard Reset (--reset)", forceReset) {
+                    forceReset = it
+                    save("force_reset", it)
+                }
+                SettingsSwitch("In-process backend (tsnet, experimental, needs WITH_TSNET build)", useTsnet) {
+                    useTsnet = it
+                    save("use_tsnet", it)
+                }
                 SettingsTextField("Extra Arguments (Raw)", extraArgs, "--advertise-tags=tag:server") {
                     extraArgs = it
                     save("extra_args_raw", it)
@@ -78,16 +78,26 @@ class TailscaledService : Service() {
         val options = StartOptions().apply {
             socks5Server = prefs.getString("socks5", "127.0.0.1:1055")
             httpProxy    = prefs.getString("httpproxy", "127.0.0.1:1057")
+            socks5Credentials = prefs.getString("socks5_users", "")
             dnsProxy     = "127.0.0.1:1053"
             dnsFallbacks = "${prefs.getString("dns_fallback1", "8.8.8.8:53")},${prefs.getString("dns_fallback2", "1.1.1.1:53")}"
             dohFallback  = prefs.getString("doh_url", "https://1.1.1.1/dns-query")
+            dnsStrategy  = prefs.getString("dns_strategy", "sequential")
+            dnsViaExitNode = prefs.getBoolean("dns_via_exit", false)
+            dnsValidateDNSSEC = prefs.getBoolean("dnssec", false)
+            dnsDohListen = prefs.getString("doh_listen", "")
+            dnsDohTLS    = prefs.getBoolean("doh_tls", true)
+            dnsDotListen = prefs.getString("dot_listen", "")
+            dnsTLSCertFile = prefs.getString("dns_tls_cert", "")
+            dnsTLSKeyFile  = prefs.getString("dns_tls_key", "")
             authKey      = prefs.getString("authkey", "")
 
             enableWebUI = prefs.getBoolean("enable_webui", false)
             webUIAddr   = prefs.getString("webui_port", "127.0.0.1:8080")
             
             // Читаем настройку форсированного сброса из пресетов
-            //doReset      = prefs.getBoolean("force_reset", false) 
+            doReset      = prefs.getBoolean("force_reset", false) 
+            backend      = if (prefs.getBoolean("use_tsnet", false)) "tsnet" else "exec"
             
             execPath     = "${applicationInfo.nativeLibraryDir}/libtailscale.so"
             socketPath   = "${applicationInfo.dataDir}/tailscaled.sock"
@@ -99,14 +109,16 @@ class TailscaledService : Service() {
             if (!hostname.isNullOrEmpty()) argsBuilder.append("--hostname=$hostname ")
             val loginServer = prefs.getString("login_server", "")
             if (!loginServer.isNullOrEmpty()) argsBuilder.append("--login-server=$loginServer ")
-            if (prefs.getBoolean("accept_routes", false)) argsBuilder.append("--accept-routes ")
-            if (!prefs.getBoolean("accept_dns", true)) argsBuilder.append("--accept-dns=false ")
-            val exitNodeIp = prefs.getString("exit_node_ip", "")
-            if (!exitNodeIp.isNullOrEmpty()) {
-                argsBuilder.append("--exit-node=$exitNodeIp ")
-                if (prefs.getBoolean("exit_node_allow_lan", false)) argsBuilder.append("--exit-node-allow-lan-access ")
-            }
-            if (prefs.getBoolean("advertise_exit_node", false)) argsBuilder.append("--advertise-exit-node ")
+            // Переключатели приложения передаём всегда, и включённые, и выключенные.
+            // Без --reset appctr применяет только те, что изменились с прошлого
+            // старта (state/applied_up_flags.json): prefs из консоли не перетираются.
+            argsBuilder.append("--accept-routes=${prefs.getBoolean("accept_routes", false)} ")
+            argsBuilder.append("--accept-dns=${prefs.getBoolean("accept_dns", true)} ")
+            val exitNodeIp = prefs.getString("exit_node_ip", "") ?: ""
+            argsBuilder.append("--exit-node=$exitNodeIp ")
+            val allowLan = exitNodeIp.isNotEmpty() && prefs.getBoolean("exit_node_allow_lan", false)
+            argsBuilder.append("--exit-node-allow-lan-access=$allowLan ")
+            argsBuilder.append("--advertise-exit-node=${prefs.getBoolean("advertise_exit_node", false)} ")
             val rawArgs = prefs.getString("extra_args_raw", "")
             if (!rawArgs.isNullOrEmpty()) argsBuilder.append("$rawArgs")
             
@@ -2,12 +2,16 @@ package appctr
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	_ "time/tzdata"
@@ -21,6 +25,9 @@ var PC pathControl
 var currentLogLevel int32 = 1
 var dnsProxyCancel context.CancelFunc
 var webCmd *exec.Cmd
+var daemonSup *supervisor
+var sessionCancel context.CancelFunc
+var lapi *localClient
 
 type Closer interface {
 	Close() error
@@ -38,39 +45,53 @@ type StartOptions struct {
 	DnsProxy      string
 	DnsFallbacks  string
 	DohFallback   string
-	DoReset       bool 
-	EnableWebUI   bool  
+	DoReset       bool
+	EnableWebUI   bool
 	WebUIAddr     string
+	// Сколько ждать интерактивного логина без AuthKey (0 — 10 минут).
+	LoginTimeoutSec int32
+	// BackendExec (по умолчанию) или BackendTsnet.
+	Backend string
+	// Ротация файлов лога в DataDir/logs: размер файла (0 — 1 МБ),
+	// сколько старых файлов хранить (0 — 5) и сжимать ли их gzip.
+	LogFileMaxKB int32
+	LogFileCount int32
+	CompressLogs bool
+	// Как опрашивать fallback резолверы: DNSStrategySequential (по умолчанию),
+	// DNSStrategyParallel, DNSStrategyRoundRobin или DNSStrategyFastest.
+	DnsStrategy string
+	// Пускать fallback запросы через SOCKS5 демона, пока выбран exit node,
+	// чтобы публичные имена резолвились с той же стороны, что и трафик.
+	DnsViaExitNode bool
+	// Локальные DoH (путь /dns-query) и DoT для приложений со встроенным
+	// secure DNS; пустой адрес — выключено. DoH идёт по HTTPS, если DnsDohTLS.
+	DnsDohListen string
+	DnsDohTLS    bool
+	DnsDotListen string
+	// PEM сертификат и ключ для DoH и DoT; пусто — самоподписанный в DataDir/dns.
+	DnsTLSCertFile string
+	DnsTLSKeyFile  string
+	// Проверять DNSSEC публичных ответов от корневого якоря; bogus — SERVFAIL,
+	// а с битом CD в запросе — ответ как есть, без AD. Публичные имена тогда
+	// и в Running идут в fallback мимо форвардера демона (LocalAPI QueryDNS),
+	// который подписи не проверяет. Имена тейлнета и split DNS не проверяются.
+	DnsValidateDNSSEC bool
+	// Логины SOCKS5 "user:password" через запятую или перевод строки. Если
+	// заданы, на Socks5Server слушает фронт с авторизацией (RFC 1929), а HTTP
+	// прокси требует те же логины (Proxy-Authorization: Basic). Работает
+	// только с tsnet: у tailscaled прокси без пароля на loopback, поэтому
+	// с exec старт завершается StateFailed.
+	Socks5Credentials string
 }
 
 func SetLogLevel(level int32) {
-	stateMu.Lock()
-	defer stateMu.Unlock()
-	currentLogLevel = level
-}
-
-func logWithFilter(text string) {
-	stateMu.Lock()
-	lvl := currentLogLevel
-	stateMu.Unlock()
-
-	if lvl >= 1 {
-		lower := strings.ToLower(text)
-		if strings.Contains(lower, "magicsock") ||
-			strings.Contains(lower, "netcheck") ||
-			strings.Contains(lower, "ratelimit") ||
-			strings.Contains(lower, "udp proxy: received") ||
-			strings.Contains(lower, "logtail") {
-			return
-		}
-	}
-	slog.Info(text)
+	atomic.StoreInt32(&currentLogLevel, level)
 }
 
 func IsRunning() bool {
 	stateMu.Lock()
 	defer stateMu.Unlock()
-	return cmd != nil && cmd.Process != nil
+	return daemonSup != nil
 }
 
 // killLeftoverDaemons убивает зависшие процессы tailscaled от предыдущего запуска.
@@ -85,15 +106,13 @@ func Start(opt *StartOptions) {
 	Stop()
 	time.Sleep(1 * time.Second)
 
+	setState(StateStarting, "")
+
 	stateMu.Lock()
 	PC = newPathControl(opt.ExecPath, opt.SocketPath, opt.StatePath)
 	stateMu.Unlock()
-
-	killLeftoverDaemons(PC.Tailscaled())
-
-	if opt.SocketPath != "" {
-		_ = os.Remove(opt.SocketPath)
-	}
+	setLogFile(PC.DataDir("logs"), opt.LogFileMaxKB, opt.LogFileCount, opt.CompressLogs)
+	rememberOptions(opt)
 
 	if opt.Socks5Server == "" {
 		opt.Socks5Server = "127.0.0.1:1055"
@@ -102,22 +121,86 @@ func Start(opt *StartOptions) {
 		opt.HttpProxy = "127.0.0.1:1057"
 	}
 
-	go func() {
-		err := tailscaledCmd(PC, opt.Socks5Server, opt.HttpProxy)
+	// Без логинов демон слушает Socks5Server сам. С ними — только tsnet за
+	// фронтом, а если фронт не поднялся или бэкенд exec, не запускаемся вовсе,
+	// чтобы не открыть прокси без пароля. DNS прокси ходит в тейлнет через фронт.
+	socksAddr := opt.Socks5Server
+	var front *socks5Front
+	var frontLn net.Listener
+	if opt.Socks5Credentials != "" {
+		var err error
+		front, frontLn, err = listenSocks5Front(opt.Socks5Server, opt.Socks5Credentials)
 		if err != nil {
-			slog.Error("tailscaled cmd crashed", "err", err)
+			slog.Error("SOCKS5 authentication unavailable", "err", err)
+			setState(StateFailed, "SOCKS5 authentication: "+err.Error())
+			if opt.CloseCallBack != nil {
+				opt.CloseCallBack.Close()
+			}
+			return
+		}
+		socksAddr = front.internalAddr(frontLn.Addr().(*net.TCPAddr))
+		slog.Info("SOCKS5 authentication enabled", "addr", frontLn.Addr().String())
+	}
+
+	b := newBackend(PC, opt, front)
+	slog.Info("Using backend", "backend", b.name())
+	if front != nil && b.name() != BackendTsnet {
+		// tailscaled слушает SOCKS5 и HTTP прокси только на TCP, без пароля:
+		// любое приложение на устройстве обошло бы фронт через loopback.
+		frontLn.Close()
+		slog.Error("SOCKS5 authentication needs the tsnet backend")
+		setState(StateFailed, "SOCKS5 authentication needs the tsnet backend")
+		if opt.CloseCallBack != nil {
+			opt.CloseCallBack.Close()
 		}
+		return
+	}
+	b.prepare()
+
+	sup := newSupervisor(b.run)
+	sup.onRestart = func(ex daemonExit) {
+		setBackendState(StateStarting, "tailscaled restarting after exit code "+strconv.Itoa(ex.ExitCode))
+	}
+	sup.onGiveUp = func() {
 		Stop()
+		setState(StateFailed, "tailscaled keeps crashing")
 		if opt.CloseCallBack != nil {
 			opt.CloseCallBack.Close()
 		}
-	}()
+	}
+	stateMu.Lock()
+	daemonSup = sup
+	stateMu.Unlock()
+	sup.start()
+
+	resetBus()
+	dnsAnswers.flush()
+	loadTailnetDomains(PC.DataDir(tailnetDomainsFile))
+	if err := loadDNSRules(PC.DataDir(dnsRulesDir)); err != nil {
+		slog.Error("Loading DNS rules failed", "err", err)
+	}
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	stateMu.Lock()
+	sessionCancel = cancel
+	stateMu.Unlock()
+	go watchIPNBus(sessionCtx, currentLocalClient())
+
+	go registerMachineWithAuthKey(sessionCtx, PC, opt, b.name() == BackendExec)
 
-	go registerMachineWithAuthKey(PC, opt)
+	if front != nil {
+		activeSocks5Front.Store(front)
+		go func() {
+			if err := front.serve(sessionCtx, frontLn); err != nil {
+				slog.Error("SOCKS5 front stopped", "err", err)
+			}
+			activeSocks5Front.CompareAndSwap(front, nil)
+		}()
+	}
 
 	if opt.DnsProxy != "" {
+		// Прокси слушает сразу: до Running он отвечает на публичные имена
+		// через fallback, а тейлнет включается, когда демон готов (tailnetReady).
 		go func() {
-			time.Sleep(5 * time.Second)
 			slog.Info("Starting DNS proxy", "addr", opt.DnsProxy)
 
 			ctx, cancel := context.WithCancel(context.Background())
@@ -143,7 +226,25 @@ func Start(opt *StartOptions) {
 				doh = "https://1.1.1.1/dns-query"
 			}
 
-			if err := startDNSProxy(ctx, opt.DnsProxy, opt.Socks5Server, fallbacks, doh); err != nil {
+			up := newDNSUpstreams(fallbacks, doh, opt.DnsStrategy)
+			if opt.DnsViaExitNode {
+				up.exitSocks = socksAddr
+			}
+			if opt.DnsValidateDNSSEC {
+				up.dnssec = newDNSSECValidator(up.exchange)
+			}
+			var sec *dnsSecureConfig
+			if opt.DnsDohListen != "" || opt.DnsDotListen != "" {
+				sec = &dnsSecureConfig{
+					dohAddr:  opt.DnsDohListen,
+					dohTLS:   opt.DnsDohTLS,
+					dotAddr:  opt.DnsDotListen,
+					certFile: opt.DnsTLSCertFile,
+					keyFile:  opt.DnsTLSKeyFile,
+					dir:      PC.DataDir(dnsRulesDir),
+				}
+			}
+			if err := startDNSProxy(ctx, opt.DnsProxy, socksAddr, up, sec); err != nil {
 				slog.Error("DNS proxy stopped", "err", err)
 			}
 		}()
@@ -151,17 +252,32 @@ func Start(opt *StartOptions) {
 }
 
 func Stop() {
+	if st, _ := currentState(); st != StateStopped {
+		setState(StateStopping, "")
+		defer setState(StateStopped, "")
+	}
+
 	stateMu.Lock()
 	defer stateMu.Unlock()
 
 	StopWebUI()
 
+	if sessionCancel != nil {
+		sessionCancel()
+		sessionCancel = nil
+	}
+
 	if dnsProxyCancel != nil {
 		slog.Info("stop dns proxy")
 		dnsProxyCancel()
 		dnsProxyCancel = nil
 	}
 
+	if daemonSup != nil {
+		daemonSup.stop()
+		daemonSup = nil
+	}
+
 	x := cmd
 	cmd = nil
 
@@ -188,7 +304,8 @@ func RunTailscaleCmd(commandStr string) string {
 	args := []string{"--socket", PC.Socket()}
 	args = append(args, parts...)
 
-	c := exec.Command(PC.Tailscale(), args...)
+	// CLI прямо из .so: у tsnet симлинков нет.
+	c := exec.Command(PC.TailscaleCliSo(), args...)
 	output, err := c.CombinedOutput()
 
 	result := string(output)
@@ -198,7 +315,11 @@ func RunTailscaleCmd(commandStr string) string {
 	return result
 }
 
-func registerMachineWithAuthKey(PC pathControl, opt *StartOptions) {
+// registerMachineWithAuthKey поднимает ноду после старта демона. Prefs
+// сбрасываются только по DoReset. viaCLI — делать ли сброс через
+// `tailscale up --reset`: у tsnet нет отдельного демона, и всё делается
+// через LocalAPI.
+func registerMachineWithAuthKey(ctx context.Context, PC pathControl, opt *StartOptions, viaCLI bool) {
 	// 1. Сначала просто ждем появления сокета (до 15 секунд)
 	socketReady := false
 	for i := 0; i < 15; i++ {
@@ -206,39 +327,104 @@ func registerMachineWithAuthKey(PC pathControl, opt *StartOptions) {
 			socketReady = true
 			break
 		}
-		time.Sleep(1 * time.Second)
+		if !sleepCtx(ctx, 1*time.Second) {
+			return
+		}
 	}
 
 	if !socketReady {
 		slog.Error("Tailscaled socket never appeared")
+		setBackendState(StateFailed, "tailscaled socket never appeared")
 		return
 	}
 
 	slog.Info("Socket found, waiting 1s for daemon to be ready...")
-	time.Sleep(1 * time.Second)
+	if !sleepCtx(ctx, 1*time.Second) {
+		return
+	}
+
+	// 2. Без DoReset — сохраняем prefs, меняем только флаги, изменившиеся с прошлого старта
+	if !opt.DoReset {
+		err := upWithoutReset(ctx, newLocalClient(PC.Socket()), opt)
+		switch {
+		case err == nil:
+			slog.Info("tailscale is up, existing prefs preserved")
+			setBackendState(StateRunning, "")
+			if opt.EnableWebUI {
+				StartWebUI(opt.WebUIAddr)
+			}
+			return
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, errLoginTimedOut):
+			slog.Error("Interactive login timed out")
+			setLoginURL("")
+			setBackendState(StateFailed, "login timed out")
+			return
+		case errors.Is(err, errNeedsReset):
+			// Сброс стёр бы prefs из консоли; делаем его только по DoReset.
+			slog.Error("ExtraUpArgs cannot be applied without --reset, enable Force Hard Reset", "err", err)
+			setBackendState(StateFailed, err.Error()+" (enable Force Hard Reset)")
+			return
+		default:
+			// В том числе дедлок userspace-демона из README: его лечит
+			// --reset, но сбрасывать prefs без DoReset нельзя.
+			slog.Error("Startup without reset failed, enable Force Hard Reset if it keeps failing", "err", err)
+			setBackendState(StateFailed, err.Error()+" (enable Force Hard Reset)")
+			return
+		}
+	}
 
-	// 2. Пробуем выполнить команду up (до 3 попыток)
+	// Без ключа — интерактивный логин по ссылке
+	if opt.AuthKey == "" {
+		if loginInteractive(ctx, newLocalClient(PC.Socket()), opt) && opt.EnableWebUI {
+			StartWebUI(opt.WebUIAddr)
+		}
+		return
+	}
+
+	if !viaCLI {
+		lc := newLocalClient(PC.Socket())
+		if err := loginWithAuthKey(ctx, lc, opt); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Login with auth key failed", "err", err)
+				setBackendState(StateFailed, "login with auth key failed: "+err.Error())
+			}
+			return
+		}
+		setBackendState(StateRunning, "")
+		if opt.EnableWebUI {
+			StartWebUI(opt.WebUIAddr)
+		}
+		return
+	}
+
+	// 3. Пробуем выполнить команду up (до 3 попыток)
 	for attempt := 1; attempt <= 3; attempt++ {
-		// Жестко захардкоженный --reset для обхода дедлоков Android
+		// --reset для обхода дедлоков Android (только по DoReset)
 		args := []string{"--socket", PC.Socket(), "up", "--reset", "--timeout", "30s"}
 
-		if opt.AuthKey != "" {
-			args = append(args, "--auth-key", opt.AuthKey)
-		}
+		args = append(args, "--auth-key", opt.AuthKey)
 		if opt.ExtraUpArgs != "" {
 			args = append(args, strings.Fields(opt.ExtraUpArgs)...)
 		}
 
 		slog.Info("Running tailscale up", "attempt", attempt)
-		
-		c := exec.Command(PC.Tailscale(), args...)
+		setBackendState(StateConnecting, "")
+
+		c := exec.CommandContext(ctx, PC.Tailscale(), args...)
 		data, err := c.CombinedOutput()
 		output := string(data)
+		if ctx.Err() != nil {
+			return
+		}
 
 		// УСПЕШНОЕ ПОДКЛЮЧЕНИЕ
 		if err == nil {
 			slog.Info("tailscale up success", "output", output)
-			
+			rememberResetFlags(opt)
+			setBackendState(StateRunning, "")
+
 			// Стартуем Web UI, если галочка включена
 			if opt.EnableWebUI {
 				StartWebUI(opt.WebUIAddr)
@@ -248,14 +434,17 @@ func registerMachineWithAuthKey(PC pathControl, opt *StartOptions) {
 
 		// ЕСЛИ ОШИБКА
 		slog.Info("tailscale up failed", "output", output, "err", err)
-		
+
 		if strings.Contains(output, "invalid key") || strings.Contains(output, "API key does not exist") {
 			slog.Error("Critical Auth Error: Invalid Auth Key. Please check settings.")
+			setBackendState(StateFailed, "auth key rejected")
 			return
 		}
 
 		slog.Info("Retrying tailscale up in 5 seconds...")
-		time.Sleep(5 * time.Second)
+		if !sleepCtx(ctx, 5*time.Second) {
+			return
+		}
 	}
 
 	slog.Info("Daemon configured but slow to connect. Leaving it to finish in background.")
@@ -266,23 +455,25 @@ func StartWebUI(listenAddr string) {
 	if listenAddr == "" {
 		listenAddr = "127.0.0.1:8080"
 	}
-	slog.Info("Starting Web UI", "addr", listenAddr)
-	
+	webLog.Info("Starting Web UI", "addr", listenAddr)
+
 	args := []string{"--socket", PC.Socket(), "web", "--listen", listenAddr}
-	c := exec.Command(PC.Tailscale(), args...)
+	c := exec.Command(PC.TailscaleCliSo(), args...)
+	out := &lineWriter{source: LogSourceWebUI}
+	c.Stdout, c.Stderr = out, out
 	webCmd = c
-	
+
 	go func() {
 		err := c.Run()
 		if err != nil {
-			slog.Error("Web UI stopped", "err", err)
+			webLog.Error("Web UI stopped", "err", err)
 		}
 	}()
 }
 
 func StopWebUI() {
 	if webCmd != nil && webCmd.Process != nil {
-		slog.Info("Stopping Web UI")
+		webLog.Info("Stopping Web UI")
 		_ = webCmd.Process.Signal(syscall.SIGTERM)
 		go func(p *os.Process) {
 			time.Sleep(1 * time.Second)
@@ -290,4 +481,4 @@ func StopWebUI() {
 		}(webCmd.Process)
 		webCmd = nil
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,57 @@
+package appctr
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+const (
+	BackendExec  = "exec"  // отдельный процесс tailscaled (PIE из jniLibs)
+	BackendTsnet = "tsnet" // tailscale.com/tsnet внутри процесса приложения
+)
+
+// backend — способ поднять tailscale. Оба варианта отдают LocalAPI на PC.Socket()
+// и SOCKS5/HTTP прокси на тех же адресах, поэтому логин, IPN bus, консоль и DNS
+// работают с ними одинаково. Prefs tailscaled берёт из стейта, а tsnet на
+// каждом старте сбрасывает их, и tsnetBackend.run восстанавливает сохранённые.
+type backend interface {
+	name() string
+	// prepare вызывается один раз перед первым run.
+	prepare()
+	// run поднимает демон и блокируется, пока он не завершится или не отменят ctx.
+	run(ctx context.Context) error
+}
+
+// newBackend выбирает бэкенд по opt. Если задан front (SOCKS5 с паролем),
+// tsnet не слушает Socks5Server сам, а подключает к нему фронт; exec так не
+// умеет, и Start с фронтом его не запускает.
+func newBackend(p pathControl, opt *StartOptions, front *socks5Front) backend {
+	if opt.Backend == BackendTsnet {
+		if b := newTsnetBackend(p, opt, front); b != nil {
+			return b
+		}
+		slog.Warn("Built without the tsnet tag, using the exec backend")
+	}
+	return &execBackend{pc: p, socks5: opt.Socks5Server, http: opt.HttpProxy}
+}
+
+// execBackend — исходная схема: симлинки на .so и fork/exec tailscaled.
+type execBackend struct {
+	pc     pathControl
+	socks5 string
+	http   string
+}
+
+func (b *execBackend) name() string { return BackendExec }
+
+func (b *execBackend) prepare() {
+	killLeftoverDaemons(b.pc.Tailscaled())
+	if b.pc.Socket() != "" {
+		_ = os.Remove(b.pc.Socket())
+	}
+}
+
+func (b *execBackend) run(ctx context.Context) error {
+	return tailscaledCmd(ctx, b.pc, b.socks5, b.http)
+}
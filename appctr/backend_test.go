@@ -0,0 +1,123 @@
+package appctr
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestNewBackend(t *testing.T) {
+	p := fakeDaemon(t, "")
+	if b := newBackend(p, &StartOptions{}, nil); b.name() != BackendExec {
+		t.Errorf("default backend = %s", b.name())
+	}
+	// Без тега tsnet выбор tsnet откатывается на exec.
+	opt := &StartOptions{Backend: BackendTsnet}
+	want := BackendExec
+	if newTsnetBackend(p, opt, nil) != nil {
+		want = BackendTsnet
+	}
+	if b := newBackend(p, opt, nil); b.name() != want {
+		t.Errorf("backend = %s, want %s", b.name(), want)
+	}
+}
+
+// Прокси tailscaled без пароля на loopback: с логинами exec не стартует, и
+// адрес фронта освобождается.
+func TestStartRejectsCredentialsWithExec(t *testing.T) {
+	dir := t.TempDir()
+	socks := freeAddr(t)
+	Start(&StartOptions{
+		ExecPath:          filepath.Join(dir, "libtailscaled.so"),
+		SocketPath:        filepath.Join(dir, "tailscaled.sock"),
+		StatePath:         filepath.Join(dir, "state"),
+		Socks5Server:      socks,
+		HttpProxy:         freeAddr(t),
+		Socks5Credentials: "firefox:pass",
+	})
+	defer Stop()
+	if st, reason := currentState(); st != StateFailed || !strings.Contains(reason, "tsnet") {
+		t.Errorf("state = %v %q, want Failed asking for tsnet", st, reason)
+	}
+	if IsRunning() || activeSocks5Front.Load() != nil {
+		t.Error("exec started behind the SOCKS5 front")
+	}
+	l, err := net.Listen("tcp", socks)
+	if err != nil {
+		t.Fatalf("SOCKS5 address still taken: %v", err)
+	}
+	l.Close()
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d net.Dialer
+	hs := &http.Server{Handler: httpProxyHandler(d.DialContext)}
+	go hs.Serve(proxyLn)
+	defer hs.Close()
+
+	c, err := net.Dial("tcp", proxyLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("CONNECT = %v, %v", resp, err)
+	}
+	io.WriteString(c, "ping\n")
+	line, err := br.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("echo = %q, %v", line, err)
+	}
+
+	// Относительный URL — не прокси-запрос.
+	r, err := http.Get("http://" + proxyLn.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(r.Body)
+	r.Body.Close()
+	if r.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "bogus RequestURI") {
+		t.Errorf("relative request = %d %q", r.StatusCode, body)
+	}
+}
@@ -0,0 +1,266 @@
+//go:build tsnet
+
+package appctr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"tailscale.com/envknob"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
+	"tailscale.com/logtail"
+	"tailscale.com/net/socks5"
+	"tailscale.com/tsnet"
+)
+
+// tsnetBackend поднимает tailscale внутри процесса приложения через tsnet.
+// Снаружи он выглядит как tailscaled: LocalAPI проброшен на unix-сокет,
+// SOCKS5 и HTTP прокси слушают те же адреса, CLI работает через сокет.
+type tsnetBackend struct {
+	pc      pathControl
+	socks5  string // пусто — SOCKS5 только для фронта, через socksIn
+	http    string
+	upArgs  string
+	authKey string
+	// keepPrefs — восстанавливать prefs после Start (без DoReset).
+	keepPrefs bool
+	// front — SOCKS5 с паролем; его логины закрывают и HTTP прокси.
+	front *socks5Front
+	// socksIn — SOCKS5 текущего запуска для фронта, без порта.
+	socksIn atomic.Pointer[connListener]
+}
+
+func newTsnetBackend(p pathControl, opt *StartOptions, front *socks5Front) backend {
+	b := &tsnetBackend{pc: p, socks5: opt.Socks5Server, http: opt.HttpProxy, upArgs: opt.ExtraUpArgs, authKey: opt.AuthKey, keepPrefs: !opt.DoReset}
+	if front != nil {
+		b.socks5, b.front = "", front
+		front.inProcess = b.dialSocks5
+	}
+	return b
+}
+
+// dialSocks5 подключает фронт к SOCKS5 текущего запуска tsnet.
+func (b *tsnetBackend) dialSocks5(ctx context.Context, local net.Addr) (net.Conn, error) {
+	in := b.socksIn.Load()
+	if in == nil {
+		return nil, errors.New("tsnet is not running")
+	}
+	return in.dial(ctx, local)
+}
+
+func (b *tsnetBackend) name() string { return BackendTsnet }
+
+// prepare не трогает чужие процессы и симлинки: демона нет, а консоль и
+// Web UI запускают CLI прямо из .so. Остаётся только старый сокет.
+func (b *tsnetBackend) prepare() {
+	if b.pc.Socket() != "" {
+		_ = os.Remove(b.pc.Socket())
+	}
+}
+
+func (b *tsnetBackend) run(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// То же, что TS_NO_LOGS_NO_SUPPORT у tailscaled.
+	envknob.SetNoLogsNoSupport()
+	logtail.Disable()
+
+	logf := func(format string, args ...any) { logDaemonLine(LogSourceTailscaled, fmt.Sprintf(format, args...)) }
+	// Тот же файл, что tsnet открыл бы сам: prefs из него нужны до Start.
+	st, err := store.New(logf, filepath.Join(b.pc.State(), "tailscaled.state"))
+	if err != nil {
+		return fmt.Errorf("state store: %w", err)
+	}
+	srv := &tsnet.Server{
+		Dir:      b.pc.State(),
+		Store:    st,
+		Hostname: b.hostname(),
+		Logf:     logf,
+		// Ключ используется, только если ноде нужен логин; дальше логином
+		// занимается registerMachineWithAuthKey через LocalAPI.
+		AuthKey: b.authKey,
+	}
+	f, _ := parseUpArgs(b.upArgs)
+	if f != nil && f.loginServer != "" {
+		srv.ControlURL = f.loginServer
+	}
+
+	// Start заменяет prefs профиля на ipn.NewPrefs(): без этого каждый запуск
+	// и рестарт супервизором терял бы exit node, маршруты и accept-dns.
+	var saved *ipn.Prefs
+	if b.keepPrefs {
+		saved = savedTsnetPrefs(st)
+	}
+	if saved != nil {
+		if srv.ControlURL == "" {
+			srv.ControlURL = saved.ControlURL
+		}
+		if (f == nil || f.hostname == "") && saved.Hostname != "" {
+			srv.Hostname = saved.Hostname
+		}
+		srv.AdvertiseTags = saved.AdvertiseTags
+	}
+	defer srv.Close()
+
+	if err := srv.Start(); err != nil {
+		return err
+	}
+	lc, err := srv.LocalClient()
+	if err != nil {
+		return err
+	}
+	if saved != nil {
+		// До сокета LocalAPI: registerMachineWithAuthKey применит флаги
+		// приложения уже поверх восстановленных prefs.
+		if _, err := lc.EditPrefs(ctx, restoredPrefs(saved)); err != nil {
+			slog.Error("Restoring prefs after tsnet start failed", "err", err)
+		} else {
+			slog.Info("Restored prefs after tsnet start")
+		}
+	}
+
+	var lns []net.Listener
+	defer func() {
+		for _, l := range lns {
+			l.Close()
+		}
+	}()
+	listen := func(network, addr string) (net.Listener, error) {
+		l, err := net.Listen(network, addr)
+		if err == nil {
+			lns = append(lns, l)
+		}
+		return l, err
+	}
+
+	_ = os.Remove(b.pc.Socket())
+	sockLn, err := listen("unix", b.pc.Socket())
+	if err != nil {
+		return fmt.Errorf("LocalAPI socket: %w", err)
+	}
+	var socksLn net.Listener
+	if b.socks5 == "" {
+		in := newConnListener()
+		lns = append(lns, in)
+		b.socksIn.Store(in)
+		defer b.socksIn.CompareAndSwap(in, nil)
+		socksLn = in
+	} else if socksLn, err = listen("tcp", b.socks5); err != nil {
+		return fmt.Errorf("SOCKS5 listener: %w", err)
+	}
+	httpLn, err := listen("tcp", b.http)
+	if err != nil {
+		return fmt.Errorf("HTTP proxy listener: %w", err)
+	}
+
+	errc := make(chan error, 3)
+	go func() { errc <- serveLocalAPIBridge(sockLn, lc.Dial) }()
+	go func() {
+		ss := &socks5.Server{
+			Logf: func(format string, args ...any) {
+				logDaemonLine(LogSourceTailscaled, "socks5: "+fmt.Sprintf(format, args...))
+			},
+			Dialer: srv.Dial,
+		}
+		errc <- fmt.Errorf("SOCKS5 server exited: %w", ss.Serve(socksLn))
+	}()
+	handler := httpProxyHandler(srv.Dial)
+	if b.front != nil {
+		handler = b.front.httpProxy(srv.Dial)
+	}
+	hs := &http.Server{Handler: handler}
+	defer hs.Close()
+	go func() { errc <- fmt.Errorf("HTTP proxy exited: %w", hs.Serve(httpLn)) }()
+
+	slog.Info("tsnet started", "socket", b.pc.Socket(), "socks5", socksLn.Addr(), "http", httpLn.Addr())
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errc:
+		return err
+	}
+}
+
+// savedTsnetPrefs читает prefs текущего профиля из стейта; nil — профиля ещё нет.
+func savedTsnetPrefs(st ipn.StateStore) *ipn.Prefs {
+	key, err := st.ReadState(ipn.CurrentProfileStateKey)
+	if err == nil && len(key) > 0 {
+		var data []byte
+		if data, err = st.ReadState(ipn.StateKey(key)); err == nil && len(data) > 0 {
+			p := ipn.NewPrefs()
+			if err = ipn.PrefsFromBytes(data, p); err == nil {
+				return p
+			}
+		}
+	}
+	if err != nil && !errors.Is(err, ipn.ErrStateNotExist) {
+		slog.Warn("Reading saved tsnet prefs failed", "err", err)
+	}
+	return nil
+}
+
+// restoredPrefs — PATCH, возвращающий то, что Start сбросил к умолчаниям.
+// Hostname, ControlURL и теги tsnet получает до Start.
+func restoredPrefs(saved *ipn.Prefs) *ipn.MaskedPrefs {
+	return &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			RouteAll:               saved.RouteAll,
+			ExitNodeID:             saved.ExitNodeID,
+			ExitNodeIP:             saved.ExitNodeIP,
+			ExitNodeAllowLANAccess: saved.ExitNodeAllowLANAccess,
+			CorpDNS:                saved.CorpDNS,
+			ShieldsUp:              saved.ShieldsUp,
+			AdvertiseRoutes:        saved.AdvertiseRoutes,
+			RunSSH:                 saved.RunSSH,
+			NoSNAT:                 saved.NoSNAT,
+		},
+		RouteAllSet:               true,
+		ExitNodeIDSet:             true,
+		ExitNodeIPSet:             true,
+		ExitNodeAllowLANAccessSet: true,
+		CorpDNSSet:                true,
+		ShieldsUpSet:              true,
+		AdvertiseRoutesSet:        true,
+		RunSSHSet:                 true,
+		NoSNATSet:                 true,
+	}
+}
+
+func (b *tsnetBackend) hostname() string {
+	if f, err := parseUpArgs(b.upArgs); err == nil && f.hostname != "" {
+		return f.hostname
+	}
+	// Как у tailscaled: без --hostname берётся имя системы.
+	h, _ := os.Hostname()
+	return h
+}
+
+// serveLocalAPIBridge пробрасывает соединения с unix-сокета в in-memory LocalAPI tsnet.
+func serveLocalAPIBridge(ln net.Listener, dial dialFunc) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("LocalAPI bridge: %w", err)
+		}
+		go func() {
+			defer c.Close()
+			up, err := dial(context.Background(), "tcp", localAPIHost+":80")
+			if err != nil {
+				slog.Error("LocalAPI bridge dial failed", "err", err)
+				return
+			}
+			defer up.Close()
+			pipe(c, up)
+		}()
+	}
+}
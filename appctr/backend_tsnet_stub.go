@@ -0,0 +1,7 @@
+//go:build !tsnet
+
+package appctr
+
+// Без тега tsnet in-process бэкенд не собирается, чтобы не тащить tsnet в
+// обычную сборку; newBackend тогда откатывается на exec.
+func newTsnetBackend(p pathControl, opt *StartOptions, front *socks5Front) backend { return nil }
@@ -0,0 +1,220 @@
+//go:build tsnet
+
+package appctr
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"tailscale.com/derp/derpserver"
+	"tailscale.com/net/netns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
+)
+
+func TestTsnetBackendOptions(t *testing.T) {
+	p := fakeDaemon(t, "")
+	b := newBackend(p, &StartOptions{Backend: BackendTsnet, AuthKey: "tskey-123", ExtraUpArgs: "--hostname=phone --accept-routes"}, nil)
+	tb, ok := b.(*tsnetBackend)
+	if !ok {
+		t.Fatalf("backend = %s", b.name())
+	}
+	if h := tb.hostname(); h != "phone" {
+		t.Errorf("hostname = %q", h)
+	}
+	if tb.authKey != "tskey-123" {
+		t.Errorf("authKey = %q", tb.authKey)
+	}
+
+	// С фронтом свой SOCKS5 не слушает порт: фронт ходит в него внутри процесса.
+	front := newSocks5Front(socks5Credentials{"firefox": "pass"})
+	fb := newBackend(p, &StartOptions{Backend: BackendTsnet, Socks5Server: "127.0.0.1:1055"}, front).(*tsnetBackend)
+	if fb.socks5 != "" || front.inProcess == nil {
+		t.Errorf("tsnet behind the front: socks5 %q, in-process dial %v", fb.socks5, front.inProcess != nil)
+	}
+
+	// prepare не создаёт симлинк на CLI.
+	tb.prepare()
+	if _, err := os.Lstat(p.Tailscale()); err == nil {
+		t.Error("tsnet prepare created the CLI symlink")
+	}
+}
+
+func TestTsnetBackend(t *testing.T) {
+	p := fakeDaemon(t, "")
+	socks := freeAddr(t)
+	b := &tsnetBackend{pc: p, socks5: socks, http: freeAddr(t), upArgs: "--login-server=http://127.0.0.1:1"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.run(ctx) }()
+
+	// LocalAPI доступен через unix-сокет, как у tailscaled.
+	lc := newLocalClient(p.Socket())
+	var st *localStatus
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		var err error
+		if _, serr := os.Stat(p.Socket()); serr == nil {
+			if st, err = lc.Status(context.Background()); err == nil {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("LocalAPI not reachable: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if st.BackendState == "Running" {
+		t.Errorf("BackendState = Running without control server")
+	}
+	prefs, err := lc.Prefs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs.ControlURL != "http://127.0.0.1:1" {
+		t.Errorf("ControlURL = %q", prefs.ControlURL)
+	}
+
+	// SOCKS5 отвечает на приветствие без аутентификации.
+	c, err := net.Dial("tcp", socks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte{5, 1, 0})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil || reply[0] != 5 || reply[1] != 0 {
+		t.Errorf("socks5 greeting reply = %v, %v", reply, err)
+	}
+	c.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("run = %v, want context.Canceled", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("run did not return after cancel")
+	}
+}
+
+// startTestControl поднимает control-сервер с одним DERP, как в тестах tsnet:
+// без живого DERP нода не доходит до Running.
+func startTestControl(t *testing.T) string {
+	t.Helper()
+	netns.SetEnabled(false)
+	t.Cleanup(func() { netns.SetEnabled(true) })
+
+	d := derpserver.New(key.NewNode(), t.Logf)
+	t.Cleanup(func() { d.Close() })
+	derp := httptest.NewUnstartedServer(derpserver.Handler(d))
+	derp.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	derp.StartTLS()
+	t.Cleanup(derp.Close)
+
+	control := &testcontrol.Server{Logf: t.Logf, DERPMap: &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, RegionCode: "test", Nodes: []*tailcfg.DERPNode{{
+			Name:             "t1",
+			RegionID:         1,
+			HostName:         "127.0.0.1",
+			IPv4:             "127.0.0.1",
+			IPv6:             "none",
+			STUNPort:         -1,
+			DERPPort:         derp.Listener.Addr().(*net.TCPAddr).Port,
+			InsecureForTests: true,
+		}}},
+	}}}
+	control.HTTPTestServer = httptest.NewUnstartedServer(control)
+	control.HTTPTestServer.Start()
+	t.Cleanup(control.HTTPTestServer.Close)
+	return control.HTTPTestServer.URL
+}
+
+func waitTsnetRunning(t *testing.T, lc *localClient) {
+	t.Helper()
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		st, err := lc.Status(context.Background())
+		if err == nil && st.BackendState == "Running" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tsnet not Running: %+v, %v", st, err)
+		}
+	}
+}
+
+// tsnet.Server.Start сбрасывает prefs к умолчаниям; после рестарта
+// супервизором они должны быть такими же, как до падения.
+func TestTsnetPrefsSurviveRestart(t *testing.T) {
+	controlURL := startTestControl(t)
+	p := fakeDaemon(t, "")
+	b := newBackend(p, &StartOptions{
+		Backend:      BackendTsnet,
+		Socks5Server: freeAddr(t),
+		HttpProxy:    freeAddr(t),
+		ExtraUpArgs:  "--hostname=phone --login-server=" + controlURL,
+	}, nil)
+
+	// kill роняет текущий запуск, как падение демона.
+	kill := make(chan struct{})
+	sup := newSupervisor(func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-kill:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		b.run(ctx)
+		return errors.New("tsnet killed")
+	})
+	sup.minBackoff = 10 * time.Millisecond
+	sup.start()
+	t.Cleanup(func() { sup.stop(); <-sup.done })
+
+	lc := newLocalClient(p.Socket())
+	waitTsnetRunning(t, lc)
+	route := netip.MustParsePrefix("10.1.0.0/24")
+	_, err := lc.EditPrefs(context.Background(), &localMaskedPrefs{
+		localPrefs:         localPrefs{RouteAll: true, ShieldsUp: true, AdvertiseRoutes: []netip.Prefix{route}},
+		RouteAllSet:        true,
+		CorpDNSSet:         true,
+		ShieldsUpSet:       true,
+		AdvertiseRoutesSet: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exits := len(daemonExits())
+	kill <- struct{}{}
+	for deadline := time.Now().Add(10 * time.Second); len(daemonExits()) == exits; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("supervisor did not see the exit")
+		}
+	}
+	waitTsnetRunning(t, lc)
+
+	prefs, err := lc.Prefs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prefs.RouteAll || prefs.CorpDNS || !prefs.ShieldsUp || !slices.Equal(prefs.AdvertiseRoutes, []netip.Prefix{route}) || prefs.Hostname != "phone" {
+		t.Errorf("prefs after restart = %+v", prefs)
+	}
+}
@@ -54,8 +54,13 @@ go mod tidy
 # Создаем временную папку для aar
 mkdir -p tmp
 
-# Передаем те же теги в gomobile, чтобы обертка соответствовала ядру
-gomobile bind -ldflags='-s -w -buildid= -checklinkname=0' -trimpath -target="android/arm64" -androidapi 21 -tags "$TAGS" -o tmp/appctr.aar -v .
+# Передаем те же теги в gomobile, чтобы обертка соответствовала ядру.
+# In-process бэкенд (tsnet) собирается только по запросу: WITH_TSNET=1 ./build.sh
+APPCTR_TAGS="$TAGS"
+if [ -n "$WITH_TSNET" ]; then
+    APPCTR_TAGS="$TAGS,tsnet"
+fi
+gomobile bind -ldflags='-s -w -buildid= -checklinkname=0' -trimpath -target="android/arm64" -androidapi 21 -tags "$APPCTR_TAGS" -o tmp/appctr.aar -v .
 
 echo "📦 Copying binaries to jniLibs..."
 mkdir -p ../app/src/main/jniLibs/arm64-v8a
@@ -0,0 +1,238 @@
+package appctr
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+var lastOptions *StartOptions
+
+// rememberOptions сохраняет копию StartOptions последнего Start для debug bundle.
+func rememberOptions(opt *StartOptions) {
+	o := *opt
+	o.CloseCallBack = nil
+	stateMu.Lock()
+	lastOptions = &o
+	stateMu.Unlock()
+}
+
+var authKeyArg = regexp.MustCompile(`(--auth-key[= ])\S+`)
+
+// socks5PasswordArg — пароль в "user:password"; имена оставляем для отладки.
+var socks5PasswordArg = regexp.MustCompile(`([^:,\n]+:)[^,\n]*`)
+
+// redactOptions убирает из StartOptions секреты: ключи и пароли не должны
+// попадать в bundle, который пользователь пересылает в чат.
+func redactOptions(opt *StartOptions) *StartOptions {
+	if opt == nil {
+		return nil
+	}
+	o := *opt
+	o.CloseCallBack = nil
+	if o.AuthKey != "" {
+		o.AuthKey = redacted
+	}
+	o.ExtraUpArgs = authKeyArg.ReplaceAllString(o.ExtraUpArgs, "${1}"+redacted)
+	o.Socks5Credentials = socks5PasswordArg.ReplaceAllString(o.Socks5Credentials, "${1}"+redacted)
+	return &o
+}
+
+type debugInfo struct {
+	Time        time.Time
+	State       string
+	StateReason string
+	Running     bool
+	GoVersion   string
+	OS          string
+	Arch        string
+}
+
+type debugPeer struct {
+	HostName     string
+	DNSName      string
+	OS           string
+	TailscaleIPs []string
+	Online       bool
+	Active       bool
+	ExitNode     bool
+	Relay        string
+	LastSeen     time.Time
+}
+
+type debugStatus struct {
+	BackendState   string
+	HaveNodeKey    bool
+	TailscaleIPs   []string
+	Health         []string
+	MagicDNSSuffix string
+	Self           *debugPeer
+	PeersTotal     int
+	PeersOnline    int
+	Peers          []debugPeer
+}
+
+func toDebugPeer(p *localPeer) debugPeer {
+	dp := debugPeer{
+		HostName: p.HostName, DNSName: p.DNSName, OS: p.OS,
+		Online: p.Online, Active: p.Active, ExitNode: p.ExitNode,
+		Relay: p.Relay, LastSeen: p.LastSeen,
+	}
+	for _, ip := range p.TailscaleIPs {
+		dp.TailscaleIPs = append(dp.TailscaleIPs, ip.String())
+	}
+	return dp
+}
+
+// summarizeStatus оставляет из status то, что нужно для отладки:
+// без ключей нод и публичных адресов (CurAddr).
+func summarizeStatus(st *localStatus) debugStatus {
+	ds := debugStatus{
+		BackendState:   st.BackendState,
+		HaveNodeKey:    st.HaveNodeKey,
+		Health:         st.Health,
+		MagicDNSSuffix: st.MagicDNSSuffix,
+		PeersTotal:     len(st.Peer),
+	}
+	for _, ip := range st.TailscaleIPs {
+		ds.TailscaleIPs = append(ds.TailscaleIPs, ip.String())
+	}
+	if st.Self != nil {
+		self := toDebugPeer(st.Self)
+		ds.Self = &self
+	}
+	for _, p := range st.Peer {
+		if p == nil {
+			continue
+		}
+		if p.Online {
+			ds.PeersOnline++
+		}
+		ds.Peers = append(ds.Peers, toDebugPeer(p))
+	}
+	return ds
+}
+
+type debugNetMap struct {
+	busNetMap
+	DNS localDNSConfig
+}
+
+// CreateDebugBundle пишет в path zip с логами, настройками запуска (без
+// секретов), сводками LocalAPI, статистикой DNS прокси и историей падений.
+func CreateDebugBundle(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	err = writeDebugBundle(zw)
+	return errors.Join(err, zw.Close(), f.Close())
+}
+
+func writeDebugBundle(zw *zip.Writer) error {
+	addJSON := func(name string, v any) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	// Ошибки LocalAPI не прерывают сборку: демон может быть мёртв,
+	// а bundle нужен как раз тогда.
+	addResult := func(name string, v any, err error) error {
+		if err != nil {
+			return addJSON(name, map[string]string{"Error": err.Error()})
+		}
+		return addJSON(name, v)
+	}
+
+	st, reason := currentState()
+	if err := addJSON("info.json", debugInfo{
+		Time:        time.Now(),
+		State:       st.String(),
+		StateReason: reason,
+		Running:     IsRunning(),
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+	}); err != nil {
+		return err
+	}
+
+	stateMu.Lock()
+	opt := redactOptions(lastOptions)
+	stateMu.Unlock()
+	if err := addJSON("start-options.json", opt); err != nil {
+		return err
+	}
+
+	lc := currentLocalClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	status, err := lc.Status(ctx)
+	var statusSum any
+	if err == nil {
+		statusSum = summarizeStatus(status)
+	}
+	if err := addResult("status.json", statusSum, err); err != nil {
+		return err
+	}
+	prefs, err := lc.Prefs(ctx)
+	if err := addResult("prefs.json", prefs, err); err != nil {
+		return err
+	}
+	nm := currentNetMap()
+	if nm == nil {
+		nm, err = lc.NetMap(ctx)
+	}
+	if nm != nil {
+		err = addJSON("netmap.json", debugNetMap{busNetMap: summarizeNetMap(nm), DNS: nm.DNS})
+	} else {
+		err = addResult("netmap.json", nil, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := addJSON("dns-stats.json", dnsStats.snapshot()); err != nil {
+		return err
+	}
+	if err := addJSON("daemon-exits.json", daemonExits()); err != nil {
+		return err
+	}
+
+	// Весь буфер, включая DEBUG, который скрыт в GetLogs.
+	recs, _ := logManager.query(logQuery{MinLevel: slog.LevelDebug})
+	w, err := zw.Create("log-buffer.txt")
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	for i := range recs {
+		sb.WriteString(recs[i].format("2006-01-02 15:04:05.000"))
+		sb.WriteByte('\n')
+	}
+	if _, err := w.Write([]byte(sb.String())); err != nil {
+		return err
+	}
+
+	logFileMu.Lock()
+	lf := logFile
+	logFileMu.Unlock()
+	if lf != nil {
+		return lf.addToZip(zw, "logs")
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package appctr
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactOptions(t *testing.T) {
+	opt := &StartOptions{AuthKey: "tskey-auth-secret", ExtraUpArgs: "--hostname=phone --auth-key=tskey-auth-other --auth-key tskey-3"}
+	r := redactOptions(opt)
+	if r.AuthKey != redacted || strings.Contains(r.ExtraUpArgs, "tskey") || !strings.Contains(r.ExtraUpArgs, "--hostname=phone") {
+		t.Errorf("redacted = %+v", r)
+	}
+	if opt.AuthKey != "tskey-auth-secret" {
+		t.Error("redactOptions modified the original")
+	}
+
+	opt.Socks5Credentials = "firefox:s3cret, telegram:pa:ss\nbot:hunter2"
+	r = redactOptions(opt)
+	if want := "firefox:" + redacted + ", telegram:" + redacted + "\nbot:" + redacted; r.Socks5Credentials != want {
+		t.Errorf("Socks5Credentials = %q, want %q", r.Socks5Credentials, want)
+	}
+}
+
+func TestCreateDebugBundle(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "tailscaled.sock")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"BackendState": "Running",
+			"Self":         map[string]any{"HostName": "phone", "PublicKey": "nodekey:self"},
+			"Peer": map[string]any{
+				"nodekey:1": map[string]any{"HostName": "nas", "PublicKey": "nodekey:1", "CurAddr": "203.0.113.5:41641", "Online": true},
+			},
+		})
+	})
+	mux.HandleFunc("/localapi/v0/prefs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"ControlURL": "https://controlplane.tailscale.com", "WantRunning": true})
+	})
+	mux.HandleFunc("/localapi/v0/watch-ipn-bus", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"NetMap": map[string]any{"Domain": "tail1.ts.net"}})
+	})
+	serveLocalAPI(t, sock, mux)
+
+	stateMu.Lock()
+	oldPC := PC
+	PC = newPathControl(filepath.Join(dir, "lib", "libtailscale.so"), sock, filepath.Join(dir, "state"))
+	stateMu.Unlock()
+	t.Cleanup(func() {
+		stateMu.Lock()
+		PC = oldPC
+		lastOptions = nil
+		stateMu.Unlock()
+	})
+	rememberOptions(&StartOptions{AuthKey: "tskey-auth-secret", Socks5Server: "127.0.0.1:1055"})
+
+	out := filepath.Join(dir, "bundle.zip")
+	if err := CreateDebugBundle(out); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+		if strings.Contains(string(data), "tskey-auth-secret") || strings.Contains(string(data), "203.0.113.5") || strings.Contains(string(data), "nodekey:") {
+			t.Errorf("%s leaks a secret or endpoint: %s", f.Name, data)
+		}
+	}
+	for _, name := range []string{"info.json", "start-options.json", "status.json", "prefs.json", "netmap.json", "dns-stats.json", "daemon-exits.json", "log-buffer.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("bundle has no %s", name)
+		}
+	}
+
+	var st debugStatus
+	if err := json.Unmarshal([]byte(files["status.json"]), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.BackendState != "Running" || st.PeersTotal != 1 || st.PeersOnline != 1 {
+		t.Errorf("status = %+v", st)
+	}
+	var opt StartOptions
+	if err := json.Unmarshal([]byte(files["start-options.json"]), &opt); err != nil {
+		t.Fatal(err)
+	}
+	if opt.AuthKey != redacted || opt.Socks5Server != "127.0.0.1:1055" {
+		t.Errorf("start options = %+v", opt)
+	}
+	if !strings.Contains(files["netmap.json"], "tail1.ts.net") {
+		t.Errorf("netmap = %s", files["netmap.json"])
+	}
+}
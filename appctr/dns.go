@@ -2,37 +2,121 @@ package appctr
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io"
-	"log/slog"
 	"net"
-	"net/http"
+	"net/netip"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/net/proxy"
 )
 
-var dnsCache sync.Map
-var splitDNSCache sync.Map
-var splitDNSLastUpdate time.Time
-var splitDNSMutex sync.Mutex
+// dnsCounters — счётчики DNS прокси с момента запуска процесса.
+type dnsCounters struct {
+	Queries  atomic.Int64
+	Rules    atomic.Int64
+	Tailnet  atomic.Int64
+	Split    atomic.Int64
+	LocalAPI atomic.Int64
+	Quad100  atomic.Int64
+	Fallback atomic.Int64
+	Failed   atomic.Int64
+	Refused  atomic.Int64
+	// Отказы по лимитам: частота клиента, переполненная очередь воркеров.
+	Limited atomic.Int64
+	Dropped atomic.Int64
+	// Запросы, получившие ответ одновременного такого же запроса.
+	Coalesced atomic.Int64
+	// Ответы fallback, не прошедшие проверку DNSSEC.
+	Bogus atomic.Int64
+}
+
+var dnsStats dnsCounters
+
+type dnsStatsSnapshot struct {
+	Queries   int64
+	Rules     int64
+	Tailnet   int64
+	Split     int64
+	LocalAPI  int64
+	Quad100   int64
+	Fallback  int64
+	Failed    int64
+	Refused   int64
+	Limited   int64
+	Dropped   int64
+	Coalesced int64
+	Bogus     int64
+	Tiers     map[string]dnsTierStats
+	RCodes    map[string]int64
+	Types     map[string]int64
+	Cache     dnsCacheStats
+	Upstreams []dnsUpstreamStats `json:",omitempty"`
+	RuleHits  []dnsRuleStats     `json:",omitempty"`
+}
+
+func (c *dnsCounters) snapshot() dnsStatsSnapshot {
+	s := dnsStatsSnapshot{
+		Queries:   c.Queries.Load(),
+		Rules:     c.Rules.Load(),
+		Tailnet:   c.Tailnet.Load(),
+		Split:     c.Split.Load(),
+		LocalAPI:  c.LocalAPI.Load(),
+		Quad100:   c.Quad100.Load(),
+		Fallback:  c.Fallback.Load(),
+		Failed:    c.Failed.Load(),
+		Refused:   c.Refused.Load(),
+		Limited:   c.Limited.Load(),
+		Dropped:   c.Dropped.Load(),
+		Coalesced: c.Coalesced.Load(),
+		Bogus:     c.Bogus.Load(),
+		Cache:     dnsAnswers.stats(),
+	}
+	if p := activeUpstreams.Load(); p != nil {
+		s.Upstreams = p.stats()
+	}
+	s.RuleHits = dnsRules.Load().stats()
+	s.Tiers, s.RCodes, s.Types = dnsQueries.aggregate()
+	return s
+}
 
-func startDNSProxy(ctx context.Context, listenAddr string, socksAddr string, fallbacks []string, dohUrl string) error {
+// startDNSProxy слушает DNS по UDP и TCP на listenAddr, а если задан sec —
+// ещё DoH и DoT. Все пути идут через общие лимиты и processDNSQuery.
+func startDNSProxy(ctx context.Context, listenAddr string, socksAddr string, up *dnsUpstreams, sec *dnsSecureConfig) error {
 	pc, err := net.ListenPacket("udp", listenAddr)
 	if err != nil {
 		return fmt.Errorf("dns proxy listen failed: %w", err)
 	}
 	defer pc.Close()
-	slog.Info("DNS proxy listening", "addr", listenAddr)
+	dnsLog.Info("DNS proxy listening", "addr", listenAddr)
+
+	handle := func(q []byte, client net.Addr) []byte { return processDNSQuery(q, client.String(), up, socksAddr) }
+	lim := dnsProxyLimits
+	pool := newDNSWorkerPool(ctx, lim.workers, lim.backlog)
+	defer pool.wait()
+	limiter := newDNSClientLimiter(lim.clientRate, lim.clientBurst)
+
+	guarded := guardDNSHandler(ctx, pool, limiter, handle)
+
+	// DNS over TCP на том же адресе: туда клиенты уходят после TC и с большими ответами.
+	if ln, err := net.Listen("tcp", pc.LocalAddr().String()); err != nil {
+		dnsLog.Error("DNS proxy TCP listen failed, serving UDP only", "err", err)
+	} else {
+		go func() {
+			if err := serveDNSTCP(ctx, ln, guarded); err != nil {
+				dnsLog.Error("DNS proxy TCP stopped", "err", err)
+			}
+		}()
+	}
+	if sec != nil {
+		startSecureDNS(ctx, sec, guarded)
+	}
 
 	go func() {
 		<-ctx.Done()
-		slog.Info("DNS proxy context cancelled, shutting down")
+		dnsLog.Info("DNS proxy context cancelled, shutting down")
 		pc.Close()
 	}()
 
@@ -45,60 +129,30 @@ func startDNSProxy(ctx context.Context, listenAddr string, socksAddr string, fal
 			}
 			return err
 		}
+		// По UDP лишнее молча отбрасываем: ответ на флуд только помогает флуду.
+		if !limiter.allow(clientAddr) {
+			dnsStats.Limited.Add(1)
+			continue
+		}
 		query := make([]byte, n)
 		copy(query, buf[:n])
 
-		go func(q []byte, cAddr net.Addr) {
-			resp := processDNSQuery(q, fallbacks, socksAddr, dohUrl)
+		if !pool.trySubmit(func() {
+			resp := handle(query, clientAddr)
 			if resp != nil {
-				if _, err := pc.WriteTo(resp, cAddr); err != nil {
-					slog.Debug("DNS write back error", "err", err)
+				resp = truncateDNSResponse(resp, udpPayloadSize(query))
+				if _, err := pc.WriteTo(resp, clientAddr); err != nil {
+					dnsLog.Debug("DNS write back error", "err", err)
 				}
 			}
-		}(query, clientAddr)
-	}
-}
-
-func getSplitDNSServers(domain string) []string {
-	splitDNSMutex.Lock()
-	defer splitDNSMutex.Unlock()
-
-	if time.Since(splitDNSLastUpdate) > 60*time.Second {
-		out := RunTailscaleCmd("dns status --json")
-		var status struct {
-			SplitDNSRoutes map[string][]struct{ Addr string }
-		}
-		if err := json.Unmarshal([]byte(out), &status); err == nil {
-			splitDNSCache.Range(func(key, value interface{}) bool {
-				splitDNSCache.Delete(key)
-				return true
-			})
-			for d, addrs := range status.SplitDNSRoutes {
-				d = strings.TrimSuffix(d, ".")
-				var ips []string
-				for _, a := range addrs {
-					ips = append(ips, a.Addr)
-				}
-				splitDNSCache.Store(d, ips)
-			}
-			splitDNSLastUpdate = time.Now()
+		}) {
+			dnsStats.Dropped.Add(1)
 		}
 	}
-
-	var match []string
-	splitDNSCache.Range(func(key, value interface{}) bool {
-		route := key.(string)
-		if domain == route || strings.HasSuffix(domain, "."+route) {
-			match = value.([]string)
-			return false
-		}
-		return true
-	})
-	return match
 }
 
 func forwardDNSviaSOCKS5(query []byte, socksAddr string, dnsServer string) ([]byte, error) {
-	dialer, err := proxy.SOCKS5("tcp", socksAddr, nil, proxy.Direct)
+	dialer, err := socks5Dialer(socksAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -109,192 +163,255 @@ func forwardDNSviaSOCKS5(query []byte, socksAddr string, dnsServer string) ([]by
 	defer conn.Close()
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 
-	length := uint16(len(query))
-	buf := make([]byte, 2+len(query))
-	buf[0] = byte(length >> 8)
-	buf[1] = byte(length)
-	copy(buf[2:], query)
-
-	if _, err := conn.Write(buf); err != nil {
-		return nil, err
-	}
-
-	lenBuf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+	if err := writeDNSTCP(conn, query); err != nil {
 		return nil, err
 	}
+	return readDNSTCP(conn)
+}
 
-	respLen := int(lenBuf[0])<<8 | int(lenBuf[1])
-	respBuf := make([]byte, respLen)
-	if _, err := io.ReadFull(conn, respBuf); err != nil {
-		return nil, err
+// socks5Dialer — SOCKS5 клиент к addr. С фронтом addr несёт его внутренний
+// логин: user:password@host:port.
+func socks5Dialer(addr string) (proxy.Dialer, error) {
+	var auth *proxy.Auth
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		user, pass, _ := strings.Cut(addr[:i], ":")
+		auth, addr = &proxy.Auth{User: user, Password: pass}, addr[i+1:]
 	}
+	return proxy.SOCKS5("tcp", addr, auth, proxy.Direct)
+}
 
-	return respBuf, nil
+// socks5Host — addr без логина, для логов.
+func socks5Host(addr string) string {
+	return addr[strings.LastIndex(addr, "@")+1:]
 }
 
-func processDNSQuery(query []byte, fallbacks []string, socksAddr string, dohUrl string) []byte {
+// processDNSQuery отвечает на сырой запрос клиента client (host:port, может
+// быть пустым) и записывает его в журнал запросов.
+func processDNSQuery(query []byte, client string, up *dnsUpstreams, socksAddr string) []byte {
+	start := time.Now()
+	dnsStats.Queries.Add(1)
 	var msg dnsmessage.Message
-	if err := msg.Unpack(query); err != nil || len(msg.Questions) == 0 {
-		return tryFallbackDNS(query, fallbacks, dohUrl)
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 || msg.Response {
+		dnsStats.Refused.Add(1)
+		return refuseQuery(query)
 	}
 
-	q := msg.Questions[0]
-	domain := strings.TrimSuffix(q.Name.String(), ".")
+	syncTailnetReady()
+	var tr dnsTrace
+	resp := answerDNSQuery(&msg, query, up, socksAddr, &tr, 0)
+	dnsQueries.record(start, client, msg.Questions[0], &tr, resp)
+	return resp
+}
 
-	if strings.HasSuffix(domain, ".arpa") {
-		return tryFallbackDNS(query, fallbacks, dohUrl)
+// answerDNSQuery отвечает на разобранный запрос: локальные правила, кэш,
+// потом резолвинг. depth — глубина разворачивания CNAME из правил.
+func answerDNSQuery(msg *dnsmessage.Message, query []byte, up *dnsUpstreams, socksAddr string, tr *dnsTrace, depth int) []byte {
+	if r := dnsRules.Load().lookup(msg.Questions[0].Name.String()); r != nil {
+		r.hits.Add(1)
+		dnsStats.Rules.Add(1)
+		resp := r.answer(msg, depth, func(sub *dnsmessage.Message, q []byte, depth int) []byte {
+			return answerDNSQuery(sub, q, up, socksAddr, tr, depth)
+		})
+		tr.set(dnsTierRules, r.pattern)
+		return resp
 	}
 
-	if q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA {
-		var ips []string
+	key := newDNSCacheKey(msg.Questions[0])
+	key.cd = msg.CheckingDisabled
+	// С валидатором апстрим всегда спрашивается с DO, и ответ годится всем.
+	key.do = up.dnssec == nil && dnsQueryDO(msg)
+	if resp := dnsAnswers.get(key, msg); resp != nil {
+		tr.set(dnsTierCache, "")
+		return resp
+	}
+	return resolveCoalesced(key, msg, query, up, socksAddr, tr)
+}
 
-		if cached, ok := dnsCache.Load(domain); ok {
-			ips = cached.([]string)
-		} else {
-			// 1. Локальные ноды тейлскейла
-			out := RunTailscaleCmd("ip " + domain)
-			ips = extractIPs(out)
-
-			if len(ips) == 0 {
-				shortName := strings.Split(domain, ".")[0]
-				out = RunTailscaleCmd("ip " + shortName)
-				ips = extractIPs(out)
-			}
+// dnsQueryDO — есть ли в запросе EDNS с битом DO.
+func dnsQueryDO(msg *dnsmessage.Message) bool {
+	for _, r := range msg.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			return r.Header.DNSSECAllowed()
+		}
+	}
+	return false
+}
 
-			// 2. Split DNS через SOCKS5 TCP
-			if len(ips) == 0 {
-				splitServers := getSplitDNSServers(domain)
-				if len(splitServers) > 0 {
-					slog.Info("Split DNS via SOCKS5 TCP triggered", "domain", domain, "servers", splitServers)
-					for _, server := range splitServers {
-						target := net.JoinHostPort(server, "53")
-						resp, err := forwardDNSviaSOCKS5(query, socksAddr, target)
-						if err == nil {
-							return resp
-						}
-						slog.Error("SOCKS5 TCP DNS failed", "server", server, "err", err)
-					}
-				}
-			}
+// refuseQuery отвечает REFUSED по одному заголовку запроса: на запрос,
+// который не разобрать или в котором не ровно один вопрос, и на TCP запрос
+// сверх лимитов. Без заголовка ответить некуда — nil; на ответы не отвечаем,
+// чтобы не устроить петлю.
+func refuseQuery(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeRefused,
+	})
+	resp, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
 
-			// 3. CLI fallback
-			if len(ips) == 0 {
-				out = RunTailscaleCmd("dns query " + domain)
-				ips = extractIPs(out)
-			}
+// fallbackDNS спрашивает публичные апстримы; если не ответил ни один —
+// SERVFAIL, чтобы клиент не ждал таймаута.
+func fallbackDNS(msg *dnsmessage.Message, query []byte, up *dnsUpstreams, tr *dnsTrace) []byte {
+	if up.dnssec != nil {
+		query = dnssecQuery(query)
+	}
+	resp, from, err := up.exchangeFrom(query)
+	if err != nil {
+		dnsLog.Debug("All DNS upstreams failed", "name", msg.Questions[0].Name.String(), "err", err)
+		dnsStats.Failed.Add(1)
+		tr.set(dnsTierFallback, "")
+		return dnsReply(msg, dnsmessage.RCodeServerFailure, nil)
+	}
+	tr.set(dnsTierFallback, from.addr)
+	if up.dnssec != nil {
+		var ok bool
+		if resp, ok = up.dnssec.check(msg, resp); !ok {
+			dnsStats.Bogus.Add(1)
+			return dnsReply(msg, dnsmessage.RCodeServerFailure, nil)
+		}
+	}
+	dnsStats.Fallback.Add(1)
+	return resp
+}
 
-			if len(ips) > 0 {
-				dnsCache.Store(domain, ips)
-				go func(d string) {
-					time.Sleep(60 * time.Second)
-					dnsCache.Delete(d)
-				}(domain)
-			}
+func resolveDNSQuery(msg *dnsmessage.Message, query []byte, up *dnsUpstreams, socksAddr string, tr *dnsTrace) []byte {
+	q := msg.Questions[0]
+	domain := strings.TrimSuffix(q.Name.String(), ".")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lc := currentLocalClient()
+
+	// Пока демон поднимается, публичные имена идут в fallback, а имена
+	// тейлнета получают SERVFAIL: netmap ещё нет, и наружу их отдавать нельзя.
+	if !tailnetReady() {
+		if isTailnetName(domain) {
+			dnsStats.Failed.Add(1)
+			tr.set(dnsTierTailnet, "")
+			return dnsReply(msg, dnsmessage.RCodeServerFailure, nil)
 		}
+		return fallbackDNS(msg, query, up, tr)
+	}
 
-		if len(ips) > 0 {
-			msg.Response = true
-			msg.Authoritative = true
-			for _, ipStr := range ips {
-				ip := net.ParseIP(ipStr)
-				if ip == nil {
-					continue
-				}
-				if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
-					var a [4]byte
-					copy(a[:], ip4)
-					msg.Answers = append(msg.Answers, dnsmessage.Resource{
-						Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
-						Body:   &dnsmessage.AResource{A: a},
-					})
-				} else if ip6 := ip.To16(); ip6 != nil && q.Type == dnsmessage.TypeAAAA {
-					var aaaa [16]byte
-					copy(aaaa[:], ip6)
-					msg.Answers = append(msg.Answers, dnsmessage.Resource{
-						Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 60},
-						Body:   &dnsmessage.AAAAResource{AAAA: aaaa},
-					})
-				}
-			}
-			if len(msg.Answers) > 0 {
-				if packed, err := msg.Pack(); err == nil {
-					return packed
+	// Обратные запросы к адресам тейлнета не должны утекать в публичный DNS.
+	if strings.HasSuffix(domain, ".arpa") {
+		if addr, ok := parseReverseName(domain); ok && isTailnetAddr(addr) {
+			return resolveTailnetReverse(ctx, lc, msg, addr, query, socksAddr, tr)
+		}
+		return fallbackDNS(msg, query, up, tr)
+	}
+
+	isAddrQuery := q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA
+
+	// 1. Локальные ноды тейлскейла: A/AAAA из status, на прочие типы — NODATA.
+	st := tailnetStatus(ctx, lc)
+	if st != nil {
+		if peer := st.findPeer(domain); peer != nil {
+			dnsStats.Tailnet.Add(1)
+			tr.set(dnsTierTailnet, "")
+			return dnsReply(msg, dnsmessage.RCodeSuccess, addrAnswers(q, peer.TailscaleIPs))
+		}
+		if isAddrQuery {
+			shortName, _, _ := strings.Cut(domain, ".")
+			if peer := st.findPeer(shortName); peer != nil {
+				if answers := addrAnswers(q, peer.TailscaleIPs); len(answers) > 0 {
+					dnsStats.Tailnet.Add(1)
+					tr.set(dnsTierTailnet, "")
+					return dnsReply(msg, dnsmessage.RCodeSuccess, answers)
 				}
 			}
 		}
 	}
 
-	return tryFallbackDNS(query, fallbacks, dohUrl)
-}
-
-func extractIPs(out string) []string {
-	var ips []string
-	for _, line := range strings.Split(out, "\n") {
-		line = strings.TrimSpace(line)
-		if net.ParseIP(line) != nil {
-			ips = append(ips, line)
+	split := splitDNSRouteFor(domain)
+	if !isAddrQuery {
+		// SRV, TXT, HTTPS и прочее для имён тейлнета и split DNS решает MagicDNS демона.
+		if split != nil || (st != nil && inDomain(domain, st.magicDNSSuffix())) {
+			return forwardQuad100(msg, query, socksAddr, tr)
 		}
+		return fallbackDNS(msg, query, up, tr)
 	}
-	return ips
-}
 
-func tryFallbackDNS(query []byte, fallbacks []string, dohUrl string) []byte {
-	for _, server := range fallbacks {
-		resp, err := forwardDNSviaUDP(query, server)
-		if err == nil {
-			return resp
+	// 2. Split DNS через SOCKS5 TCP: маршрут с самым длинным суффиксом,
+	// начиная с резолвера, который ответил последним.
+	if split != nil && len(split.resolvers) > 0 {
+		dnsLog.Debug("Split DNS via SOCKS5 TCP", "domain", domain, "route", split.domain)
+		for _, server := range split.order() {
+			resp, err := forwardDNSviaSOCKS5(query, socksAddr, server)
+			if err == nil {
+				split.answered(server)
+				dnsStats.Split.Add(1)
+				tr.set(dnsTierSplit, server)
+				return resp
+			}
+			dnsLog.Error("SOCKS5 TCP DNS failed", "server", server, "err", err)
 		}
-		slog.Debug("Fallback DNS failed", "server", server, "err", err)
+		// Имя под split DNS маршрутом внутреннее: в публичные резолверы не отдаём.
+		dnsStats.Failed.Add(1)
+		tr.set(dnsTierSplit, "")
+		return dnsReply(msg, dnsmessage.RCodeServerFailure, nil)
 	}
 
-	if dohUrl != "none" {
-		resp, err := forwardDNSviaDoH(query, dohUrl)
+	// 3. DNS форвардер демона (бывший `tailscale dns query`). Подписи он не
+	// проверяет, поэтому с DNSSEC публичные имена идут в fallback.
+	tailnetName := isTailnetName(domain) || (st != nil && inDomain(domain, st.magicDNSSuffix()))
+	if IsRunning() && (up.dnssec == nil || tailnetName) {
+		resp, err := lc.QueryDNS(ctx, domain, strings.TrimPrefix(q.Type.String(), "Type"))
 		if err == nil {
-			return resp
+			var ips []netip.Addr
+			for _, s := range answerIPs(resp) {
+				if ip, err := netip.ParseAddr(s); err == nil {
+					ips = append(ips, ip)
+				}
+			}
+			if answers := addrAnswers(q, ips); len(answers) > 0 {
+				dnsStats.LocalAPI.Add(1)
+				tr.set(dnsTierLocalAPI, "")
+				return dnsReply(msg, dnsmessage.RCodeSuccess, answers)
+			}
+		} else {
+			dnsLog.Debug("LocalAPI dns-query failed", "domain", domain, "err", err)
 		}
-		slog.Debug("DoH fallback failed", "err", err)
 	}
-	return nil
-}
 
-func forwardDNSviaUDP(query []byte, server string) ([]byte, error) {
-	conn, err := net.DialTimeout("udp", server, 3*time.Second)
-	if err != nil {
-		return nil, err
+	// Имя под суффиксом MagicDNS, которого нет в тейлнете, не существует и снаружи.
+	if st != nil {
+		if suffix := st.magicDNSSuffix(); inDomain(domain, suffix) {
+			dnsStats.Tailnet.Add(1)
+			tr.set(dnsTierTailnet, "")
+			return tailnetNXDomain(msg, suffix)
+		}
 	}
-	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(3 * time.Second))
 
-	if _, err := conn.Write(query); err != nil {
-		return nil, err
-	}
-	buf := make([]byte, 65535)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return nil, err
-	}
-	return buf[:n], nil
+	return fallbackDNS(msg, query, up, tr)
 }
 
-func forwardDNSviaDoH(query []byte, dohUrl string) ([]byte, error) {
-	encoded := base64.RawURLEncoding.EncodeToString(query)
-	client := &http.Client{Timeout: 5 * time.Second}
-
-	req, err := http.NewRequest("GET", dohUrl+"?dns="+encoded, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Accept", "application/dns-message")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+// answerIPs достаёт адреса из A/AAAA записей сырого DNS ответа.
+func answerIPs(resp []byte) []string {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return nil
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("doh status: %d", resp.StatusCode)
+	var ips []string
+	for _, a := range m.Answers {
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(b.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(b.AAAA[:]).String())
+		}
 	}
-	return io.ReadAll(resp.Body)
+	return ips
 }
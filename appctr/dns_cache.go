@@ -0,0 +1,209 @@
+package appctr
+
+import (
+	"container/list"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsCacheSize = 4096
+	// Верхняя граница TTL в кэше: апстрим может отдать и неделю.
+	dnsCacheMaxTTL = 24 * time.Hour
+)
+
+type dnsCacheKey struct {
+	name  string // в нижнем регистре, с точкой на конце
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+	cd    bool // с CD ответ может быть bogus
+	do    bool // только без валидатора: тогда подписи есть лишь в ответе на DO
+}
+
+func newDNSCacheKey(q dnsmessage.Question) dnsCacheKey {
+	return dnsCacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class}
+}
+
+type dnsCacheEntry struct {
+	key     dnsCacheKey
+	resp    []byte // ответ целиком, как пришёл, до подгонки под клиента
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsAnswerCache — LRU кэш целых DNS ответов. Время жизни берётся из TTL ответа,
+// для NXDOMAIN/NODATA — из SOA (RFC 2308 5); при выдаче TTL уменьшаются на
+// прошедшее время.
+type dnsAnswerCache struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List // от свежих к старым
+	items map[dnsCacheKey]*list.Element
+	now   func() time.Time
+
+	hits, misses, evictions int64
+}
+
+func newDNSAnswerCache(max int) *dnsAnswerCache {
+	return &dnsAnswerCache{max: max, ll: list.New(), items: make(map[dnsCacheKey]*list.Element), now: time.Now}
+}
+
+var dnsAnswers = newDNSAnswerCache(dnsCacheSize)
+
+// get возвращает кэшированный ответ, подогнанный под запрос q, или nil.
+func (c *dnsAnswerCache) get(key dnsCacheKey, q *dnsmessage.Message) []byte {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		c.mu.Unlock()
+		return nil
+	}
+	e := el.Value.(*dnsCacheEntry)
+	now := c.now()
+	if !now.Before(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.misses++
+		c.mu.Unlock()
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	c.hits++
+	resp, elapsed := e.resp, uint32(now.Sub(e.stored)/time.Second)
+	c.mu.Unlock()
+	return adaptDNSResponse(resp, q, elapsed)
+}
+
+// adaptDNSResponse подгоняет общий ответ из кэша или singleflight под запрос q:
+// ID, RD, CD и вопрос как у клиента, TTL уменьшены на elapsed секунд. Клиент
+// без DO не получает подписей и NSEC, AD остаётся, только если клиент о нём
+// просил (RFC 6840 5.8), OPT свой: размер наш, DO эхом, без опций апстрима.
+func adaptDNSResponse(resp []byte, q *dnsmessage.Message, elapsed uint32) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return nil
+	}
+	clientOPT, clientDO := false, false
+	for _, r := range q.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			clientOPT, clientDO = true, r.Header.DNSSECAllowed()
+		}
+	}
+	m.ID = q.ID
+	m.RecursionDesired = q.RecursionDesired
+	m.CheckingDisabled = q.CheckingDisabled
+	m.AuthenticData = m.AuthenticData && (clientDO || q.AuthenticData)
+	m.Questions = q.Questions // регистр букв как в запросе (0x20)
+	qtype := q.Questions[0].Type
+	drop := func(r dnsmessage.Resource) bool {
+		t := r.Header.Type
+		return t == dnsmessage.TypeOPT || !clientDO && t != qtype && (t == dnsTypeRRSIG || t == dnsTypeNSEC || t == dnsTypeNSEC3)
+	}
+	m.Answers = slices.DeleteFunc(m.Answers, drop)
+	m.Authorities = slices.DeleteFunc(m.Authorities, drop)
+	m.Additionals = slices.DeleteFunc(m.Additionals, drop)
+	for _, sec := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range sec {
+			h := &sec[i].Header
+			h.TTL -= min(h.TTL, elapsed)
+		}
+	}
+	if clientOPT {
+		m.Additionals = append(m.Additionals, dnsOPT(clientDO))
+	}
+	out, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func (c *dnsAnswerCache) put(key dnsCacheKey, resp []byte) {
+	ttl, ok := cacheableTTL(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+	ttl = min(ttl, dnsCacheMaxTTL)
+	now := c.now()
+	e := &dnsCacheEntry{key: key, resp: append([]byte(nil), resp...), stored: now, expires: now.Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	for c.ll.Len() > c.max {
+		old := c.ll.Back()
+		c.ll.Remove(old)
+		delete(c.items, old.Value.(*dnsCacheEntry).key)
+		c.evictions++
+	}
+}
+
+func (c *dnsAnswerCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	clear(c.items)
+}
+
+// cacheableTTL решает, можно ли кэшировать ответ, и на сколько.
+// Положительный ответ живёт по минимальному TTL в answer; NXDOMAIN и NODATA —
+// min(TTL SOA, SOA.MINIMUM), а без SOA не кэшируются (RFC 2308 5).
+// SERVFAIL, REFUSED и обрезанные ответы не кэшируются.
+func cacheableTTL(resp []byte) (time.Duration, bool) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil || !m.Response || m.Truncated {
+		return 0, false
+	}
+	switch m.RCode {
+	case dnsmessage.RCodeSuccess:
+		if len(m.Answers) > 0 {
+			ttl := m.Answers[0].Header.TTL
+			for _, a := range m.Answers[1:] {
+				ttl = min(ttl, a.Header.TTL)
+			}
+			return time.Duration(ttl) * time.Second, true
+		}
+	case dnsmessage.RCodeNameError:
+	default:
+		return 0, false
+	}
+	for _, a := range m.Authorities {
+		if soa, ok := a.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(a.Header.TTL, soa.MinTTL)) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+type dnsCacheStats struct {
+	Entries   int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+func (c *dnsAnswerCache) stats() dnsCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return dnsCacheStats{Entries: c.ll.Len(), Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
+
+// GetDNSCacheStats возвращает JSON со статистикой кэша DNS ответов.
+func GetDNSCacheStats() string {
+	data, _ := json.Marshal(dnsAnswers.stats())
+	return string(data)
+}
+
+// FlushDNSCache очищает кэш DNS ответов.
+func FlushDNSCache() { dnsAnswers.flush() }
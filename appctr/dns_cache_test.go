@@ -0,0 +1,180 @@
+package appctr
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func testCache(max int) (*dnsAnswerCache, *fakeClock) {
+	clk := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := newDNSAnswerCache(max)
+	c.now = clk.now
+	return c, clk
+}
+
+// dnsResponse собирает ответ на query с заданным RCODE, answers и SOA в authority.
+func dnsResponse(t *testing.T, query []byte, rcode dnsmessage.RCode, answerTTLs []uint32, soa *[2]uint32) []byte {
+	t.Helper()
+	m := parseMsg(t, query)
+	m.Response = true
+	m.RCode = rcode
+	m.Additionals = nil
+	name := m.Questions[0].Name
+	for i, ttl := range answerTTLs {
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i + 1)}},
+		})
+	}
+	if soa != nil {
+		m.Authorities = append(m.Authorities, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: soa[0]},
+			Body: &dnsmessage.SOAResource{
+				NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("admin.example."),
+				Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: soa[1],
+			},
+		})
+	}
+	resp, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestCacheableTTL(t *testing.T) {
+	q := buildQuery(t, 1, "host.example.", dnsmessage.TypeA, 0)
+	truncated := parseMsg(t, dnsResponse(t, q, dnsmessage.RCodeSuccess, []uint32{300}, nil))
+	truncated.Truncated = true
+	tcResp, _ := truncated.Pack()
+
+	tests := []struct {
+		name string
+		resp []byte
+		ttl  time.Duration
+		ok   bool
+	}{
+		{"positive uses min answer ttl", dnsResponse(t, q, dnsmessage.RCodeSuccess, []uint32{300, 120, 600}, nil), 120 * time.Second, true},
+		{"nxdomain uses soa minimum", dnsResponse(t, q, dnsmessage.RCodeNameError, nil, &[2]uint32{3600, 900}), 900 * time.Second, true},
+		{"nxdomain uses soa ttl when lower", dnsResponse(t, q, dnsmessage.RCodeNameError, nil, &[2]uint32{60, 900}), 60 * time.Second, true},
+		{"nodata uses soa", dnsResponse(t, q, dnsmessage.RCodeSuccess, nil, &[2]uint32{3600, 300}), 300 * time.Second, true},
+		{"negative without soa", dnsResponse(t, q, dnsmessage.RCodeNameError, nil, nil), 0, false},
+		{"servfail", dnsResponse(t, q, dnsmessage.RCodeServerFailure, nil, nil), 0, false},
+		{"truncated", tcResp, 0, false},
+		{"query is not a response", q, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, ok := cacheableTTL(tt.resp)
+			if ttl != tt.ttl || ok != tt.ok {
+				t.Errorf("cacheableTTL = %v, %v; want %v, %v", ttl, ok, tt.ttl, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDNSAnswerCacheTTL(t *testing.T) {
+	c, clk := testCache(10)
+	q := buildQuery(t, 1, "Host.Example.", dnsmessage.TypeA, 0)
+	qm := parseMsg(t, q)
+	key := newDNSCacheKey(qm.Questions[0])
+	c.put(key, dnsResponse(t, q, dnsmessage.RCodeSuccess, []uint32{100}, nil))
+
+	clk.advance(30 * time.Second)
+	q2 := parseMsg(t, buildQuery(t, 77, "hOST.example.", dnsmessage.TypeA, 0))
+	resp := c.get(newDNSCacheKey(q2.Questions[0]), &q2)
+	if resp == nil {
+		t.Fatal("miss for a case-insensitive name within TTL")
+	}
+	m := parseMsg(t, resp)
+	if m.ID != 77 || m.Questions[0].Name.String() != "hOST.example." {
+		t.Errorf("ID/question not taken from the query: %d %s", m.ID, m.Questions[0].Name)
+	}
+	if m.Answers[0].Header.TTL != 70 {
+		t.Errorf("TTL = %d, want 70", m.Answers[0].Header.TTL)
+	}
+
+	// Другой тип — другой ключ.
+	aaaa := parseMsg(t, buildQuery(t, 2, "host.example.", dnsmessage.TypeAAAA, 0))
+	if c.get(newDNSCacheKey(aaaa.Questions[0]), &aaaa) != nil {
+		t.Error("AAAA served from the A entry")
+	}
+
+	clk.advance(70 * time.Second)
+	if c.get(key, &qm) != nil {
+		t.Error("entry served after TTL expired")
+	}
+	if st := c.stats(); st.Hits != 1 || st.Misses != 2 || st.Entries != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestDNSAnswerCacheNegative(t *testing.T) {
+	c, clk := testCache(10)
+	q := buildQuery(t, 1, "missing.example.", dnsmessage.TypeA, 0)
+	qm := parseMsg(t, q)
+	key := newDNSCacheKey(qm.Questions[0])
+	c.put(key, dnsResponse(t, q, dnsmessage.RCodeNameError, nil, &[2]uint32{3600, 60}))
+
+	clk.advance(59 * time.Second)
+	resp := c.get(key, &qm)
+	if resp == nil {
+		t.Fatal("NXDOMAIN not cached")
+	}
+	if m := parseMsg(t, resp); m.RCode != dnsmessage.RCodeNameError || m.Authorities[0].Header.TTL != 3541 {
+		t.Errorf("rcode = %v, soa ttl = %d", m.RCode, m.Authorities[0].Header.TTL)
+	}
+	clk.advance(time.Second)
+	if c.get(key, &qm) != nil {
+		t.Error("NXDOMAIN served past SOA minimum")
+	}
+}
+
+func TestDNSAnswerCacheLRU(t *testing.T) {
+	c, _ := testCache(2)
+	keys := make([]dnsCacheKey, 3)
+	msgs := make([]dnsmessage.Message, 3)
+	for i, name := range []string{"a.example.", "b.example.", "c.example."} {
+		q := buildQuery(t, 1, name, dnsmessage.TypeA, 0)
+		msgs[i] = parseMsg(t, q)
+		keys[i] = newDNSCacheKey(msgs[i].Questions[0])
+		c.put(keys[i], dnsResponse(t, q, dnsmessage.RCodeSuccess, []uint32{300}, nil))
+		if i == 1 {
+			c.get(keys[0], &msgs[0]) // a — самый свежий, вытеснится b
+		}
+	}
+	if c.get(keys[1], &msgs[1]) != nil {
+		t.Error("least recently used entry was not evicted")
+	}
+	if c.get(keys[0], &msgs[0]) == nil || c.get(keys[2], &msgs[2]) == nil {
+		t.Error("recent entries evicted")
+	}
+	if st := c.stats(); st.Evictions != 1 || st.Entries != 2 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestProcessDNSQueryCachesFallback(t *testing.T) {
+	dnsAnswers.flush()
+	t.Cleanup(dnsAnswers.flush)
+	upstream := fakeUpstream(t, 3)
+	q := buildQuery(t, 5, "cached.example.", dnsmessage.TypeA, 0)
+	if resp := processDNSQuery(q, "", testUpstreams(upstream), ""); resp == nil {
+		t.Fatal("no answer from upstream")
+	}
+	before := dnsAnswers.stats().Hits
+	resp := processDNSQuery(buildQuery(t, 6, "cached.example.", dnsmessage.TypeA, 0), "", testUpstreams("127.0.0.1:1"), "")
+	if resp == nil || parseMsg(t, resp).ID != 6 || len(parseMsg(t, resp).Answers) != 3 {
+		t.Fatal("second query not answered from cache")
+	}
+	if dnsAnswers.stats().Hits != before+1 {
+		t.Error("hit not counted")
+	}
+}
@@ -0,0 +1,565 @@
+package appctr
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Валидация DNSSEC ответов fallback апстримов (RFC 4033–4035). Прокси ведёт
+// себя как валидирующий стаб: спрашивает апстримы с битом DO и сам проверяет
+// цепочку DS → DNSKEY → RRSIG от корневого якоря. Ответ из подписанной зоны
+// без подписей или с битыми подписями — SERVFAIL. Зона без DS у родителя
+// (доказанного подписанным NSEC/NSEC3) — insecure, ответ отдаём как есть.
+// Отрицательные ответы проверяем по подписям и покрытию имени NSEC/NSEC3;
+// доказательства для wildcard и closest encloser не проверяются.
+//
+// Синтезированные ответы для тейлнета сюда не попадают: проверяется только fallback.
+
+// dnssecRootAnchors — DS корневых KSK-2017 и KSK-2024 из root-anchors.xml IANA.
+var dnssecRootAnchors = []*dns.DS{
+	{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET}, KeyTag: 20326, Algorithm: dns.RSASHA256, DigestType: dns.SHA256,
+		Digest: "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"},
+	{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET}, KeyTag: 38696, Algorithm: dns.RSASHA256, DigestType: dns.SHA256,
+		Digest: "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16"},
+}
+
+const (
+	// Размер UDP ответа, который просим у апстримов: подписи не влезают в 512.
+	dnssecUDPSize = 1232
+	// Сколько держим проверенные ключи и делегирования, если TTL больше.
+	dnssecMaxCacheTTL = time.Hour
+	dnssecCacheSize   = 4096
+)
+
+type dnssecResult int
+
+const (
+	dnssecSecure   dnssecResult = iota
+	dnssecInsecure              // зона доказанно не подписана
+	dnssecBogus
+)
+
+// Состояние имени как точки делегирования по ответу на запрос DS.
+type dnssecCut int
+
+const (
+	dnssecNoCut       dnssecCut = iota // не граница зоны
+	dnssecSignedCut                    // делегирование с DS
+	dnssecInsecureCut                  // делегирование без DS
+)
+
+// Типы записей DNSSEC для dnsmessage, где своих констант нет.
+const (
+	dnsTypeRRSIG = dnsmessage.Type(dns.TypeRRSIG)
+	dnsTypeNSEC  = dnsmessage.Type(dns.TypeNSEC)
+	dnsTypeNSEC3 = dnsmessage.Type(dns.TypeNSEC3)
+)
+
+var errDNSSECBogus = errors.New("dnssec: bogus")
+
+type dnssecEntry struct {
+	cut     dnssecCut
+	ds      []*dns.DS
+	keys    []*dns.DNSKEY // nil у insecure зоны
+	result  dnssecResult
+	expires time.Time
+}
+
+// dnssecValidator проверяет ответы и кэширует проверенные DS и DNSKEY зон.
+type dnssecValidator struct {
+	exchange func(query []byte) ([]byte, error)
+	anchors  []*dns.DS
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]dnssecEntry // "ds/имя" и "keys/зона"
+}
+
+func newDNSSECValidator(exchange func(query []byte) ([]byte, error)) *dnssecValidator {
+	return &dnssecValidator{exchange: exchange, anchors: dnssecRootAnchors, now: time.Now, cache: map[string]dnssecEntry{}}
+}
+
+// dnssecQuery ставит в запрос бит DO, добавляя EDNS при необходимости.
+func dnssecQuery(query []byte) []byte {
+	var m dns.Msg
+	if err := m.Unpack(query); err != nil {
+		return query
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+		opt.SetUDPSize(max(opt.UDPSize(), dnssecUDPSize))
+	} else {
+		m.SetEdns0(dnssecUDPSize, true)
+	}
+	out, err := m.Pack()
+	if err != nil {
+		return query
+	}
+	return out
+}
+
+// check проверяет ответ апстрима на запрос клиента msg и ставит AD по
+// результату. Подписи и NSEC остаются: ответ ещё общий, под клиента его
+// подгоняет adaptDNSResponse. false — ответ bogus; с CD (RFC 4035 3.2.2)
+// bogus отдаём клиенту как есть, без AD.
+func (v *dnssecValidator) check(msg *dnsmessage.Message, resp []byte) ([]byte, bool) {
+	var m dns.Msg
+	if err := m.Unpack(resp); err != nil {
+		return resp, true
+	}
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return resp, true
+	}
+	res := v.validate(&m)
+	if res == dnssecBogus {
+		dnsLog.Warn("DNSSEC validation failed", "name", m.Question[0].Name, "type", dns.TypeToString[m.Question[0].Qtype], "cd", msg.CheckingDisabled)
+		if !msg.CheckingDisabled {
+			return nil, false
+		}
+	}
+	m.AuthenticatedData = res == dnssecSecure
+	out, err := m.Pack()
+	if err != nil {
+		return resp, true
+	}
+	return out, true
+}
+
+// validate проверяет все RRset ответа, а для отрицательного ответа —
+// подписанное доказательство отсутствия.
+func (v *dnssecValidator) validate(m *dns.Msg) dnssecResult {
+	if len(m.Question) != 1 {
+		return dnssecBogus
+	}
+	q := m.Question[0]
+	result := dnssecSecure
+	merge := func(r dnssecResult) {
+		result = max(result, r)
+	}
+
+	if len(m.Answer) > 0 && m.Rcode == dns.RcodeSuccess {
+		for _, set := range groupRRsets(m.Answer) {
+			merge(v.verifyOrInsecure(set.rrs, set.sigs))
+		}
+		return result
+	}
+
+	// NXDOMAIN или NODATA: в authority должны быть подписанные SOA и NSEC/NSEC3.
+	sets := groupRRsets(m.Ns)
+	signed := false
+	for _, set := range sets {
+		if len(set.sigs) > 0 {
+			signed = true
+		}
+	}
+	if !signed {
+		return v.insecureName(q.Name)
+	}
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	for _, set := range sets {
+		r := v.verifyOrInsecure(set.rrs, set.sigs)
+		merge(r)
+		if r != dnssecSecure {
+			continue
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsec = append(nsec, rr)
+			case *dns.NSEC3:
+				nsec3 = append(nsec3, rr)
+			}
+		}
+	}
+	if result != dnssecSecure {
+		return result
+	}
+	if !provesDenial(q, m.Rcode == dns.RcodeNameError, nsec, nsec3) {
+		return dnssecBogus
+	}
+	return dnssecSecure
+}
+
+// verifyOrInsecure проверяет RRset; неподписанный допустим только под
+// доказанно неподписанным делегированием.
+func (v *dnssecValidator) verifyOrInsecure(rrs []dns.RR, sigs []*dns.RRSIG) dnssecResult {
+	if len(sigs) == 0 {
+		return v.insecureName(rrs[0].Header().Name)
+	}
+	return v.verify(rrs, sigs, "")
+}
+
+// verify проверяет RRset одной из подписей. Если задан above, подписавший
+// должен быть строго выше него: DS и отрицание DS подписывает родитель.
+func (v *dnssecValidator) verify(rrs []dns.RR, sigs []*dns.RRSIG, above string) dnssecResult {
+	owner := rrs[0].Header().Name
+	result := dnssecBogus
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, owner) {
+			continue
+		}
+		if above != "" && (!dns.IsSubDomain(sig.SignerName, above) || dns.CanonicalName(sig.SignerName) == dns.CanonicalName(above)) {
+			continue
+		}
+		if !sig.ValidityPeriod(v.now()) {
+			continue
+		}
+		keys, r := v.zoneKeys(sig.SignerName)
+		if r == dnssecInsecure {
+			result = dnssecInsecure
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && sig.Verify(k, rrs) == nil {
+				return dnssecSecure
+			}
+		}
+	}
+	return result
+}
+
+// insecureName ищет сверху вниз делегирование без DS над name: нашли —
+// insecure, дошли до name по подписанным зонам — bogus (подписи срезаны).
+func (v *dnssecValidator) insecureName(name string) dnssecResult {
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		cut, _, err := v.delegation(dns.Fqdn(strings.Join(labels[i:], ".")))
+		if err != nil {
+			return dnssecBogus
+		}
+		if cut == dnssecInsecureCut {
+			return dnssecInsecure
+		}
+	}
+	return dnssecBogus
+}
+
+// zoneKeys возвращает проверенные DNSKEY зоны или dnssecInsecure для
+// неподписанной зоны.
+func (v *dnssecValidator) zoneKeys(zone string) ([]*dns.DNSKEY, dnssecResult) {
+	zone = dns.CanonicalName(zone)
+	if e, ok := v.cached("keys/" + zone); ok {
+		return e.keys, e.result
+	}
+	ds := v.anchors
+	if zone != "." {
+		cut, set, err := v.delegation(zone)
+		switch {
+		case err != nil || cut == dnssecNoCut:
+			return nil, dnssecBogus
+		case cut == dnssecInsecureCut:
+			v.store("keys/"+zone, dnssecEntry{result: dnssecInsecure}, dnssecMaxCacheTTL)
+			return nil, dnssecInsecure
+		}
+		ds = set
+	}
+
+	m, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, dnssecBogus
+	}
+	var keys []dns.RR
+	var dnskeys []*dns.DNSKEY
+	var sigs []*dns.RRSIG
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			if dns.CanonicalName(rr.Hdr.Name) == zone {
+				keys = append(keys, rr)
+				dnskeys = append(dnskeys, rr)
+			}
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY && dns.CanonicalName(rr.SignerName) == zone {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	// RRset ключей должен быть подписан ключом, на который указывает DS родителя.
+	for _, k := range dnskeys {
+		if !matchesDS(k, ds) {
+			continue
+		}
+		for _, sig := range sigs {
+			if sig.KeyTag == k.KeyTag() && sig.ValidityPeriod(v.now()) && sig.Verify(k, keys) == nil {
+				v.store("keys/"+zone, dnssecEntry{keys: dnskeys, result: dnssecSecure}, rrsetTTL(keys))
+				return dnskeys, dnssecSecure
+			}
+		}
+	}
+	dnsLog.Debug("DNSSEC: no DNSKEY matches DS", "zone", zone)
+	return nil, dnssecBogus
+}
+
+// delegation выясняет по ответу на DS, граница ли name и подписана ли зона под ней.
+func (v *dnssecValidator) delegation(name string) (dnssecCut, []*dns.DS, error) {
+	name = dns.CanonicalName(name)
+	if e, ok := v.cached("ds/" + name); ok {
+		if e.result == dnssecBogus {
+			return 0, nil, errDNSSECBogus
+		}
+		return e.cut, e.ds, nil
+	}
+	cut, ds, ttl, err := v.fetchDelegation(name)
+	if err != nil {
+		v.store("ds/"+name, dnssecEntry{result: dnssecBogus}, time.Minute)
+		return 0, nil, err
+	}
+	v.store("ds/"+name, dnssecEntry{cut: cut, ds: ds}, ttl)
+	return cut, ds, nil
+}
+
+func (v *dnssecValidator) fetchDelegation(name string) (dnssecCut, []*dns.DS, time.Duration, error) {
+	m, err := v.query(name, dns.TypeDS)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	for _, set := range groupRRsets(m.Answer) {
+		if set.rrs[0].Header().Rrtype != dns.TypeDS || dns.CanonicalName(set.rrs[0].Header().Name) != name {
+			continue
+		}
+		switch v.verify(set.rrs, set.sigs, name) {
+		case dnssecSecure:
+			var ds []*dns.DS
+			for _, rr := range set.rrs {
+				ds = append(ds, rr.(*dns.DS))
+			}
+			return dnssecSignedCut, ds, rrsetTTL(set.rrs), nil
+		case dnssecInsecure:
+			return dnssecInsecureCut, nil, rrsetTTL(set.rrs), nil
+		}
+		return 0, nil, 0, fmt.Errorf("dnssec: DS for %s not verified", name)
+	}
+
+	// DS нет: отрицание должен подписать родитель, а NSEC/NSEC3 — сказать,
+	// есть ли тут делегирование (бит NS).
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	signed := false
+	ttl := dnssecMaxCacheTTL
+	for _, set := range groupRRsets(m.Ns) {
+		if len(set.sigs) == 0 {
+			continue
+		}
+		signed = true
+		switch v.verify(set.rrs, set.sigs, name) {
+		case dnssecInsecure:
+			return dnssecInsecureCut, nil, rrsetTTL(set.rrs), nil
+		case dnssecBogus:
+			return 0, nil, 0, fmt.Errorf("dnssec: denial of DS for %s not verified", name)
+		}
+		ttl = min(ttl, rrsetTTL(set.rrs))
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsec = append(nsec, rr)
+			case *dns.NSEC3:
+				nsec3 = append(nsec3, rr)
+			}
+		}
+	}
+	if !signed {
+		return 0, nil, 0, fmt.Errorf("dnssec: unsigned denial of DS for %s", name)
+	}
+	for _, n := range nsec {
+		if dns.CanonicalName(n.Hdr.Name) == name {
+			return nsecCut(n.TypeBitMap), nil, ttl, nil
+		}
+	}
+	for _, n := range nsec3 {
+		if n.Match(name) {
+			return nsecCut(n.TypeBitMap), nil, ttl, nil
+		}
+	}
+	for _, n := range nsec3 {
+		// Opt-out (RFC 5155 6): покрытые неподписанные делегирования.
+		if n.Flags&1 != 0 && n.Cover(name) {
+			return dnssecInsecureCut, nil, ttl, nil
+		}
+	}
+	for _, n := range nsec {
+		if nsecCovers(n, name) {
+			return dnssecNoCut, nil, ttl, nil
+		}
+	}
+	for _, n := range nsec3 {
+		if n.Cover(name) {
+			return dnssecNoCut, nil, ttl, nil
+		}
+	}
+	return 0, nil, 0, fmt.Errorf("dnssec: no proof for missing DS at %s", name)
+}
+
+func nsecCut(types []uint16) dnssecCut {
+	switch {
+	case slices.Contains(types, dns.TypeDS):
+		// DS есть, но апстрим его не отдал: ключи зоны не сойдутся, будет bogus.
+		return dnssecSignedCut
+	case slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA):
+		return dnssecInsecureCut
+	}
+	return dnssecNoCut
+}
+
+// provesDenial проверяет, что NSEC/NSEC3 покрывают имя (NXDOMAIN) или
+// совпадают с ним без запрошенного типа (NODATA).
+func provesDenial(q dns.Question, nxdomain bool, nsec []*dns.NSEC, nsec3 []*dns.NSEC3) bool {
+	name := dns.CanonicalName(q.Name)
+	if !nxdomain {
+		for _, n := range nsec {
+			if dns.CanonicalName(n.Hdr.Name) == name {
+				return !slices.Contains(n.TypeBitMap, q.Qtype) && !slices.Contains(n.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+		for _, n := range nsec3 {
+			if n.Match(name) {
+				return !slices.Contains(n.TypeBitMap, q.Qtype) && !slices.Contains(n.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+	}
+	for _, n := range nsec {
+		if nsecCovers(n, name) {
+			return true
+		}
+	}
+	for _, n := range nsec3 {
+		if n.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers — name лежит строго между владельцем NSEC и следующим именем
+// в каноническом порядке (RFC 4034 6.1); последний NSEC зоны замыкает круг.
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare сравнивает имена по меткам справа налево без учёта регистра.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(dns.CanonicalName(a))
+	lb := dns.SplitDomainName(dns.CanonicalName(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func matchesDS(k *dns.DNSKEY, set []*dns.DS) bool {
+	for _, ds := range set {
+		if ds.KeyTag != k.KeyTag() || ds.Algorithm != k.Algorithm {
+			continue
+		}
+		if got := k.ToDS(ds.DigestType); got != nil && strings.EqualFold(got.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+type dnssecRRset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// groupRRsets раскладывает записи секции по RRset (имя, тип) вместе с их подписями.
+func groupRRsets(rrs []dns.RR) []*dnssecRRset {
+	type key struct {
+		name  string
+		rtype uint16
+	}
+	var order []key
+	sets := map[key]*dnssecRRset{}
+	get := func(k key) *dnssecRRset {
+		s := sets[k]
+		if s == nil {
+			s = &dnssecRRset{}
+			sets[k] = s
+			order = append(order, k)
+		}
+		return s
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			s := get(key{dns.CanonicalName(h.Name), sig.TypeCovered})
+			s.sigs = append(s.sigs, sig)
+			continue
+		}
+		s := get(key{dns.CanonicalName(h.Name), h.Rrtype})
+		s.rrs = append(s.rrs, rr)
+	}
+	var out []*dnssecRRset
+	for _, k := range order {
+		// Подписи без записей ничего не доказывают.
+		if s := sets[k]; len(s.rrs) > 0 {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func rrsetTTL(rrs []dns.RR) time.Duration {
+	ttl := dnssecMaxCacheTTL
+	for _, rr := range rrs {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	return ttl
+}
+
+// query спрашивает апстримы о служебной записи с битом DO.
+func (v *dnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(dnssecUDPSize, true)
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := v.exchange(packed)
+	if err != nil {
+		return nil, err
+	}
+	var m dns.Msg
+	if err := m.Unpack(raw); err != nil {
+		return nil, err
+	}
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("dnssec: %s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[m.Rcode])
+	}
+	return &m, nil
+}
+
+func (v *dnssecValidator) cached(key string) (dnssecEntry, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	e, ok := v.cache[key]
+	if !ok || v.now().After(e.expires) {
+		return dnssecEntry{}, false
+	}
+	return e, true
+}
+
+func (v *dnssecValidator) store(key string, e dnssecEntry, ttl time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.cache) >= dnssecCacheSize {
+		clear(v.cache)
+	}
+	e.expires = v.now().Add(ttl)
+	v.cache[key] = e
+}
@@ -0,0 +1,366 @@
+package appctr
+
+import (
+	"crypto"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testSignedZone — зона с одним ключом (он же KSK и ZSK).
+type testSignedZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestSignedZone(t *testing.T, name string) *testSignedZone {
+	t.Helper()
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := k.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSignedZone{name: name, key: k, priv: priv.(crypto.Signer)}
+}
+
+// sign возвращает RRset с подписью, действующей с inception до expiration.
+func (z *testSignedZone) sign(t *testing.T, inception, expiration time.Time, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	h := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		Algorithm:  z.key.Algorithm,
+		SignerName: z.name,
+		KeyTag:     z.key.KeyTag(),
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func (z *testSignedZone) signNow(t *testing.T, rrs ...dns.RR) []dns.RR {
+	return z.sign(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), rrs...)
+}
+
+func (z *testSignedZone) ds() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+type testDNSAnswer struct {
+	rcode  int
+	answer []dns.RR
+	ns     []dns.RR
+}
+
+// testSignedTree — корень ".", "test." и зоны под ним:
+//
+//	signed.test.   подписана, DS в test.
+//	unsigned.test. делегирована без DS (NSEC в test.)
+//	evil.test.     DS в test. указывает на другой ключ
+func testSignedTree(t *testing.T) (map[string]testDNSAnswer, *dns.DS) {
+	root := newTestSignedZone(t, ".")
+	tld := newTestSignedZone(t, "test.")
+	signed := newTestSignedZone(t, "signed.test.")
+	evil := newTestSignedZone(t, "evil.test.")
+	evilReal := newTestSignedZone(t, "evil.test.")
+	now := time.Now()
+
+	withTTL := func(rr dns.RR) dns.RR { rr.Header().Ttl = 3600; return rr }
+	tamperedA := signed.signNow(t, testRR(t, "bad.signed.test. 300 IN A 192.0.2.66"))
+	tamperedA[0].(*dns.A).A = net.IPv4(192, 0, 2, 99)
+
+	answers := map[string]testDNSAnswer{
+		"./DNSKEY":                {answer: root.signNow(t, root.key)},
+		"test./DS":                {answer: root.signNow(t, withTTL(tld.ds()))},
+		"test./DNSKEY":            {answer: tld.signNow(t, tld.key)},
+		"signed.test./DS":         {answer: tld.signNow(t, withTTL(signed.ds()))},
+		"signed.test./DNSKEY":     {answer: signed.signNow(t, signed.key)},
+		"evil.test./DS":           {answer: tld.signNow(t, withTTL(evil.ds()))},
+		"evil.test./DNSKEY":       {answer: evilReal.signNow(t, evilReal.key)},
+		"www.signed.test./A":      {answer: signed.signNow(t, testRR(t, "www.signed.test. 300 IN A 192.0.2.1"))},
+		"bad.signed.test./A":      {answer: tamperedA},
+		"old.signed.test./A":      {answer: signed.sign(t, now.Add(-48*time.Hour), now.Add(-24*time.Hour), testRR(t, "old.signed.test. 300 IN A 192.0.2.2"))},
+		"stripped.signed.test./A": {answer: []dns.RR{testRR(t, "stripped.signed.test. 300 IN A 192.0.2.3")}},
+		"www.evil.test./A":        {answer: evilReal.signNow(t, testRR(t, "www.evil.test. 300 IN A 192.0.2.4"))},
+		"www.unsigned.test./A":    {answer: []dns.RR{testRR(t, "www.unsigned.test. 300 IN A 192.0.2.5")}},
+		"unsigned.test./DS": {ns: append(
+			tld.signNow(t, testRR(t, "test. 300 IN SOA ns.test. admin.test. 1 3600 600 86400 300")),
+			tld.signNow(t, testRR(t, "unsigned.test. 300 IN NSEC z.test. NS RRSIG NSEC"))...)},
+		"nx.signed.test./A": {rcode: dns.RcodeNameError, ns: append(
+			signed.signNow(t, testRR(t, "signed.test. 300 IN SOA ns.signed.test. admin.signed.test. 1 3600 600 86400 300")),
+			signed.signNow(t, testRR(t, "mail.signed.test. 300 IN NSEC www.signed.test. A RRSIG NSEC"))...)},
+		// NSEC покрывает другое имя: отсутствие nx2 не доказано.
+		"nx2.signed.test./A": {rcode: dns.RcodeNameError, ns: append(
+			signed.signNow(t, testRR(t, "signed.test. 300 IN SOA ns.signed.test. admin.signed.test. 1 3600 600 86400 300")),
+			signed.signNow(t, testRR(t, "a.signed.test. 300 IN NSEC b.signed.test. A RRSIG NSEC"))...)},
+	}
+	return answers, root.ds()
+}
+
+// signedTreeResolver — резолвер-дублёр, отвечающий из testSignedTree.
+func signedTreeResolver(t *testing.T, answers map[string]testDNSAnswer) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dns.Msg
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			q := req.Question[0]
+			resp := new(dns.Msg)
+			resp.SetReply(&req)
+			a, ok := answers[dns.CanonicalName(q.Name)+"/"+dns.TypeToString[q.Qtype]]
+			if !ok {
+				resp.Rcode = dns.RcodeServerFailure
+			}
+			resp.Rcode = max(resp.Rcode, a.rcode)
+			resp.Answer, resp.Ns = a.answer, a.ns
+			if opt := req.IsEdns0(); opt != nil {
+				resp.SetEdns0(opt.UDPSize(), opt.Do())
+			}
+			out, err := resp.Pack()
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			pc.WriteTo(out, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// dnssecQueryMsg — запрос клиента; do — с битом DO.
+func dnssecQueryMsg(t *testing.T, name string, do bool) []byte {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.Id = 7
+	if do {
+		m.SetEdns0(1232, true)
+	}
+	out, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	dnsAnswers.flush()
+	t.Cleanup(dnsAnswers.flush)
+	answers, anchor := testSignedTree(t)
+	up := testUpstreams(signedTreeResolver(t, answers))
+	up.dnssec = newDNSSECValidator(up.exchange)
+	up.dnssec.anchors = []*dns.DS{anchor}
+	bogus := dnsStats.Bogus.Load()
+
+	tests := []struct {
+		name    string
+		rcode   int
+		answers int
+		ad      bool
+	}{
+		{"www.signed.test.", dns.RcodeSuccess, 1, true},
+		{"nx.signed.test.", dns.RcodeNameError, 0, true},
+		{"www.unsigned.test.", dns.RcodeSuccess, 1, false},
+		{"bad.signed.test.", dns.RcodeServerFailure, 0, false},
+		{"old.signed.test.", dns.RcodeServerFailure, 0, false},
+		{"stripped.signed.test.", dns.RcodeServerFailure, 0, false},
+		{"www.evil.test.", dns.RcodeServerFailure, 0, false},
+		{"nx2.signed.test.", dns.RcodeServerFailure, 0, false},
+	}
+	for _, tt := range tests {
+		for _, do := range []bool{false, true} {
+			dnsAnswers.flush()
+			var m dns.Msg
+			if err := m.Unpack(processDNSQuery(dnssecQueryMsg(t, tt.name, do), "", up, "")); err != nil {
+				t.Fatal(err)
+			}
+			var records, sigs int
+			for _, rr := range m.Answer {
+				if rr.Header().Rrtype == dns.TypeRRSIG {
+					sigs++
+				} else {
+					records++
+				}
+			}
+			if m.Id != 7 || m.Rcode != tt.rcode || records != tt.answers || m.AuthenticatedData != (tt.ad && do) {
+				t.Errorf("%s do=%v: rcode %s, %d answers, ad %v", tt.name, do, dns.RcodeToString[m.Rcode], records, m.AuthenticatedData)
+			}
+			// Подписи получает только клиент с DO.
+			if wantSigs := do && tt.ad && tt.answers > 0; (sigs > 0) != wantSigs {
+				t.Errorf("%s do=%v: %d signatures", tt.name, do, sigs)
+			}
+			if !do && (m.IsEdns0() != nil || len(m.Ns) > 0 && m.Ns[len(m.Ns)-1].Header().Rrtype == dns.TypeNSEC) {
+				t.Errorf("%s: EDNS or NSEC leaked to a plain client: %v", tt.name, m)
+			}
+		}
+	}
+	if n := dnsStats.Bogus.Load() - bogus; n != 10 {
+		t.Errorf("bogus = %d, want 10", n)
+	}
+}
+
+// Кэш общий для клиентов с DO и без, а подгонка под клиента — после него.
+func TestDNSSECSharedCache(t *testing.T) {
+	dnsAnswers.flush()
+	t.Cleanup(dnsAnswers.flush)
+	answers, anchor := testSignedTree(t)
+	up := testUpstreams(signedTreeResolver(t, answers))
+	up.dnssec = newDNSSECValidator(up.exchange)
+	up.dnssec.anchors = []*dns.DS{anchor}
+
+	ask := func(query []byte) *dns.Msg {
+		t.Helper()
+		m := new(dns.Msg)
+		if err := m.Unpack(processDNSQuery(query, "", up, "")); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	ask(dnssecQueryMsg(t, "www.signed.test.", true))
+	before := dnsStats.Fallback.Load()
+	for _, do := range []bool{false, true, false} {
+		m := ask(dnssecQueryMsg(t, "www.signed.test.", do))
+		sigs := 0
+		for _, rr := range m.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				sigs++
+			}
+		}
+		if len(m.Answer)-sigs != 1 || (sigs > 0) != do || m.AuthenticatedData != do || (m.IsEdns0() != nil) != do {
+			t.Errorf("do=%v from cache: %d sigs, ad %v, edns %v", do, sigs, m.AuthenticatedData, m.IsEdns0())
+		}
+	}
+	if n := dnsStats.Fallback.Load() - before; n != 0 {
+		t.Errorf("%d fallback answers, want all from cache", n)
+	}
+}
+
+// С CD bogus ответ отдаётся как есть (RFC 4035 3.2.2), но без AD и только
+// тем, кто поставил CD.
+func TestDNSSECCheckingDisabled(t *testing.T) {
+	dnsAnswers.flush()
+	t.Cleanup(dnsAnswers.flush)
+	answers, anchor := testSignedTree(t)
+	up := testUpstreams(signedTreeResolver(t, answers))
+	up.dnssec = newDNSSECValidator(up.exchange)
+	up.dnssec.anchors = []*dns.DS{anchor}
+
+	for _, name := range []string{"bad.signed.test.", "www.signed.test."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.CheckingDisabled = true
+		query, err := q.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(processDNSQuery(query, "", up, "")); err != nil {
+			t.Fatal(err)
+		}
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || !m.CheckingDisabled || m.AuthenticatedData {
+			t.Errorf("%s with CD: rcode %s, %d answers, cd %v, ad %v", name, dns.RcodeToString[m.Rcode], len(m.Answer), m.CheckingDisabled, m.AuthenticatedData)
+		}
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(processDNSQuery(dnssecQueryMsg(t, "bad.signed.test.", false), "", up, "")); err != nil {
+		t.Fatal(err)
+	}
+	if m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("bogus without CD after a CD query: rcode %s", dns.RcodeToString[m.Rcode])
+	}
+}
+
+func TestDNSSECLeavesTailnetAlone(t *testing.T) {
+	socksAddr, _ := fakeTailnet(t)
+	up := testUpstreams(signedTreeResolver(t, nil))
+	up.dnssec = newDNSSECValidator(up.exchange)
+	resp := processDNSQuery(buildQuery(t, 1, "nas.tail1.ts.net.", dnsmessage.TypeA, 0), "", up, socksAddr)
+	if m := parseMsg(t, resp); m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 1 {
+		t.Errorf("tailnet answer: rcode %v, %d answers", m.RCode, len(m.Answers))
+	}
+}
+
+// Форвардер демона подписи не проверяет: с DNSSEC публичные имена в Running
+// идут в fallback, а имена тейлнета — по-прежнему к демону.
+func TestDNSSECBypassesDaemonForwarder(t *testing.T) {
+	var forwarded atomic.Int32
+	socksAddr, _ := fakeTailnetWith(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+		b.StartAnswers()
+		name := dnsmessage.MustNewName(r.URL.Query().Get("name") + ".")
+		b.AResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 30}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 66}})
+		resp, _ := b.Finish()
+		writeJSON(w, map[string]any{"Bytes": resp})
+	})
+	answers, anchor := testSignedTree(t)
+	plain := testUpstreams(signedTreeResolver(t, answers))
+	up := testUpstreams(signedTreeResolver(t, answers))
+	up.dnssec = newDNSSECValidator(up.exchange)
+	up.dnssec.anchors = []*dns.DS{anchor}
+
+	ask := func(up *dnsUpstreams, name string) *dns.Msg {
+		t.Helper()
+		dnsAnswers.flush()
+		m := new(dns.Msg)
+		if err := m.Unpack(processDNSQuery(dnssecQueryMsg(t, name, false), "", up, socksAddr)); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	if m := ask(up, "bad.signed.test."); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("bogus name: rcode %s, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	if m := ask(up, "www.signed.test."); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || !m.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("signed name: %v", m)
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("%d public queries reached the daemon forwarder", n)
+	}
+
+	// Без DNSSEC и для имён тейлнета форвардер работает как раньше.
+	if m := ask(plain, "www.signed.test."); len(m.Answer) != 1 || !m.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 66)) {
+		t.Errorf("without DNSSEC: %v", m)
+	}
+	if m := ask(up, "svc.tail1.ts.net."); len(m.Answer) != 1 || !m.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 66)) {
+		t.Errorf("MagicDNS name with DNSSEC: %v", m)
+	}
+	if n := forwarded.Load(); n != 2 {
+		t.Errorf("forwarder got %d queries, want 2", n)
+	}
+}
@@ -0,0 +1,178 @@
+package appctr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+// dnsLimits — ограничения DNS прокси против наплыва запросов.
+type dnsLimits struct {
+	workers     int        // сколько запросов резолвится одновременно
+	backlog     int        // сколько ждут свободного воркера; сверх — отказ
+	clientRate  rate.Limit // запросов в секунду с одного IP
+	clientBurst int
+}
+
+// dnsProxyLimits читается при старте прокси; тесты его уменьшают.
+var dnsProxyLimits = dnsLimits{workers: 64, backlog: 1024, clientRate: 200, clientBurst: 400}
+
+// Лимитер клиента, молчащего дольше, забываем.
+const dnsClientIdle = time.Minute
+
+// dnsWorkerPool — фиксированный набор воркеров с ограниченной очередью.
+type dnsWorkerPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+// newDNSWorkerPool запускает workers воркеров; они выходят с отменой ctx.
+func newDNSWorkerPool(ctx context.Context, workers, backlog int) *dnsWorkerPool {
+	p := &dnsWorkerPool{jobs: make(chan func(), backlog)}
+	for range workers {
+		p.wg.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-p.jobs:
+					job()
+				}
+			}
+		})
+	}
+	return p
+}
+
+// wait ждёт, пока воркеры доделают начатое после отмены ctx.
+func (p *dnsWorkerPool) wait() { p.wg.Wait() }
+
+// trySubmit ставит job в очередь, не блокируясь; false — очередь полна.
+func (p *dnsWorkerPool) trySubmit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+type dnsClientBucket struct {
+	lim  *rate.Limiter
+	seen time.Time
+}
+
+// dnsClientLimiter ограничивает частоту запросов с каждого IP (token bucket).
+type dnsClientLimiter struct {
+	limit     rate.Limit
+	burst     int
+	mu        sync.Mutex
+	clients   map[netip.Addr]*dnsClientBucket
+	lastSweep time.Time
+}
+
+func newDNSClientLimiter(limit rate.Limit, burst int) *dnsClientLimiter {
+	return &dnsClientLimiter{limit: limit, burst: burst, clients: map[netip.Addr]*dnsClientBucket{}, lastSweep: time.Now()}
+}
+
+func (l *dnsClientLimiter) allow(client net.Addr) bool {
+	ip := clientIP(client)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > dnsClientIdle {
+		for k, b := range l.clients {
+			if now.Sub(b.seen) > dnsClientIdle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b := l.clients[ip]
+	if b == nil {
+		b = &dnsClientBucket{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = b
+	}
+	b.seen = now
+	return b.lim.AllowN(now, 1)
+}
+
+// clientIP — IP клиента без порта; для неизвестных адресов — нулевой.
+func clientIP(a net.Addr) netip.Addr {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case nil:
+		return netip.Addr{}
+	}
+	ap, _ := netip.ParseAddrPort(a.String())
+	return ap.Addr().Unmap()
+}
+
+// guardDNSHandler пропускает запросы через лимит клиента и пул воркеров.
+// Отказанный запрос получает REFUSED, чтобы TCP клиент не ждал таймаута.
+func guardDNSHandler(ctx context.Context, pool *dnsWorkerPool, limiter *dnsClientLimiter, handle dnsHandler) dnsHandler {
+	return func(q []byte, client net.Addr) []byte {
+		if !limiter.allow(client) {
+			dnsStats.Limited.Add(1)
+			return refuseQuery(q)
+		}
+		done := make(chan []byte, 1)
+		if !pool.trySubmit(func() { done <- handle(q, client) }) {
+			dnsStats.Dropped.Add(1)
+			return refuseQuery(q)
+		}
+		select {
+		case resp := <-done:
+			return resp
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// dnsFlight склеивает одинаковые запросы, которые резолвятся одновременно.
+var dnsFlight singleflight.Group
+
+type dnsFlightResult struct {
+	resp []byte
+	tr   dnsTrace
+}
+
+// resolveCoalesced резолвит запрос один раз на все одинаковые по key,
+// пришедшие, пока он в полёте, и кладёт общий ответ в кэш. Каждый, включая
+// первого, получает его подогнанным под свой запрос.
+func resolveCoalesced(key dnsCacheKey, msg *dnsmessage.Message, query []byte, up *dnsUpstreams, socksAddr string, tr *dnsTrace) []byte {
+	leader := false
+	flight := fmt.Sprintf("%s/%d/%d/%t/%t", key.name, key.qtype, key.class, key.cd, key.do)
+	v, _, shared := dnsFlight.Do(flight, func() (any, error) {
+		leader = true
+		var ftr dnsTrace
+		resp := resolveDNSQuery(msg, query, up, socksAddr, &ftr)
+		if resp != nil {
+			dnsAnswers.put(key, resp)
+		}
+		return dnsFlightResult{resp, ftr}, nil
+	})
+	res := v.(dnsFlightResult)
+	tr.set(res.tr.tier, res.tr.upstream)
+	if res.resp == nil {
+		return nil
+	}
+	if shared && !leader {
+		dnsStats.Coalesced.Add(1)
+	}
+	if resp := adaptDNSResponse(res.resp, msg, 0); resp != nil || !leader {
+		return resp
+	}
+	return res.resp // не разобрался — первому отдаём как есть
+}
@@ -0,0 +1,258 @@
+package appctr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSWorkerPoolBacklog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newDNSWorkerPool(ctx, 1, 1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if !p.trySubmit(func() { close(started); <-release }) {
+		t.Fatal("first job rejected")
+	}
+	<-started
+	if !p.trySubmit(func() {}) {
+		t.Fatal("job rejected with free backlog")
+	}
+	if p.trySubmit(func() {}) {
+		t.Fatal("job accepted over backlog")
+	}
+	close(release)
+}
+
+func TestDNSClientLimiter(t *testing.T) {
+	l := newDNSClientLimiter(1, 2)
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	b := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1000}
+	samePort := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000}
+	if !l.allow(a) || !l.allow(samePort) {
+		t.Fatal("burst not allowed")
+	}
+	if l.allow(a) {
+		t.Error("over burst allowed: limit must be per IP, not per port")
+	}
+	if !l.allow(b) {
+		t.Error("other client limited")
+	}
+}
+
+func TestDNSCoalescing(t *testing.T) {
+	dnsAnswers.flush()
+	t.Cleanup(dnsAnswers.flush)
+	addr, hits := standInUDP(t, 9, 200*time.Millisecond)
+	up := testUpstreams(addr)
+	before := dnsStats.Coalesced.Load()
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Go(func() {
+			resp := processDNSQuery(buildQuery(t, uint16(1000+i), "same.example.", dnsmessage.TypeA, 0), "", up, "")
+			m := parseMsg(t, resp)
+			if m.ID != uint16(1000+i) || len(m.Answers) != 1 {
+				t.Errorf("query %d: id %d, %d answers", i, m.ID, len(m.Answers))
+			}
+		})
+	}
+	wg.Wait()
+	if n := hits.Load(); n != 1 {
+		t.Errorf("upstream hits = %d, want 1", n)
+	}
+	if dnsStats.Coalesced.Load() == before {
+		t.Error("no coalesced queries counted")
+	}
+}
+
+// Запросы с DO и CD не склеиваются с обычными: ответы на них разные.
+func TestDNSCoalescingKeepsDOAndCD(t *testing.T) {
+	dnsAnswers.flush()
+	t.Cleanup(dnsAnswers.flush)
+	addr, hits := standInUDP(t, 9, 200*time.Millisecond)
+	up := testUpstreams(addr)
+
+	var do dnsmessage.ResourceHeader
+	do.SetEDNS0(1232, dnsmessage.RCodeSuccess, true)
+	q := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions:   []dnsmessage.Question{{Name: dnsmessage.MustNewName("split.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Additionals: []dnsmessage.Resource{{Header: do, Body: &dnsmessage.OPTResource{}}},
+	}
+	withDO, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Additionals = nil
+	q.CheckingDisabled = true
+	withCD, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, query := range [][]byte{buildQuery(t, 1, "split.example.", dnsmessage.TypeA, 0), withDO, withCD} {
+		wg.Go(func() { processDNSQuery(query, "", up, "") })
+	}
+	wg.Wait()
+	if n := hits.Load(); n != 3 {
+		t.Errorf("upstream hits = %d, want 3", n)
+	}
+}
+
+// startTestDNSProxy поднимает прокси на свободном порту с лимитами lim и,
+// если задан sec, с DoH и DoT.
+func startTestDNSProxy(t *testing.T, lim dnsLimits, up *dnsUpstreams, sec *dnsSecureConfig) string {
+	t.Helper()
+	old := dnsProxyLimits
+	dnsProxyLimits = lim
+	t.Cleanup(func() { dnsProxyLimits = old })
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().String()
+	probe.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() { cancel(); <-done })
+	go func() {
+		defer close(done)
+		startDNSProxy(ctx, addr, "127.0.0.1:1", up, sec)
+	}()
+	for range 50 {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("dns proxy did not start")
+	return ""
+}
+
+func TestDNSProxyLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	dnsAnswers.flush()
+	t.Cleanup(dnsAnswers.flush)
+	upstream, hits := standInUDP(t, 1, 5*time.Millisecond)
+	lim := dnsLimits{workers: 8, backlog: 64, clientRate: 1e6, clientBurst: 1e6}
+	addr := startTestDNSProxy(t, lim, testUpstreams(upstream), nil)
+	base := runtime.NumGoroutine()
+
+	// Максимум горутин во время нагрузки: пул не должен плодить их на каждый пакет.
+	var peak atomic.Int64
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if n := int64(runtime.NumGoroutine()); n > peak.Load() {
+				peak.Store(n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	const clients, perClient, names = 20, 200, 50
+	var answered atomic.Int64
+	var wg sync.WaitGroup
+	for c := range clients {
+		wg.Go(func() {
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			buf := make([]byte, 1500)
+			for i := range perClient {
+				id := uint16(c*perClient + i)
+				conn.Write(buildQuery(t, id, fmt.Sprintf("n%d.load.example.", (c+i)%names), dnsmessage.TypeA, 0))
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, err := conn.Read(buf)
+				if err != nil {
+					t.Errorf("client %d query %d: %v", c, i, err)
+					return
+				}
+				if m := parseMsg(t, buf[:n]); m.ID == id && m.RCode == dnsmessage.RCodeSuccess {
+					answered.Add(1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(stop)
+
+	if n := answered.Load(); n != clients*perClient {
+		t.Errorf("answered %d of %d", n, clients*perClient)
+	}
+	// Каждое имя уходит наверх один раз: одновременные склеиваются, дальше кэш.
+	if n := hits.Load(); n > 2*names {
+		t.Errorf("upstream hits = %d for %d names", n, names)
+	}
+	if p := peak.Load(); p > int64(base+clients+lim.workers+20) {
+		t.Errorf("goroutines peaked at %d (base %d)", p, base)
+	}
+}
+
+func TestDNSProxyLimits(t *testing.T) {
+	upstream, _ := standInUDP(t, 1, 0)
+	addr := startTestDNSProxy(t, dnsLimits{workers: 2, backlog: 2, clientRate: 1, clientBurst: 5}, testUpstreams(upstream), nil)
+	limited := dnsStats.Limited.Load()
+
+	// UDP сверх лимита клиента молча отбрасывается.
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := range 20 {
+		conn.Write(buildQuery(t, uint16(i), "limited.example.", dnsmessage.TypeA, 0))
+	}
+	got := 0
+	buf := make([]byte, 1500)
+	for {
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+		got++
+	}
+	if got < 1 || got > 6 {
+		t.Errorf("udp answers = %d, want about the burst of 5", got)
+	}
+	if n := dnsStats.Limited.Load() - limited; n < 14 {
+		t.Errorf("limited = %d", n)
+	}
+
+	// TCP сверх лимита получает REFUSED, а не тишину.
+	tcp, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	writeDNSTCP(tcp, buildQuery(t, 77, "limited.example.", dnsmessage.TypeA, 0))
+	tcp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := readDNSTCP(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := parseMsg(t, resp); m.ID != 77 || m.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("tcp over limit: id %d rcode %v", m.ID, m.RCode)
+	}
+}
@@ -0,0 +1,184 @@
+package appctr
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Пути, которыми DNS прокси получил ответ (Tier в журнале запросов).
+const (
+	dnsTierRules    = "rules"    // hosts и правила из DataDir/dns
+	dnsTierCache    = "cache"    // кэш ответов
+	dnsTierTailnet  = "tailnet"  // ноды из status и netmap
+	dnsTierSplit    = "split"    // split DNS через SOCKS5
+	dnsTierLocalAPI = "localapi" // DNS форвардер демона
+	dnsTierQuad100  = "quad100"  // MagicDNS через SOCKS5
+	dnsTierFallback = "fallback" // публичные апстримы
+)
+
+// Сколько последних запросов хранит журнал.
+const dnsQueryLogSize = 1000
+
+// dnsTrace — каким путём получен ответ; заполняется по ходу резолвинга.
+type dnsTrace struct {
+	tier     string
+	upstream string
+}
+
+func (tr *dnsTrace) set(tier, upstream string) {
+	if tr != nil {
+		tr.tier, tr.upstream = tier, upstream
+	}
+}
+
+// dnsQueryRecord — одна запись журнала. Seq растёт монотонно и не
+// сбрасывается ClearDNSQueryLog.
+type dnsQueryRecord struct {
+	Seq       int64
+	Time      time.Time
+	Client    string `json:",omitempty"` // IP клиента
+	Name      string
+	Type      string
+	Tier      string
+	Upstream  string `json:",omitempty"` // апстрим, резолвер split DNS или правило
+	RCode     string
+	LatencyUs int64
+}
+
+type dnsTierStats struct {
+	Queries      int64
+	AvgLatencyUs int64
+}
+
+type dnsTierTotals struct {
+	queries int64
+	totalUs int64
+}
+
+// dnsQueryLog — кольцевой буфер последних запросов и счётчики по ним.
+type dnsQueryLog struct {
+	mu     sync.Mutex
+	recs   ring[dnsQueryRecord]
+	tiers  map[string]*dnsTierTotals
+	rcodes map[string]int64
+	types  map[string]int64
+}
+
+func newDNSQueryLog(size int) *dnsQueryLog {
+	return &dnsQueryLog{
+		recs:   newRing[dnsQueryRecord](size),
+		tiers:  map[string]*dnsTierTotals{},
+		rcodes: map[string]int64{},
+		types:  map[string]int64{},
+	}
+}
+
+var dnsQueries = newDNSQueryLog(dnsQueryLogSize)
+
+// record записывает ответ resp на вопрос q, начатый в start.
+func (l *dnsQueryLog) record(start time.Time, client string, q dnsmessage.Question, tr *dnsTrace, resp []byte) {
+	r := dnsQueryRecord{
+		Time:      start,
+		Client:    client,
+		Name:      strings.TrimSuffix(q.Name.String(), "."),
+		Type:      strings.TrimPrefix(q.Type.String(), "Type"),
+		Tier:      tr.tier,
+		Upstream:  tr.upstream,
+		RCode:     "NoAnswer",
+		LatencyUs: time.Since(start).Microseconds(),
+	}
+	if ap, err := netip.ParseAddrPort(client); err == nil {
+		r.Client = ap.Addr().Unmap().String()
+	}
+	var p dnsmessage.Parser
+	if h, err := p.Start(resp); err == nil {
+		r.RCode = strings.TrimPrefix(h.RCode.String(), "RCode")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.tiers[r.Tier]
+	if t == nil {
+		t = &dnsTierTotals{}
+		l.tiers[r.Tier] = t
+	}
+	t.queries++
+	t.totalUs += r.LatencyUs
+	l.rcodes[r.RCode]++
+	l.types[r.Type]++
+
+	seq, slot := l.recs.push(r)
+	slot.Seq = seq
+}
+
+// since возвращает до limit записей новее afterSeq от старых к новым, курсор
+// для следующего вызова и признак того, что часть записей уже вытеснена.
+func (l *dnsQueryLog) since(afterSeq int64, limit int) ([]dnsQueryRecord, int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out, next := l.recs.since(afterSeq, limit, nil)
+	if out == nil {
+		out = []dnsQueryRecord{}
+	}
+	return out, next, l.recs.truncated(afterSeq)
+}
+
+func (l *dnsQueryLog) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recs.reset()
+}
+
+// aggregate — счётчики по путям, кодам ответа и типам записей с запуска процесса.
+func (l *dnsQueryLog) aggregate() (map[string]dnsTierStats, map[string]int64, map[string]int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tiers := make(map[string]dnsTierStats, len(l.tiers))
+	for k, t := range l.tiers {
+		tiers[k] = dnsTierStats{Queries: t.queries, AvgLatencyUs: t.totalUs / t.queries}
+	}
+	rcodes := make(map[string]int64, len(l.rcodes))
+	for k, v := range l.rcodes {
+		rcodes[k] = v
+	}
+	types := make(map[string]int64, len(l.types))
+	for k, v := range l.types {
+		types[k] = v
+	}
+	return tiers, rcodes, types
+}
+
+// maxDNSQueryLogSince — сколько записей отдаёт один вызов GetDNSQueryLog.
+const maxDNSQueryLogSince = 500
+
+// GetDNSQueryLog отдаёт записи журнала DNS запросов новее курсора afterSeq
+// (0 — с начала буфера), не больше limit (0 — до 500). Next — курсор для
+// следующего вызова; Truncated — часть записей после afterSeq уже вытеснена.
+func GetDNSQueryLog(afterSeq int64, limit int32) string {
+	n := int(limit)
+	if n <= 0 || n > maxDNSQueryLogSince {
+		n = maxDNSQueryLogSince
+	}
+	recs, next, truncated := dnsQueries.since(afterSeq, n)
+	data, _ := json.Marshal(struct {
+		Records   []dnsQueryRecord
+		Next      int64
+		Truncated bool
+	}{recs, next, truncated})
+	return string(data)
+}
+
+// ClearDNSQueryLog очищает журнал запросов; счётчики остаются.
+func ClearDNSQueryLog() { dnsQueries.clear() }
+
+// GetDNSStats возвращает JSON со счётчиками DNS прокси: запросы по путям с
+// средней задержкой, коды ответов, типы записей, кэш, апстримы и правила.
+func GetDNSStats() string {
+	data, _ := json.Marshal(dnsStats.snapshot())
+	return string(data)
+}
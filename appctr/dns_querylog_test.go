@@ -0,0 +1,102 @@
+package appctr
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSQueryLogRing(t *testing.T) {
+	l := newDNSQueryLog(3)
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeAAAA}
+	for range 5 {
+		l.record(time.Now(), "[::1]:5353", q, &dnsTrace{tier: dnsTierCache}, nil)
+	}
+	recs, next, truncated := l.since(0, 0)
+	if len(recs) != 3 || recs[0].Seq != 3 || next != 5 || truncated {
+		t.Fatalf("since(0) = %d records from %d, next %d, truncated %v", len(recs), recs[0].Seq, next, truncated)
+	}
+	if r := recs[0]; r.Client != "::1" || r.Name != "example.com" || r.Type != "AAAA" || r.RCode != "NoAnswer" {
+		t.Errorf("record = %+v", r)
+	}
+	if _, _, truncated := l.since(1, 0); !truncated {
+		t.Error("evicted records not reported")
+	}
+	recs, next, _ = l.since(3, 1)
+	if len(recs) != 1 || recs[0].Seq != 4 || next != 4 {
+		t.Errorf("since(3, 1) = %+v, next %d", recs, next)
+	}
+
+	l.clear()
+	if recs, next, _ := l.since(5, 0); len(recs) != 0 || next != 5 {
+		t.Errorf("after clear: %+v, next %d", recs, next)
+	}
+	l.record(time.Now(), "", q, &dnsTrace{tier: dnsTierCache}, nil)
+	if recs, _, _ := l.since(5, 0); len(recs) != 1 || recs[0].Seq != 6 {
+		t.Errorf("seq reset by clear: %+v", recs)
+	}
+}
+
+func TestDNSQueryLogTiers(t *testing.T) {
+	t.Cleanup(func() { dnsRules.Store(nil); dnsAnswers.flush() })
+	dnsAnswers.flush()
+	_, cursor, _ := dnsQueries.since(0, 0)
+	tiersBefore, rcodesBefore, _ := dnsQueries.aggregate()
+
+	dir := t.TempDir()
+	writeDNSRules(t, dir, "", "ads.example BLOCK\n")
+	if err := loadDNSRules(dir); err != nil {
+		t.Fatal(err)
+	}
+	live := fakeUpstream(t, 1)
+	up := testUpstreams(live)
+	query := func(name string, up *dnsUpstreams) {
+		t.Helper()
+		if processDNSQuery(buildQuery(t, 1, name, dnsmessage.TypeA, 0), "127.0.0.1:40000", up, "127.0.0.1:1") == nil {
+			t.Fatalf("%s: no answer", name)
+		}
+	}
+	query("ads.example.", up)
+	query("example.com.", up)
+	query("example.com.", up)
+	query("down.example.", testUpstreams("127.0.0.1:1"))
+	processDNSQuery([]byte{0, 1, 2}, "127.0.0.1:40000", up, "")
+
+	var log struct {
+		Records []dnsQueryRecord
+		Next    int64
+	}
+	if err := json.Unmarshal([]byte(GetDNSQueryLog(cursor, 0)), &log); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ name, tier, upstream, rcode string }{
+		{"ads.example", dnsTierRules, "ads.example", "Success"},
+		{"example.com", dnsTierFallback, live, "Success"},
+		{"example.com", dnsTierCache, "", "Success"},
+		{"down.example", dnsTierFallback, "", "ServerFailure"},
+	}
+	if len(log.Records) != len(want) || log.Next != cursor+4 {
+		t.Fatalf("log = %+v", log)
+	}
+	for i, w := range want {
+		r := log.Records[i]
+		if r.Name != w.name || r.Tier != w.tier || r.Upstream != w.upstream || r.RCode != w.rcode || r.Client != "127.0.0.1" || r.Type != "A" {
+			t.Errorf("record %d = %+v, want %+v", i, r, w)
+		}
+	}
+
+	var stats dnsStatsSnapshot
+	if err := json.Unmarshal([]byte(GetDNSStats()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	for tier, n := range map[string]int64{dnsTierFallback: 2, dnsTierCache: 1, dnsTierRules: 1} {
+		if got := stats.Tiers[tier].Queries - tiersBefore[tier].Queries; got != n {
+			t.Errorf("tier %s queries = %d, want %d", tier, got, n)
+		}
+	}
+	if stats.RCodes["Success"]-rcodesBefore["Success"] != 3 || stats.RCodes["ServerFailure"]-rcodesBefore["ServerFailure"] != 1 {
+		t.Errorf("rcodes = %v, before %v", stats.RCodes, rcodesBefore)
+	}
+}
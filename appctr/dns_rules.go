@@ -0,0 +1,315 @@
+package appctr
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Локальные правила DNS лежат в DataDir/dns:
+//
+//	hosts — как /etc/hosts: "IP имя [имя...]", имя может быть *.домен;
+//	        0.0.0.0 в hosts-блоклистах просто отвечается как адрес.
+//	rules — "шаблон ДЕЙСТВИЕ [значение]", по строке на правило:
+//	        nas.home      A        100.64.0.2
+//	        nas.home      AAAA     fd7a:115c:a1e0::2
+//	        *.dev.home    CNAME    nas.home
+//	        ads.example   NXDOMAIN
+//	        *.tracker.com BLOCK    (A 0.0.0.0, AAAA ::)
+//
+// # — комментарий. Шаблон *.домен ловит все поддомены, но не сам домен;
+// точное имя важнее шаблона, длинный шаблон важнее короткого.
+const (
+	dnsRulesDir  = "dns"
+	dnsHostsFile = "hosts"
+	dnsRulesFile = "rules"
+	// Сколько CNAME из правил подряд разворачиваем, прежде чем сдаться.
+	dnsMaxCNAMEChain = 8
+)
+
+const (
+	dnsRuleOverride = "override" // A/AAAA из hosts или правил
+	dnsRuleCNAME    = "cname"
+	dnsRuleNXDomain = "nxdomain"
+	dnsRuleBlock    = "block"
+)
+
+type dnsRule struct {
+	pattern string // имя или *.домен, в нижнем регистре без точки в конце
+	source  string // файл:строка первого определения
+	action  string
+	addrs   []netip.Addr
+	cname   string
+	hits    atomic.Int64
+}
+
+type dnsRuleStats struct {
+	Pattern string
+	Source  string
+	Action  string
+	Hits    int64
+}
+
+// dnsRuleSet — неизменяемый набор правил; при перезагрузке подменяется целиком.
+type dnsRuleSet struct {
+	exact    map[string]*dnsRule
+	wildcard map[string]*dnsRule // ключ — домен после "*."
+	list     []*dnsRule          // в порядке загрузки, для статистики
+}
+
+var dnsRules atomic.Pointer[dnsRuleSet]
+
+func newDNSRuleSet() *dnsRuleSet {
+	return &dnsRuleSet{exact: map[string]*dnsRule{}, wildcard: map[string]*dnsRule{}}
+}
+
+// rule возвращает правило для pattern, создавая его при первом упоминании.
+// Правило с другим действием не перезаписывается.
+func (s *dnsRuleSet) rule(pattern, action, source string) (*dnsRule, error) {
+	m, key := s.exact, pattern
+	if rest, ok := strings.CutPrefix(pattern, "*."); ok {
+		m, key = s.wildcard, rest
+	}
+	if key == "" || strings.ContainsAny(key, "*") {
+		return nil, fmt.Errorf("bad pattern %q", pattern)
+	}
+	if _, err := dnsmessage.NewName(key + "."); err != nil {
+		return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+	}
+	if r := m[key]; r != nil {
+		if r.action != action {
+			return nil, fmt.Errorf("%s already has a %s rule at %s", pattern, r.action, r.source)
+		}
+		return r, nil
+	}
+	r := &dnsRule{pattern: pattern, source: source, action: action}
+	m[key] = r
+	s.list = append(s.list, r)
+	return r, nil
+}
+
+// lookup находит правило для name: сначала точное, потом самый длинный шаблон.
+func (s *dnsRuleSet) lookup(name string) *dnsRule {
+	if s == nil || len(s.list) == 0 {
+		return nil
+	}
+	name = normalizeDNSName(name)
+	if r := s.exact[name]; r != nil {
+		return r
+	}
+	for {
+		_, rest, ok := strings.Cut(name, ".")
+		if !ok {
+			return nil
+		}
+		if r := s.wildcard[rest]; r != nil {
+			return r
+		}
+		name = rest
+	}
+}
+
+func (s *dnsRuleSet) parseHostsLine(line, source string) error {
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return errors.New("want: IP name [name...]")
+	}
+	ip, err := netip.ParseAddr(f[0])
+	if err != nil {
+		return err
+	}
+	for _, name := range f[1:] {
+		r, err := s.rule(normalizeDNSName(name), dnsRuleOverride, source)
+		if err != nil {
+			return err
+		}
+		r.addrs = append(r.addrs, ip.Unmap())
+	}
+	return nil
+}
+
+func (s *dnsRuleSet) parseRulesLine(line, source string) error {
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return errors.New("want: pattern ACTION [value]")
+	}
+	pattern, kind := normalizeDNSName(f[0]), strings.ToUpper(f[1])
+	want := 3
+	if kind == "NXDOMAIN" || kind == "BLOCK" {
+		want = 2
+	}
+	if len(f) != want {
+		return fmt.Errorf("%s takes %d fields", kind, want)
+	}
+	switch kind {
+	case "A", "AAAA":
+		ip, err := netip.ParseAddr(f[2])
+		if err != nil {
+			return err
+		}
+		if ip = ip.Unmap(); ip.Is4() != (kind == "A") {
+			return fmt.Errorf("%s is not an %s address", ip, kind)
+		}
+		r, err := s.rule(pattern, dnsRuleOverride, source)
+		if err != nil {
+			return err
+		}
+		r.addrs = append(r.addrs, ip)
+	case "CNAME":
+		target := normalizeDNSName(f[2])
+		if _, err := dnsmessage.NewName(target + "."); err != nil || target == "" {
+			return fmt.Errorf("bad CNAME target %q", f[2])
+		}
+		r, err := s.rule(pattern, dnsRuleCNAME, source)
+		if err != nil {
+			return err
+		}
+		if r.cname != "" {
+			return fmt.Errorf("%s already has a CNAME at %s", pattern, r.source)
+		}
+		r.cname = target
+	case "NXDOMAIN":
+		_, err := s.rule(pattern, dnsRuleNXDomain, source)
+		return err
+	case "BLOCK":
+		_, err := s.rule(pattern, dnsRuleBlock, source)
+		return err
+	default:
+		return fmt.Errorf("unknown action %q", f[1])
+	}
+	return nil
+}
+
+// loadFile читает файл правил построчно; плохие строки пропускаются с
+// предупреждением. Отсутствующий файл — не ошибка.
+func (s *dnsRuleSet) loadFile(path string, parse func(s *dnsRuleSet, line, source string) error) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", filepath.Base(path), n)
+		if err := parse(s, line, source); err != nil {
+			dnsLog.Warn("Skipping DNS rule", "at", source, "err", err)
+		}
+	}
+	return sc.Err()
+}
+
+// loadDNSRules загружает hosts и rules из dir и подменяет текущие правила.
+// Счётчики правил с тем же шаблоном переносятся из прошлого набора.
+func loadDNSRules(dir string) error {
+	s := newDNSRuleSet()
+	err := errors.Join(
+		s.loadFile(filepath.Join(dir, dnsHostsFile), (*dnsRuleSet).parseHostsLine),
+		s.loadFile(filepath.Join(dir, dnsRulesFile), (*dnsRuleSet).parseRulesLine),
+	)
+	if old := dnsRules.Load(); old != nil {
+		for _, r := range s.list {
+			if prev := old.lookupPattern(r.pattern); prev != nil {
+				r.hits.Store(prev.hits.Load())
+			}
+		}
+	}
+	dnsRules.Store(s)
+	dnsLog.Info("DNS rules loaded", "dir", dir, "rules", len(s.list), "err", err)
+	return err
+}
+
+func (s *dnsRuleSet) lookupPattern(pattern string) *dnsRule {
+	if rest, ok := strings.CutPrefix(pattern, "*."); ok {
+		return s.wildcard[rest]
+	}
+	return s.exact[pattern]
+}
+
+// answer отвечает на msg по правилу. CNAME разворачивается через resolve,
+// чтобы клиент сразу получил адреса цели.
+func (r *dnsRule) answer(msg *dnsmessage.Message, depth int, resolve func(msg *dnsmessage.Message, query []byte, depth int) []byte) []byte {
+	q := msg.Questions[0]
+	switch r.action {
+	case dnsRuleNXDomain:
+		return dnsReply(msg, dnsmessage.RCodeNameError, nil)
+	case dnsRuleBlock:
+		return dnsReply(msg, dnsmessage.RCodeSuccess, addrAnswers(q, []netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()}))
+	case dnsRuleOverride:
+		return dnsReply(msg, dnsmessage.RCodeSuccess, addrAnswers(q, r.addrs))
+	}
+
+	target := dnsmessage.MustNewName(r.cname + ".")
+	answers := []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: tailnetTTL},
+		Body:   &dnsmessage.CNAMEResource{CNAME: target},
+	}}
+	if q.Type == dnsmessage.TypeCNAME {
+		return dnsReply(msg, dnsmessage.RCodeSuccess, answers)
+	}
+	if depth >= dnsMaxCNAMEChain {
+		dnsLog.Warn("DNS rule CNAME chain too long", "name", q.Name.String())
+		return dnsReply(msg, dnsmessage.RCodeServerFailure, nil)
+	}
+
+	sub := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: target, Type: q.Type, Class: q.Class}},
+	}
+	query, err := sub.Pack()
+	if err != nil {
+		return dnsReply(msg, dnsmessage.RCodeServerFailure, nil)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(resolve(&sub, query, depth+1)); err != nil || resp.RCode == dnsmessage.RCodeServerFailure {
+		return dnsReply(msg, dnsmessage.RCodeServerFailure, nil)
+	}
+	return dnsReply(msg, resp.RCode, append(answers, resp.Answers...))
+}
+
+// ReloadDNSRules перечитывает hosts и rules из DataDir/dns без перезапуска.
+func ReloadDNSRules() error {
+	stateMu.Lock()
+	dir := PC.DataDir()
+	stateMu.Unlock()
+	if dir == "" {
+		return errors.New("data dir not set: start the service first")
+	}
+	return loadDNSRules(filepath.Join(dir, dnsRulesDir))
+}
+
+func (s *dnsRuleSet) stats() []dnsRuleStats {
+	if s == nil {
+		return nil
+	}
+	out := make([]dnsRuleStats, 0, len(s.list))
+	for _, r := range s.list {
+		out = append(out, dnsRuleStats{Pattern: r.pattern, Source: r.source, Action: r.action, Hits: r.hits.Load()})
+	}
+	return out
+}
+
+// GetDNSRuleStats возвращает JSON-массив правил со счётчиками срабатываний.
+func GetDNSRuleStats() string {
+	st := dnsRules.Load().stats()
+	if st == nil {
+		return "[]"
+	}
+	data, _ := json.Marshal(st)
+	return string(data)
+}
@@ -0,0 +1,154 @@
+package appctr
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testHosts = `# hosts
+100.64.0.2   nas.home
+10.1.1.1     Pinned.Example.COM. pinned2.example.com
+0.0.0.0      ads.example
+not-an-ip    broken.example
+`
+
+const testRules = `nas.home          AAAA     fd7a:115c:a1e0::2
+*.dev.home        CNAME    nas.home
+www.example       CNAME    example.com
+*.tracker.com     BLOCK
+*.ads.tracker.com NXDOMAIN
+loop1.home        CNAME    loop2.home
+loop2.home        CNAME    loop1.home
+nas.home          NXDOMAIN # уже есть override из hosts
+bad.home          A        fd00::1
+`
+
+func writeDNSRules(t *testing.T, dir, hosts, rules string) {
+	t.Helper()
+	for name, data := range map[string]string{dnsHostsFile: hosts, dnsRulesFile: rules} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// rrValue — содержимое записи ответа в виде строки для сравнения.
+func rrValue(r dnsmessage.Resource) string {
+	switch b := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return netip.AddrFrom4(b.A).String()
+	case *dnsmessage.AAAAResource:
+		return netip.AddrFrom16(b.AAAA).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	}
+	return r.Header.Type.String()
+}
+
+func TestDNSRules(t *testing.T) {
+	dir := t.TempDir()
+	writeDNSRules(t, dir, testHosts, testRules)
+	t.Cleanup(func() { dnsRules.Store(nil) })
+	if err := loadDNSRules(dir); err != nil {
+		t.Fatal(err)
+	}
+	up := testUpstreams(fakeUpstream(t, 1))
+
+	tests := []struct {
+		name  string
+		qtype dnsmessage.Type
+		rcode dnsmessage.RCode
+		want  []string // значения записей ответа по порядку
+	}{
+		{"nas.home.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"100.64.0.2"}},
+		{"NAS.home.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd7a:115c:a1e0::2"}},
+		{"nas.home.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, nil},
+		{"pinned.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.1.1.1"}},
+		{"pinned2.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.1.1.1"}},
+		{"ads.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"0.0.0.0"}},
+		{"api.dev.home.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"nas.home.", "100.64.0.2"}},
+		{"a.b.dev.home.", dnsmessage.TypeCNAME, dnsmessage.RCodeSuccess, []string{"nas.home."}},
+		{"www.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"example.com.", "10.0.0.0"}},
+		{"x.tracker.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"0.0.0.0"}},
+		{"x.tracker.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"::"}},
+		{"a.ads.tracker.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"loop1.home.", dnsmessage.TypeA, dnsmessage.RCodeServerFailure, nil},
+		// Шаблон *.домен не ловит сам домен, плохие строки не загружены.
+		{"tracker.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.0.0.0"}},
+		{"broken.example.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.0.0.0"}},
+		{"bad.home.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.0.0.0"}},
+	}
+	for _, tt := range tests {
+		dnsAnswers.flush()
+		resp := processDNSQuery(buildQuery(t, 7, tt.name, tt.qtype, 0), "", up, "127.0.0.1:1")
+		m := parseMsg(t, resp)
+		var got []string
+		for _, a := range m.Answers {
+			got = append(got, rrValue(a))
+		}
+		if m.ID != 7 || m.RCode != tt.rcode || len(got) != len(tt.want) {
+			t.Errorf("%s %v: rcode %v answers %v, want %v %v", tt.name, tt.qtype, m.RCode, got, tt.rcode, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s %v: answers %v, want %v", tt.name, tt.qtype, got, tt.want)
+				break
+			}
+		}
+	}
+	dnsAnswers.flush()
+
+	hits := map[string]int64{}
+	var stats []dnsRuleStats
+	if err := json.Unmarshal([]byte(GetDNSRuleStats()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stats {
+		hits[s.Pattern] = s.Hits
+	}
+	// nas.home: три прямых запроса и один через CNAME *.dev.home.
+	want := map[string]int64{"nas.home": 4, "*.dev.home": 2, "*.tracker.com": 2, "*.ads.tracker.com": 1, "loop1.home": 5, "loop2.home": 4}
+	for p, n := range want {
+		if hits[p] != n {
+			t.Errorf("hits[%s] = %d, want %d", p, hits[p], n)
+		}
+	}
+	if _, ok := hits["bad.home"]; ok {
+		t.Error("rule with wrong address family loaded")
+	}
+
+	// Перезагрузка подхватывает новые правила и сохраняет счётчики прежних.
+	writeDNSRules(t, dir, "100.64.0.9 nas.home\n", "new.home A 192.0.2.1\n")
+	if err := loadDNSRules(dir); err != nil {
+		t.Fatal(err)
+	}
+	resp := processDNSQuery(buildQuery(t, 1, "new.home.", dnsmessage.TypeA, 0), "", up, "127.0.0.1:1")
+	if m := parseMsg(t, resp); len(m.Answers) != 1 || rrValue(m.Answers[0]) != "192.0.2.1" {
+		t.Errorf("new rule answers = %v", m.Answers)
+	}
+	resp = processDNSQuery(buildQuery(t, 1, "api.dev.home.", dnsmessage.TypeA, 0), "", up, "127.0.0.1:1")
+	if m := parseMsg(t, resp); m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 1 {
+		t.Errorf("removed wildcard still answers: %v", m.Answers)
+	}
+	stats = nil
+	json.Unmarshal([]byte(GetDNSRuleStats()), &stats)
+	if len(stats) != 2 || stats[0].Pattern != "nas.home" || stats[0].Hits != 4 || stats[0].Source != "hosts:1" {
+		t.Errorf("stats after reload = %+v", stats)
+	}
+}
+
+func TestDNSRulesMissingFiles(t *testing.T) {
+	t.Cleanup(func() { dnsRules.Store(nil) })
+	if err := loadDNSRules(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetDNSRuleStats(); got != "[]" {
+		t.Errorf("stats = %s", got)
+	}
+}
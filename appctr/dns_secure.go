@@ -0,0 +1,291 @@
+package appctr
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Локальные DoH (RFC 8484) и DoT (RFC 7858) для браузеров и приложений со
+// встроенным secure DNS, которые не умеют в обычный UDP резолвер.
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+	// Самоподписанный сертификат лежит рядом с правилами, в DataDir/dns.
+	dnsCertFile = "tls.crt"
+	dnsKeyFile  = "tls.key"
+	// Срок самоподписанного сертификата; за месяц до конца выпускаем новый.
+	dnsCertLifetime = 5 * 365 * 24 * time.Hour
+	dnsCertRenew    = 30 * 24 * time.Hour
+)
+
+// dnsSecureConfig — адреса DoH и DoT и сертификат для них. Пустой адрес —
+// эндпоинт выключен.
+type dnsSecureConfig struct {
+	dohAddr  string
+	dohTLS   bool // DoH по HTTPS; иначе по HTTP, например за обратным прокси
+	dotAddr  string
+	certFile string // PEM от пользователя; пусто — самоподписанный в dir
+	keyFile  string
+	dir      string
+}
+
+// dnsServerCert — сертификат, с которым сейчас отвечают DoH и DoT.
+var dnsServerCert atomic.Pointer[tls.Certificate]
+
+// startSecureDNS поднимает DoH и DoT; handle уже пропущен через лимиты прокси.
+// Ошибки только логируются: обычный DNS прокси работает и без них.
+func startSecureDNS(ctx context.Context, cfg *dnsSecureConfig, handle dnsHandler) {
+	var tlsConfig *tls.Config
+	if cfg.dotAddr != "" || (cfg.dohAddr != "" && cfg.dohTLS) {
+		cert, err := loadDNSCertificate(cfg.certFile, cfg.keyFile, cfg.dir, listenHosts(cfg.dohAddr, cfg.dotAddr))
+		if err != nil {
+			dnsLog.Error("DNS TLS certificate unavailable, serving DoH over HTTP only", "err", err)
+		} else {
+			dnsServerCert.Store(&cert)
+			go func() {
+				<-ctx.Done()
+				dnsServerCert.CompareAndSwap(&cert, nil)
+			}()
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+	}
+
+	if cfg.dotAddr != "" && tlsConfig != nil {
+		if ln, err := net.Listen("tcp", cfg.dotAddr); err != nil {
+			dnsLog.Error("DoT listen failed", "err", err)
+		} else {
+			dotConfig := tlsConfig.Clone()
+			dotConfig.NextProtos = []string{"dot"}
+			dnsLog.Info("DoT listening", "addr", ln.Addr().String())
+			go func() {
+				if err := serveDNSTCP(ctx, tls.NewListener(ln, dotConfig), handle); err != nil {
+					dnsLog.Error("DoT stopped", "err", err)
+				}
+			}()
+		}
+	}
+
+	if cfg.dohAddr != "" && (!cfg.dohTLS || tlsConfig != nil) {
+		ln, err := net.Listen("tcp", cfg.dohAddr)
+		if err != nil {
+			dnsLog.Error("DoH listen failed", "err", err)
+			return
+		}
+		srv := &http.Server{
+			Handler:           dohHandler(handle),
+			ReadHeaderTimeout: dnsTCPIdleTimeout,
+			IdleTimeout:       dnsTCPIdleTimeout,
+		}
+		if cfg.dohTLS {
+			srv.TLSConfig = tlsConfig.Clone()
+			ln = tls.NewListener(ln, srv.TLSConfig)
+		}
+		dnsLog.Info("DoH listening", "addr", ln.Addr().String(), "tls", cfg.dohTLS)
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+		go func() {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				dnsLog.Error("DoH stopped", "err", err)
+			}
+		}()
+	}
+}
+
+// dohHandler отвечает на GET ?dns=<base64url> и POST application/dns-message.
+func dohHandler(handle dnsHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != dohPath {
+			http.NotFound(w, r)
+			return
+		}
+		var query []byte
+		switch r.Method {
+		case http.MethodGet:
+			// RFC 8484 требует base64url без паддинга, но паддинг прощаем.
+			q, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+			if err != nil || len(q) == 0 {
+				http.Error(w, "bad dns parameter", http.StatusBadRequest)
+				return
+			}
+			query = q
+		case http.MethodPost:
+			if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != dohContentType {
+				http.Error(w, "content type must be "+dohContentType, http.StatusUnsupportedMediaType)
+				return
+			}
+			q, err := io.ReadAll(io.LimitReader(r.Body, 0xffff+1))
+			if err != nil || len(q) == 0 {
+				http.Error(w, "bad dns message", http.StatusBadRequest)
+				return
+			}
+			if len(q) > 0xffff {
+				http.Error(w, "dns message too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			query = q
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		resp := handle(query, dohClientAddr(r.RemoteAddr))
+		if resp == nil {
+			http.Error(w, "dns proxy stopping", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		// RFC 8484 5.1: свежесть HTTP ответа не дольше TTL в нём.
+		if ttl, ok := cacheableTTL(resp); ok {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl.Seconds())))
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write(resp)
+	})
+}
+
+// dohClientAddr превращает RemoteAddr запроса в адрес для лимитера и журнала.
+func dohClientAddr(remote string) net.Addr {
+	ap, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// listenHosts — хосты из адресов эндпоинтов, на которые должен быть выписан
+// сертификат, кроме 0.0.0.0 и ::.
+func listenHosts(addrs ...string) []string {
+	var hosts []string
+	for _, a := range addrs {
+		host, _, err := net.SplitHostPort(a)
+		if err != nil || host == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(host); err == nil && ip.IsUnspecified() {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// loadDNSCertificate берёт сертификат пользователя, если он задан, иначе
+// самоподписанный из dir. Самоподписанный выпускается заново, если его нет,
+// он скоро истекает или не покрывает hosts.
+func loadDNSCertificate(certFile, keyFile, dir string, hosts []string) (tls.Certificate, error) {
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("load dns certificate: %w", err)
+		}
+		return cert, nil
+	}
+
+	certPath, keyPath := filepath.Join(dir, dnsCertFile), filepath.Join(dir, dnsKeyFile)
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && certCovers(cert.Leaf, hosts) {
+		return cert, nil
+	}
+	certPEM, keyPEM, err := newSelfSignedDNSCert(append([]string{"localhost", "127.0.0.1", "::1"}, hosts...))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+		return tls.Certificate{}, err
+	}
+	dnsLog.Info("Generated self-signed DNS certificate", "path", certPath)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func certCovers(leaf *x509.Certificate, hosts []string) bool {
+	if leaf == nil || time.Until(leaf.NotAfter) < dnsCertRenew {
+		return false
+	}
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// newSelfSignedDNSCert выпускает самоподписанный ECDSA P-256 сертификат на
+// hosts. Это не CA и подписывать другие сертификаты он не может: поставленный
+// в доверенные, он подтверждает только сам себя, даже если ключ утечёт.
+func newSelfSignedDNSCert(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "tailscaled local DNS"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(dnsCertLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// GetDNSCertificate возвращает PEM сертификата локальных DoH и DoT, чтобы его
+// можно было поставить в доверенные; пусто, если они не запущены.
+func GetDNSCertificate() string {
+	cert := dnsServerCert.Load()
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}))
+}
@@ -0,0 +1,190 @@
+package appctr
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSCertificate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dns")
+	cert, err := loadDNSCertificate("", "", dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err := cert.Leaf.VerifyHostname(h); err != nil {
+			t.Errorf("self-signed cert: %v", err)
+		}
+	}
+	// Не CA: доверие к нему не даёт подписывать чужие сертификаты.
+	if cert.Leaf.IsCA || cert.Leaf.KeyUsage&x509.KeyUsageCertSign != 0 {
+		t.Errorf("self-signed cert is a CA: IsCA %v, key usage %v", cert.Leaf.IsCA, cert.Leaf.KeyUsage)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "localhost"}); err != nil {
+		t.Errorf("pinned self-signed cert does not verify: %v", err)
+	}
+	again, err := loadDNSCertificate("", "", dir, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Certificate[0], cert.Certificate[0]) {
+		t.Error("certificate regenerated on restart")
+	}
+	// Новый адрес эндпоинта — новый сертификат, который его покрывает.
+	lan, err := loadDNSCertificate("", "", dir, []string{"192.168.1.5", "dns.home"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(lan.Certificate[0], cert.Certificate[0]) || lan.Leaf.VerifyHostname("192.168.1.5") != nil || lan.Leaf.VerifyHostname("dns.home") != nil {
+		t.Error("certificate not reissued for new listen hosts")
+	}
+
+	// Сертификат пользователя берётся как есть, без выпуска своего.
+	user, err := loadDNSCertificate(filepath.Join(dir, dnsCertFile), filepath.Join(dir, dnsKeyFile), t.TempDir(), []string{"other.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(user.Certificate[0], lan.Certificate[0]) {
+		t.Error("user certificate not used")
+	}
+	if _, err := loadDNSCertificate(filepath.Join(dir, "missing.crt"), filepath.Join(dir, dnsKeyFile), dir, nil); err == nil {
+		t.Error("missing user certificate accepted")
+	}
+}
+
+func TestDoHHandler(t *testing.T) {
+	up := testUpstreams(fakeUpstream(t, 1))
+	t.Cleanup(dnsAnswers.flush)
+	srv := httptest.NewServer(dohHandler(func(q []byte, client net.Addr) []byte {
+		if client == nil {
+			t.Error("no client address")
+		}
+		return processDNSQuery(q, client.String(), up, "")
+	}))
+	defer srv.Close()
+	query := buildQuery(t, 0, "example.com.", dnsmessage.TypeA, 0)
+	b64 := base64.RawURLEncoding.EncodeToString(query)
+
+	tests := []struct {
+		name, method, path, ctype string
+		body                      []byte
+		status                    int
+	}{
+		{"get", http.MethodGet, dohPath + "?dns=" + b64, "", nil, http.StatusOK},
+		{"get padded", http.MethodGet, dohPath + "?dns=" + base64.URLEncoding.EncodeToString(query), "", nil, http.StatusOK},
+		{"post", http.MethodPost, dohPath, dohContentType, query, http.StatusOK},
+		{"get without dns", http.MethodGet, dohPath, "", nil, http.StatusBadRequest},
+		{"get bad base64", http.MethodGet, dohPath + "?dns=%%%", "", nil, http.StatusBadRequest},
+		{"post wrong type", http.MethodPost, dohPath, "text/plain", query, http.StatusUnsupportedMediaType},
+		{"post empty", http.MethodPost, dohPath, dohContentType, nil, http.StatusBadRequest},
+		{"put", http.MethodPut, dohPath, dohContentType, query, http.StatusMethodNotAllowed},
+		{"other path", http.MethodGet, "/resolve?dns=" + b64, "", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, srv.URL+tt.path, bytes.NewReader(tt.body))
+			if tt.ctype != "" {
+				req.Header.Set("Content-Type", tt.ctype)
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != dohContentType {
+				t.Errorf("content type = %q", ct)
+			}
+			if cc := resp.Header.Get("Cache-Control"); !strings.HasPrefix(cc, "max-age=") {
+				t.Errorf("cache control = %q", cc)
+			}
+			if m := parseMsg(t, body); m.ID != 0 || m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 1 {
+				t.Errorf("answer: id %d rcode %v, %d answers", m.ID, m.RCode, len(m.Answers))
+			}
+		})
+	}
+}
+
+func TestSecureDNSEndpoints(t *testing.T) {
+	dnsAnswers.flush()
+	t.Cleanup(dnsAnswers.flush)
+	upstream, _ := standInUDP(t, 4, 0)
+	sec := &dnsSecureConfig{dohAddr: freeAddr(t), dohTLS: true, dotAddr: freeAddr(t), dir: t.TempDir()}
+	lim := dnsLimits{workers: 4, backlog: 16, clientRate: 1e6, clientBurst: 1e6}
+	startTestDNSProxy(t, lim, testUpstreams(upstream), sec)
+
+	// Эндпоинты поднимаются следом за обычным TCP; ждём оба.
+	for _, addr := range []string{sec.dohAddr, sec.dotAddr} {
+		for i := 0; ; i++ {
+			if c, err := net.Dial("tcp", addr); err == nil {
+				c.Close()
+				break
+			}
+			if i == 50 {
+				t.Fatalf("%s did not start", addr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(GetDNSCertificate())) {
+		t.Fatal("GetDNSCertificate returned no certificate")
+	}
+	if _, err := os.Stat(filepath.Join(sec.dir, dnsCertFile)); err != nil {
+		t.Errorf("self-signed certificate not saved: %v", err)
+	}
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	// DoH по HTTPS с проверкой сертификата.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Post("https://"+sec.dohAddr+dohPath, dohContentType, bytes.NewReader(buildQuery(t, 0, "doh.example.", dnsmessage.TypeA, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || answerIP(t, body) != 4 {
+		t.Errorf("DoH: status %d", resp.StatusCode)
+	}
+
+	// DoT: те же кадры с длиной, что и DNS over TCP, внутри TLS.
+	conn, err := tls.Dial("tcp", sec.dotAddr, &tls.Config{RootCAs: roots, NextProtos: []string{"dot"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for id := range uint16(2) {
+		writeDNSTCP(conn, buildQuery(t, 10+id, "dot.example.", dnsmessage.TypeA, 0))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := readDNSTCP(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := parseMsg(t, resp); m.ID != 10+id || answerIP(t, resp) != 4 {
+			t.Errorf("DoT query %d: id %d", id, m.ID)
+		}
+	}
+}
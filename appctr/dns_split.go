@@ -0,0 +1,135 @@
+package appctr
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// splitDNSRoute — резолверы одного split DNS домена из DNS конфига netmap.
+// Маршрут без резолверов значит, что домен решает сам демон (MagicDNS), и
+// он перекрывает более короткий маршрут сверху.
+type splitDNSRoute struct {
+	domain    string
+	resolvers []string     // host:port в порядке из конфига
+	preferred atomic.Int32 // индекс последнего ответившего: с него начинаем
+}
+
+// order возвращает резолверы, начиная с последнего ответившего, дальше по
+// кругу в порядке конфига.
+func (r *splitDNSRoute) order() []string {
+	i := int(r.preferred.Load())
+	if i <= 0 || i >= len(r.resolvers) {
+		return r.resolvers
+	}
+	return slices.Concat(r.resolvers[i:], r.resolvers[:i])
+}
+
+// answered запоминает, что server ответил, чтобы следующие запросы шли к нему.
+func (r *splitDNSRoute) answered(server string) {
+	if i := slices.Index(r.resolvers, server); i >= 0 {
+		r.preferred.Store(int32(i))
+	}
+}
+
+// splitDNSTable — неизменяемая таблица маршрутов; при смене netmap
+// собирается новая и подменяется целиком.
+type splitDNSTable struct {
+	routes map[string]*splitDNSRoute // ключ — домен в нижнем регистре без точки в конце
+}
+
+// newSplitDNSTable собирает таблицу из DNS.Routes. Резолверы, до которых
+// нельзя дойти DNS по TCP через SOCKS5 (DoH и прочие URL), пропускаются.
+// prev — прошлая таблица: от неё переносится выбор резолвера, если маршрут
+// не поменялся.
+func newSplitDNSTable(cfg localDNSConfig, prev *splitDNSTable) *splitDNSTable {
+	t := &splitDNSTable{routes: make(map[string]*splitDNSRoute, len(cfg.Routes))}
+	for d, resolvers := range cfg.Routes {
+		d = normalizeDNSName(d)
+		if d == "" {
+			continue
+		}
+		r := &splitDNSRoute{domain: d}
+		for _, res := range resolvers {
+			server, ok := splitDNSResolverAddr(res.Addr)
+			if !ok {
+				dnsLog.Debug("Skipping split DNS resolver", "domain", d, "resolver", res.Addr)
+				continue
+			}
+			r.resolvers = append(r.resolvers, server)
+		}
+		if old := prev.route(d); old != nil && slices.Equal(old.resolvers, r.resolvers) {
+			r.preferred.Store(old.preferred.Load())
+		}
+		t.routes[d] = r
+	}
+	return t
+}
+
+// splitDNSResolverAddr приводит адрес резолвера из netmap ("1.2.3.4",
+// "1.2.3.4:53", "[fd00::1]:5353") к host:port.
+func splitDNSResolverAddr(addr string) (string, bool) {
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		return net.JoinHostPort(ip.String(), "53"), true
+	}
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return ap.String(), true
+	}
+	return "", false
+}
+
+func normalizeDNSName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (t *splitDNSTable) route(domain string) *splitDNSRoute {
+	if t == nil {
+		return nil
+	}
+	return t.routes[domain]
+}
+
+// lookup возвращает маршрут с самым длинным суффиксом name или nil.
+func (t *splitDNSTable) lookup(name string) *splitDNSRoute {
+	if t == nil || len(t.routes) == 0 {
+		return nil
+	}
+	name = normalizeDNSName(name)
+	for name != "" {
+		if r := t.routes[name]; r != nil {
+			return r
+		}
+		_, rest, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = rest
+	}
+	return nil
+}
+
+// splitDNSRoutes — текущая таблица; обновляется из IPN bus при каждом netmap.
+var splitDNSRoutes atomic.Pointer[splitDNSTable]
+
+// setSplitDNSConfig перестраивает таблицу по DNS конфигу netmap; nil — очистить.
+func setSplitDNSConfig(cfg *localDNSConfig) {
+	if cfg == nil {
+		splitDNSRoutes.Store(nil)
+		return
+	}
+	t := newSplitDNSTable(*cfg, splitDNSRoutes.Load())
+	splitDNSRoutes.Store(t)
+	for _, r := range t.routes {
+		rememberTailnetDomain(r.domain)
+	}
+	for _, d := range cfg.Domains {
+		rememberTailnetDomain(d)
+	}
+	dnsLog.Debug("Split DNS routes updated", "routes", len(t.routes))
+}
+
+func splitDNSRouteFor(name string) *splitDNSRoute {
+	return splitDNSRoutes.Load().lookup(name)
+}
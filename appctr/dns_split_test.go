@@ -0,0 +1,154 @@
+package appctr
+
+import (
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testSplitConfig(routes map[string][]string) localDNSConfig {
+	cfg := localDNSConfig{Routes: map[string][]localResolver{}}
+	for d, addrs := range routes {
+		cfg.Routes[d] = []localResolver{}
+		for _, a := range addrs {
+			cfg.Routes[d] = append(cfg.Routes[d], localResolver{Addr: a})
+		}
+	}
+	return cfg
+}
+
+func TestSplitDNSLongestSuffix(t *testing.T) {
+	tbl := newSplitDNSTable(testSplitConfig(map[string][]string{
+		"example.":          {"10.0.0.1"},
+		"corp.example.":     {"10.0.1.1", "10.0.1.2:5353"},
+		"lab.corp.example.": {"[fd00::53]:53"},
+		// Исключение: поддомен решает сам демон, а не резолвер corp.example.
+		"public.corp.example.": {},
+		"doh.example.":         {"https://dns.example/dns-query"},
+	}), nil)
+
+	tests := []struct {
+		name, route string
+		resolvers   []string
+	}{
+		{"example", "example", []string{"10.0.0.1:53"}},
+		{"www.example.", "example", []string{"10.0.0.1:53"}},
+		{"corp.example", "corp.example", []string{"10.0.1.1:53", "10.0.1.2:5353"}},
+		{"Host.CORP.example.", "corp.example", []string{"10.0.1.1:53", "10.0.1.2:5353"}},
+		{"a.b.lab.corp.example", "lab.corp.example", []string{"[fd00::53]:53"}},
+		{"www.public.corp.example", "public.corp.example", nil},
+		{"doh.example", "doh.example", nil},
+		// Суффикс должен совпадать по границе метки.
+		{"notcorp.example", "example", []string{"10.0.0.1:53"}},
+		{"example.org", "", nil},
+		{"", "", nil},
+	}
+	for _, tt := range tests {
+		r := tbl.lookup(tt.name)
+		if tt.route == "" {
+			if r != nil {
+				t.Errorf("%q matched %q", tt.name, r.domain)
+			}
+			continue
+		}
+		if r == nil || r.domain != tt.route || !slices.Equal(r.resolvers, tt.resolvers) {
+			t.Errorf("%q = %+v, want %s %v", tt.name, r, tt.route, tt.resolvers)
+		}
+	}
+}
+
+func TestSplitDNSResolverOrder(t *testing.T) {
+	cfg := testSplitConfig(map[string][]string{"corp.example": {"10.0.1.1", "10.0.1.2", "10.0.1.3"}})
+	tbl := newSplitDNSTable(cfg, nil)
+	r := tbl.lookup("corp.example")
+	if got := r.order(); !slices.Equal(got, []string{"10.0.1.1:53", "10.0.1.2:53", "10.0.1.3:53"}) {
+		t.Fatalf("order = %v", got)
+	}
+	r.answered("10.0.1.2:53")
+	if got := r.order(); !slices.Equal(got, []string{"10.0.1.2:53", "10.0.1.3:53", "10.0.1.1:53"}) {
+		t.Fatalf("order after answer = %v", got)
+	}
+
+	// Тот же маршрут в новом netmap сохраняет выбор, изменённый — сбрасывает.
+	if got := newSplitDNSTable(cfg, tbl).lookup("corp.example").order()[0]; got != "10.0.1.2:53" {
+		t.Errorf("preferred lost on identical netmap: %s", got)
+	}
+	changed := testSplitConfig(map[string][]string{"corp.example": {"10.0.1.1", "10.0.1.2"}})
+	if got := newSplitDNSTable(changed, tbl).lookup("corp.example").order()[0]; got != "10.0.1.1:53" {
+		t.Errorf("preferred kept after resolvers changed: %s", got)
+	}
+}
+
+func TestSplitDNSFromIPNBus(t *testing.T) {
+	resetBus()
+	t.Cleanup(resetBus)
+	cfg := testSplitConfig(map[string][]string{"corp.example": {"10.0.1.1"}})
+	handleNotify(&localNotify{NetMap: &localNetMap{DNS: cfg}})
+	if r := splitDNSRouteFor("git.corp.example"); r == nil || r.domain != "corp.example" {
+		t.Fatalf("route = %+v", r)
+	}
+	handleNotify(&localNotify{NetMap: &localNetMap{}})
+	if r := splitDNSRouteFor("git.corp.example"); r != nil {
+		t.Errorf("route survived netmap without it: %+v", r)
+	}
+	handleNotify(&localNotify{NetMap: &localNetMap{DNS: cfg}})
+	resetBus()
+	if r := splitDNSRouteFor("git.corp.example"); r != nil {
+		t.Errorf("route survived resetBus: %+v", r)
+	}
+}
+
+func TestSplitDNSQueryPrefersLastAnswered(t *testing.T) {
+	socksAddr, seen := recordingSOCKS5(t)
+	live := fakeUpstream(t, 1)
+	dead := "127.0.0.1:1"
+	resetBus()
+	setState(StateRunning, "")
+	t.Cleanup(func() { setState(StateStopped, ""); resetBus() })
+	setSplitDNSConfig(&localDNSConfig{Routes: map[string][]localResolver{
+		"corp.example": {{Addr: dead}, {Addr: live}},
+	}})
+	t.Cleanup(dnsAnswers.flush)
+
+	for i, want := range [][]string{{dead, live}, {live}} {
+		dnsAnswers.flush()
+		resp := processDNSQuery(buildQuery(t, 1, "git.corp.example.", dnsmessage.TypeA, 0), "", testUpstreams(), socksAddr)
+		if m := parseMsg(t, resp); m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 1 {
+			t.Fatalf("query %d: rcode %v, %d answers", i, m.RCode, len(m.Answers))
+		}
+		for _, w := range want {
+			if got := <-seen; got != w {
+				t.Errorf("query %d: SOCKS5 dial to %s, want %s", i, got, w)
+			}
+		}
+		select {
+		case got := <-seen:
+			t.Errorf("query %d: extra SOCKS5 dial to %s", i, got)
+		default:
+		}
+	}
+}
+
+func TestSplitDNSDownDoesNotLeak(t *testing.T) {
+	socksAddr, seen := recordingSOCKS5(t)
+	public, hits := standInUDP(t, 1, 0)
+	resetBus()
+	setState(StateRunning, "")
+	t.Cleanup(func() { setState(StateStopped, ""); resetBus() })
+	setSplitDNSConfig(&localDNSConfig{Routes: map[string][]localResolver{
+		"corp.example": {{Addr: "127.0.0.1:1"}},
+	}})
+	t.Cleanup(dnsAnswers.flush)
+
+	resp := processDNSQuery(buildQuery(t, 1, "git.corp.example.", dnsmessage.TypeA, 0), "", testUpstreams(public), socksAddr)
+	if m := parseMsg(t, resp); m.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("rcode %v, want SERVFAIL", m.RCode)
+	}
+	if got := <-seen; got != "127.0.0.1:1" {
+		t.Errorf("SOCKS5 dial to %s, want the split resolver", got)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("public fallback got %d queries for a split-DNS name", n)
+	}
+}
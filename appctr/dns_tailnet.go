@@ -0,0 +1,350 @@
+package appctr
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"maps"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Адреса нод тейлнета: CGNAT 100.64.0.0/10 и ULA Tailscale.
+var (
+	tailnetCGNAT = netip.MustParsePrefix("100.64.0.0/10")
+	tailnetULA   = netip.MustParsePrefix("fd7a:115c:a1e0::/48")
+)
+
+// quad100DNS — резолвер MagicDNS внутри tailscaled, доступен только через SOCKS5.
+const quad100DNS = "100.100.100.100:53"
+
+// tailnetTTL — TTL синтезированных ответов для имён тейлнета.
+const tailnetTTL = 60
+
+func isTailnetAddr(a netip.Addr) bool {
+	a = a.Unmap()
+	return tailnetCGNAT.Contains(a) || tailnetULA.Contains(a)
+}
+
+// parseReverseName переводит имя из in-addr.arpa или ip6.arpa обратно в адрес.
+func parseReverseName(name string) (netip.Addr, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var a [4]byte
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			a[3-i] = byte(n)
+		}
+		return netip.AddrFrom4(a), true
+	}
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, false
+		}
+		var a [16]byte
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return netip.Addr{}, false
+			}
+			// Первая метка — младший полубайт последнего байта.
+			pos := 31 - i
+			if pos%2 == 0 {
+				a[pos/2] |= byte(n) << 4
+			} else {
+				a[pos/2] |= byte(n)
+			}
+		}
+		return netip.AddrFrom16(a), true
+	}
+	return netip.Addr{}, false
+}
+
+// ptrName ищет в netmap ноду с адресом a и возвращает её FQDN.
+func ptrName(nm *localNetMap, a netip.Addr) string {
+	a = a.Unmap()
+	nodes := nm.Peers
+	if nm.SelfNode != nil {
+		nodes = append([]*localNode{nm.SelfNode}, nodes...)
+	}
+	for _, n := range nodes {
+		if n == nil || n.Name == "" {
+			continue
+		}
+		for _, p := range n.Addresses {
+			if p.Addr() == a {
+				if !strings.HasSuffix(n.Name, ".") {
+					return n.Name + "."
+				}
+				return n.Name
+			}
+		}
+	}
+	return ""
+}
+
+// tailnetNetMap — последний netmap из IPN bus, а если его ещё нет — из LocalAPI.
+func tailnetNetMap(ctx context.Context, lc *localClient) *localNetMap {
+	if nm := currentNetMap(); nm != nil {
+		return nm
+	}
+	if !IsRunning() {
+		return nil
+	}
+	nm, err := lc.NetMap(ctx)
+	if err != nil {
+		dnsLog.Debug("LocalAPI netmap failed", "err", err)
+		return nil
+	}
+	return nm
+}
+
+// tailnetStatus — status демона или nil, если он не запущен.
+func tailnetStatus(ctx context.Context, lc *localClient) *localStatus {
+	if !IsRunning() {
+		return nil
+	}
+	st, err := lc.Status(ctx)
+	if err != nil {
+		dnsLog.Debug("LocalAPI status failed", "err", err)
+		return nil
+	}
+	rememberTailnetDomain(st.magicDNSSuffix())
+	return st
+}
+
+// tailnetReady сообщает, что демон дошёл до Running и netmap со split DNS
+// актуальны. До этого прокси отвечает на публичные имена через fallback.
+func tailnetReady() bool {
+	st, _ := currentState()
+	return st == StateRunning
+}
+
+// dnsSawTailnet — был ли тейлнет готов на прошлом запросе к прокси.
+var dnsSawTailnet atomic.Bool
+
+// syncTailnetReady зовётся на каждый запрос до кэша: при переходе в Running
+// сбрасывает кэш, ответы в нём получены мимо тейлнета.
+func syncTailnetReady() {
+	if ready := tailnetReady(); dnsSawTailnet.Swap(ready) != ready && ready {
+		dnsLog.Debug("Tailnet ready, flushing DNS cache")
+		dnsAnswers.flush()
+	}
+}
+
+// tailnetDomainsFile — файл в DataDir, где домены тейлнета переживают
+// перезапуск процесса, по одному в строке.
+const tailnetDomainsFile = "tailnet_domains"
+
+// tailnetDomains — суффикс MagicDNS и домены split DNS этого тейлнета,
+// виденные раньше. Переживают Stop/Start и перезапуск: пока демон
+// поднимается, по ним видно, какие имена нельзя отдавать публичным
+// резолверам. Весь ts.net сюда не входит: имена чужих тейлнетов публичные.
+var (
+	tailnetDomainsMu   sync.Mutex
+	tailnetDomains     = map[string]bool{}
+	tailnetDomainsPath string // куда сохранять; пусто — только в памяти
+)
+
+// loadTailnetDomains добавляет домены, сохранённые в path, и запоминает
+// path для новых.
+func loadTailnetDomains(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		dnsLog.Warn("Reading tailnet domains failed", "path", path, "err", err)
+	}
+	tailnetDomainsMu.Lock()
+	defer tailnetDomainsMu.Unlock()
+	tailnetDomainsPath = path
+	for _, d := range strings.Fields(string(data)) {
+		if d = normalizeDNSName(d); d != "" {
+			tailnetDomains[d] = true
+		}
+	}
+}
+
+func rememberTailnetDomain(domain string) {
+	domain = normalizeDNSName(domain)
+	if domain == "" {
+		return
+	}
+	tailnetDomainsMu.Lock()
+	defer tailnetDomainsMu.Unlock()
+	if tailnetDomains[domain] {
+		return
+	}
+	tailnetDomains[domain] = true
+	if tailnetDomainsPath == "" {
+		return
+	}
+	list := slices.Sorted(maps.Keys(tailnetDomains))
+	if err := os.WriteFile(tailnetDomainsPath, []byte(strings.Join(list, "\n")+"\n"), 0o600); err != nil {
+		dnsLog.Warn("Saving tailnet domains failed", "path", tailnetDomainsPath, "err", err)
+	}
+}
+
+// isTailnetName сообщает, что имя относится к тейлнету: короткое имя ноды,
+// имя под известным доменом тейлнета или обратное имя адреса тейлнета.
+func isTailnetName(name string) bool {
+	name = normalizeDNSName(name)
+	if !strings.Contains(name, ".") {
+		return name != ""
+	}
+	if addr, ok := parseReverseName(name); ok {
+		return isTailnetAddr(addr)
+	}
+	tailnetDomainsMu.Lock()
+	defer tailnetDomainsMu.Unlock()
+	for d := name; d != ""; {
+		if tailnetDomains[d] {
+			return true
+		}
+		_, d, _ = strings.Cut(d, ".")
+	}
+	return false
+}
+
+func (st *localStatus) magicDNSSuffix() string {
+	s := st.MagicDNSSuffix
+	if s == "" && st.CurrentTailnet != nil {
+		s = st.CurrentTailnet.MagicDNSSuffix
+	}
+	return strings.TrimSuffix(s, ".")
+}
+
+// inDomain сообщает, совпадает ли name с suffix или лежит под ним.
+func inDomain(name, suffix string) bool {
+	if suffix == "" {
+		return false
+	}
+	name, suffix = strings.ToLower(name), strings.ToLower(suffix)
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
+
+// addrAnswers строит записи A или AAAA (по типу вопроса) из адресов ноды.
+func addrAnswers(q dnsmessage.Question, ips []netip.Addr) []dnsmessage.Resource {
+	var out []dnsmessage.Resource
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: tailnetTTL}
+		switch {
+		case ip.Is4() && q.Type == dnsmessage.TypeA:
+			out = append(out, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: ip.As4()}})
+		case ip.Is6() && q.Type == dnsmessage.TypeAAAA:
+			out = append(out, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: ip.As16()}})
+		}
+	}
+	return out
+}
+
+// dnsReply отвечает на msg сам. Пустой answers с RCodeSuccess — NODATA.
+func dnsReply(msg *dnsmessage.Message, rcode dnsmessage.RCode, answers []dnsmessage.Resource) []byte {
+	return dnsReplyAuth(msg, rcode, answers, nil)
+}
+
+// tailnetNXDomain — NXDOMAIN с SOA зоны MagicDNS, чтобы ответ попал в
+// негативный кэш (RFC 2308 3).
+func tailnetNXDomain(msg *dnsmessage.Message, suffix string) []byte {
+	zone, err := dnsmessage.NewName(suffix + ".")
+	if err != nil {
+		return dnsReply(msg, dnsmessage.RCodeNameError, nil)
+	}
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: tailnetTTL},
+		Body: &dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.ts.net."),
+			MBox:   dnsmessage.MustNewName("hostmaster.ts.net."),
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: tailnetTTL,
+		},
+	}
+	return dnsReplyAuth(msg, dnsmessage.RCodeNameError, nil, []dnsmessage.Resource{soa})
+}
+
+func dnsReplyAuth(msg *dnsmessage.Message, rcode dnsmessage.RCode, answers, authorities []dnsmessage.Resource) []byte {
+	m := dnsmessage.Message{Header: msg.Header, Questions: msg.Questions}
+	m.Response = true
+	m.AuthenticData = false
+	m.Authoritative = rcode == dnsmessage.RCodeSuccess || rcode == dnsmessage.RCodeNameError
+	m.RecursionAvailable = true
+	m.RCode = rcode
+	m.Answers = answers
+	m.Authorities = authorities
+	// OPT клиента не копируем (RFC 6891 7): свой размер, DO эхом, без опций
+	// вроде cookie, которые имеют смысл только для того, кто их прислал.
+	for _, r := range msg.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			m.Additionals = []dnsmessage.Resource{dnsOPT(r.Header.DNSSECAllowed())}
+			break
+		}
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		dnsLog.Debug("DNS reply pack failed", "err", err)
+		return nil
+	}
+	return packed
+}
+
+// dnsOPT — наш OPT для ответа: размер dnsEDNSUDPSize, DO как у клиента.
+func dnsOPT(do bool) dnsmessage.Resource {
+	var h dnsmessage.ResourceHeader
+	h.SetEDNS0(dnsEDNSUDPSize, dnsmessage.RCodeSuccess, do)
+	return dnsmessage.Resource{Header: h, Body: &dnsmessage.OPTResource{}}
+}
+
+// resolveTailnetReverse отвечает на обратный запрос к адресу тейлнета:
+// PTR из netmap, для прочих адресов (shared ноды, 4via6) — MagicDNS демона.
+// В публичный DNS такие запросы не уходят.
+func resolveTailnetReverse(ctx context.Context, lc *localClient, msg *dnsmessage.Message, addr netip.Addr, query []byte, socksAddr string, tr *dnsTrace) []byte {
+	q := msg.Questions[0]
+	if nm := tailnetNetMap(ctx, lc); nm != nil {
+		if name := ptrName(nm, addr); name != "" {
+			target, err := dnsmessage.NewName(name)
+			if err == nil {
+				dnsStats.Tailnet.Add(1)
+				tr.set(dnsTierTailnet, "")
+				var answers []dnsmessage.Resource
+				if q.Type == dnsmessage.TypePTR {
+					answers = append(answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: tailnetTTL},
+						Body:   &dnsmessage.PTRResource{PTR: target},
+					})
+				}
+				return dnsReply(msg, dnsmessage.RCodeSuccess, answers)
+			}
+		}
+	}
+	return forwardQuad100(msg, query, socksAddr, tr)
+}
+
+// forwardQuad100 передаёт запрос резолверу MagicDNS через SOCKS5 демона.
+// Если он недоступен — SERVFAIL: имя тейлнета нельзя отдавать публичным серверам.
+func forwardQuad100(msg *dnsmessage.Message, query []byte, socksAddr string, tr *dnsTrace) []byte {
+	if IsRunning() {
+		resp, err := forwardDNSviaSOCKS5(query, socksAddr, quad100DNS)
+		if err == nil {
+			dnsStats.Quad100.Add(1)
+			tr.set(dnsTierQuad100, quad100DNS)
+			return resp
+		}
+		dnsLog.Error("MagicDNS via SOCKS5 failed", "name", msg.Questions[0].Name.String(), "err", err)
+	}
+	dnsStats.Failed.Add(1)
+	tr.set(dnsTierQuad100, "")
+	return dnsReply(msg, dnsmessage.RCodeServerFailure, nil)
+}
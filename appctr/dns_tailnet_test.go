@@ -0,0 +1,311 @@
+package appctr
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/socks5"
+)
+
+func TestParseReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // "" — не разбирается
+	}{
+		{"2.0.64.100.in-addr.arpa.", "100.64.0.2"},
+		{"1.0.168.192.IN-ADDR.ARPA", "192.168.0.1"},
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", "fd7a:115c:a1e0::2"},
+		{"0.64.100.in-addr.arpa.", ""},
+		{"256.0.64.100.in-addr.arpa.", ""},
+		{"x.0.64.100.in-addr.arpa.", ""},
+		{"2.0.0.ip6.arpa.", ""},
+		{"example.com.", ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseReverseName(tt.name)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("%s: parsed as %v", tt.name, got)
+			}
+			continue
+		}
+		if !ok || got != netip.MustParseAddr(tt.want) {
+			t.Errorf("%s = %v, %v; want %s", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestIsTailnetAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"100.64.0.1":         true,
+		"100.127.255.254":    true,
+		"100.128.0.1":        false,
+		"::ffff:100.100.1.1": true,
+		"fd7a:115c:a1e0::1":  true,
+		"fd7a:115c:a1e1::1":  false,
+		"8.8.8.8":            false,
+	} {
+		if got := isTailnetAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isTailnetAddr(%s) = %v", addr, got)
+		}
+	}
+}
+
+func TestPTRName(t *testing.T) {
+	nm := &localNetMap{
+		SelfNode: &localNode{Name: "phone.tail1.ts.net.", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")}},
+		Peers: []*localNode{
+			nil,
+			{Name: "nas.tail1.ts.net", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32"), netip.MustParsePrefix("fd7a:115c:a1e0::2/128")}},
+		},
+	}
+	for addr, want := range map[string]string{
+		"100.64.0.1":        "phone.tail1.ts.net.",
+		"fd7a:115c:a1e0::2": "nas.tail1.ts.net.",
+		"100.64.0.9":        "",
+	} {
+		if got := ptrName(nm, netip.MustParseAddr(addr)); got != want {
+			t.Errorf("ptrName(%s) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+// fakeTailnet поднимает LocalAPI с одной нодой, netmap в IPN bus и SOCKS5,
+// который вместо 100.100.100.100:53 ведёт на локальный TCP DNS. Возвращает
+// адрес SOCKS5 и канал с именами, дошедшими до MagicDNS.
+func fakeTailnet(t *testing.T) (string, chan string) {
+	t.Helper()
+	return fakeTailnetWith(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusInternalServerError)
+	})
+}
+
+// fakeTailnetWith — fakeTailnet с обработчиком LocalAPI dns-query.
+func fakeTailnetWith(t *testing.T, dnsQuery http.HandlerFunc) (string, chan string) {
+	t.Helper()
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "tailscaled.sock")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"BackendState":   "Running",
+			"MagicDNSSuffix": "tail1.ts.net",
+			"Self":           map[string]any{"HostName": "phone", "DNSName": "phone.tail1.ts.net.", "TailscaleIPs": []string{"100.64.0.1"}},
+			"Peer": map[string]any{
+				"nodekey:1": map[string]any{"HostName": "nas", "DNSName": "nas.tail1.ts.net.", "TailscaleIPs": []string{"100.64.0.2"}},
+			},
+		})
+	})
+	mux.HandleFunc("/localapi/v0/dns-query", dnsQuery)
+	serveLocalAPI(t, sock, mux)
+
+	seen := make(chan string, 10)
+	dnsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveDNSTCP(context.Background(), dnsLn, func(q []byte, _ net.Addr) []byte {
+		var m dnsmessage.Message
+		if m.Unpack(q) != nil {
+			return nil
+		}
+		seen <- m.Questions[0].Name.String()
+		return dnsReply(&m, dnsmessage.RCodeNameError, nil)
+	})
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &socks5.Server{Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != quad100DNS {
+			t.Errorf("SOCKS5 dial to %s", addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, dnsLn.Addr().String())
+	}}
+	go ss.Serve(socksLn)
+
+	stateMu.Lock()
+	oldPC, oldSup := PC, daemonSup
+	PC = newPathControl(filepath.Join(dir, "lib", "libtailscale.so"), sock, filepath.Join(dir, "state"))
+	daemonSup = &supervisor{}
+	stateMu.Unlock()
+	busMu.Lock()
+	busLastNetMap = &localNetMap{
+		SelfNode: &localNode{Name: "phone.tail1.ts.net.", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")}},
+		Peers:    []*localNode{{Name: "nas.tail1.ts.net.", Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")}}},
+	}
+	busMu.Unlock()
+	setState(StateRunning, "")
+	dnsAnswers.flush()
+	t.Cleanup(func() {
+		socksLn.Close()
+		dnsLn.Close()
+		setState(StateStopped, "")
+		stateMu.Lock()
+		PC, daemonSup = oldPC, oldSup
+		stateMu.Unlock()
+		resetBus()
+		dnsAnswers.flush()
+	})
+	return socksLn.Addr().String(), seen
+}
+
+func TestProcessDNSQueryTailnetTypes(t *testing.T) {
+	socksAddr, seen := fakeTailnet(t)
+	// Публичный апстрим отвечает тремя A: так видно, что запрос утёк.
+	public := testUpstreams(fakeUpstream(t, 3))
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers int
+		quad100 bool
+	}{
+		{"ptr for peer", "2.0.64.100.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 1, false},
+		{"ptr for self", "1.0.64.100.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 1, false},
+		{"txt on tailnet reverse name", "2.0.64.100.in-addr.arpa.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, 0, false},
+		{"ptr for unknown tailnet addr", "9.0.64.100.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeNameError, 0, true},
+		{"ptr for public addr", "8.8.8.8.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, 3, false},
+		{"a for peer", "nas.tail1.ts.net.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, 1, false},
+		{"aaaa for v4-only peer", "nas.tail1.ts.net.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, 0, false},
+		{"https for peer", "nas.tail1.ts.net.", dnsmessage.Type(65), dnsmessage.RCodeSuccess, 0, false},
+		{"srv under magicdns suffix", "_http._tcp.nas.tail1.ts.net.", dnsmessage.TypeSRV, dnsmessage.RCodeNameError, 0, true},
+		{"txt on public name", "example.com.", dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, 3, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := processDNSQuery(buildQuery(t, uint16(i+1), tt.qname, tt.qtype, 0), "", public, socksAddr)
+			if resp == nil {
+				t.Fatal("no response")
+			}
+			m := parseMsg(t, resp)
+			if m.RCode != tt.rcode || len(m.Answers) != tt.answers {
+				t.Errorf("rcode = %v, answers = %d; want %v, %d", m.RCode, len(m.Answers), tt.rcode, tt.answers)
+			}
+			select {
+			case name := <-seen:
+				if !tt.quad100 {
+					t.Errorf("%s unexpectedly sent to MagicDNS", name)
+				} else if name != tt.qname {
+					t.Errorf("MagicDNS got %s", name)
+				}
+			default:
+				if tt.quad100 {
+					t.Error("query did not reach MagicDNS")
+				}
+			}
+			if tt.qtype == dnsmessage.TypePTR && tt.answers == 1 {
+				ptr, ok := m.Answers[0].Body.(*dnsmessage.PTRResource)
+				if !ok || !inDomain(ptr.PTR.String(), "tail1.ts.net.") {
+					t.Errorf("PTR answer = %v", m.Answers[0].Body)
+				}
+			}
+		})
+	}
+}
+
+// Синтезированный ответ несёт свой OPT, а не копию клиентского.
+func TestTailnetReplyRebuildsOPT(t *testing.T) {
+	socksAddr, _ := fakeTailnet(t)
+	dnsAnswers.flush()
+	t.Cleanup(dnsAnswers.flush)
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true)
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 9, RecursionDesired: true, AuthenticData: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("nas.tail1.ts.net."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{Options: []dnsmessage.Option{
+			{Code: 10, Data: []byte("clientcookie")}, // COOKIE
+		}}}},
+	}
+	query, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := parseMsg(t, processDNSQuery(query, "", testUpstreams(fakeUpstream(t, 1)), socksAddr))
+	if m.ID != 9 || len(m.Answers) != 1 || m.AuthenticData {
+		t.Fatalf("reply: id %d, %d answers, ad %v", m.ID, len(m.Answers), m.AuthenticData)
+	}
+	if len(m.Additionals) != 1 || m.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+		t.Fatalf("additionals = %v", m.Additionals)
+	}
+	h := m.Additionals[0].Header
+	if h.Class != dnsEDNSUDPSize || !h.DNSSECAllowed() || len(m.Additionals[0].Body.(*dnsmessage.OPTResource).Options) != 0 {
+		t.Errorf("OPT = %v %v", h, m.Additionals[0].Body)
+	}
+
+	// Без OPT в запросе его нет и в ответе, даже из кэша.
+	m = parseMsg(t, processDNSQuery(buildQuery(t, 10, "nas.tail1.ts.net.", dnsmessage.TypeA, 0), "", testUpstreams(fakeUpstream(t, 1)), socksAddr))
+	if len(m.Additionals) != 0 {
+		t.Errorf("OPT added to a plain query: %v", m.Additionals)
+	}
+}
+
+func TestDNSBeforeRunning(t *testing.T) {
+	socksAddr, seen := fakeTailnet(t)
+	// Суффикс MagicDNS сохранён прошлым процессом.
+	path := filepath.Join(t.TempDir(), tailnetDomainsFile)
+	if err := os.WriteFile(path, []byte("tail1.ts.net\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tailnetDomainsMu.Lock()
+	tailnetDomains = map[string]bool{}
+	tailnetDomainsMu.Unlock()
+	loadTailnetDomains(path)
+	t.Cleanup(func() {
+		tailnetDomainsMu.Lock()
+		tailnetDomainsPath = ""
+		tailnetDomainsMu.Unlock()
+	})
+	// Домен split DNS из прошлой сессии: таблица сброшена, но домен помним.
+	setSplitDNSConfig(&localDNSConfig{Routes: map[string][]localResolver{"corp.example": {{Addr: "10.0.0.53"}}}})
+	resetBus()
+	setState(StateConnecting, "")
+	public, hits := standInUDP(t, 3, 0)
+	up := testUpstreams(public)
+
+	for _, name := range []string{"nas.tail1.ts.net.", "nas.", "2.0.64.100.in-addr.arpa.", "git.corp.example."} {
+		resp := processDNSQuery(buildQuery(t, 1, name, dnsmessage.TypeA, 0), "", up, socksAddr)
+		if m := parseMsg(t, resp); m.RCode != dnsmessage.RCodeServerFailure || len(m.Answers) != 0 {
+			t.Errorf("%s before Running: rcode %v, %d answers", name, m.RCode, len(m.Answers))
+		}
+	}
+	// Имена чужих тейлнетов публичные.
+	for _, name := range []string{"example.com.", "other.tail2.ts.net."} {
+		resp := processDNSQuery(buildQuery(t, 1, name, dnsmessage.TypeA, 0), "", up, socksAddr)
+		if m := parseMsg(t, resp); m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 1 {
+			t.Errorf("public name %s before Running: rcode %v, %d answers", name, m.RCode, len(m.Answers))
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("public upstream hits = %d, want 2: tailnet names leaked", n)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "corp.example\ntail1.ts.net\n" {
+		t.Errorf("saved tailnet domains = %q", data)
+	}
+	select {
+	case name := <-seen:
+		t.Errorf("%s sent to MagicDNS before Running", name)
+	default:
+	}
+
+	// С Running включается тейлнет, а ответы, полученные до него, забываются.
+	setState(StateRunning, "")
+	resp := processDNSQuery(buildQuery(t, 2, "nas.tail1.ts.net.", dnsmessage.TypeA, 0), "", up, socksAddr)
+	if m := parseMsg(t, resp); len(m.Answers) != 1 || rrValue(m.Answers[0]) != "100.64.0.2" {
+		t.Errorf("peer after Running: rcode %v, answers %v", m.RCode, m.Answers)
+	}
+	processDNSQuery(buildQuery(t, 3, "example.com.", dnsmessage.TypeA, 0), "", up, socksAddr)
+	if n := hits.Load(); n != 3 {
+		t.Errorf("public upstream hits = %d, want 3: cache not flushed on Running", n)
+	}
+}
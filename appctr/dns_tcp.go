@@ -0,0 +1,214 @@
+package appctr
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsHandler отвечает на сырой DNS запрос от client; nil — не отвечать.
+type dnsHandler func(query []byte, client net.Addr) []byte
+
+const (
+	// RFC 7766 6.2.3: неактивное соединение закрываем через несколько секунд.
+	dnsTCPIdleTimeout = 10 * time.Second
+	// Сколько запросов одного соединения обрабатываются параллельно (pipelining).
+	dnsTCPMaxInFlight = 16
+	// Минимальный размер UDP ответа без EDNS (RFC 1035 4.2.1).
+	dnsMinUDPSize = 512
+	// Размер UDP, который объявляем в своих OPT (DNS flag day 2020).
+	dnsEDNSUDPSize = 1232
+)
+
+// readDNSTCP читает одно сообщение с двухбайтовым префиксом длины (RFC 1035 4.2.2).
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return errors.New("dns message too large for tcp")
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// serveDNSTCP обслуживает DNS over TCP, пока не закроют ln или не отменят ctx.
+func serveDNSTCP(ctx context.Context, ln net.Listener, handle dnsHandler) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go handleDNSTCPConn(ctx, c, handle)
+	}
+}
+
+// handleDNSTCPConn читает запросы подряд и отвечает по мере готовности,
+// не дожидаясь предыдущих (RFC 7766 6.2.1.1: ответы могут идти не по порядку).
+func handleDNSTCPConn(ctx context.Context, c net.Conn, handle dnsHandler) {
+	defer c.Close()
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, dnsTCPMaxInFlight)
+
+	for ctx.Err() == nil {
+		c.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := readDNSTCP(c)
+		if err != nil {
+			return
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			resp := handle(query, c.RemoteAddr())
+			if resp == nil {
+				return
+			}
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			c.SetWriteDeadline(time.Now().Add(dnsTCPIdleTimeout))
+			if err := writeDNSTCP(c, resp); err != nil {
+				dnsLog.Debug("DNS TCP write error", "err", err)
+			}
+		}()
+	}
+}
+
+// udpPayloadSize — сколько байт клиент готов принять по UDP: размер из EDNS0 OPT
+// (RFC 6891 6.2.3), но не меньше 512.
+func udpPayloadSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return dnsMinUDPSize
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return dnsMinUDPSize
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return dnsMinUDPSize
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return dnsMinUDPSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsMinUDPSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return max(int(h.Class), dnsMinUDPSize)
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return dnsMinUDPSize
+		}
+	}
+}
+
+// truncateDNSResponse обрезает ответ, не влезающий в UDP: остаются заголовок
+// с битом TC, вопрос и OPT, чтобы клиент повторил запрос по TCP (RFC 7766 5).
+func truncateDNSResponse(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return resp
+	}
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return resp
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return resp
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return resp
+	}
+	var opt *dnsmessage.Resource
+	for {
+		r, err := p.Additional()
+		if err != nil {
+			break
+		}
+		if r.Header.Type == dnsmessage.TypeOPT {
+			opt = &r
+			break
+		}
+	}
+
+	h.Truncated = true
+	b := dnsmessage.NewBuilder(make([]byte, 0, dnsMinUDPSize), h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return resp
+	}
+	for _, q := range qs {
+		if err := b.Question(q); err != nil {
+			return resp
+		}
+	}
+	if opt != nil {
+		if err := b.StartAdditionals(); err != nil {
+			return resp
+		}
+		if err := b.OPTResource(opt.Header, *opt.Body.(*dnsmessage.OPTResource)); err != nil {
+			return resp
+		}
+	}
+	out, err := b.Finish()
+	if err != nil {
+		return resp
+	}
+	return out
+}
+
+// isTruncated сообщает, выставлен ли в ответе бит TC.
+func isTruncated(resp []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	return err == nil && h.Truncated
+}
+
+func forwardDNSviaTCP(query []byte, server string) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeDNSTCP(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSStreamReply(conn, query)
+}
@@ -0,0 +1,212 @@
+package appctr
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type, ednsSize int) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	if ednsSize > 0 {
+		b.StartAdditionals()
+		var rh dnsmessage.ResourceHeader
+		rh.SetEDNS0(ednsSize, dnsmessage.RCodeSuccess, false)
+		b.OPTResource(rh, dnsmessage.OPTResource{})
+	}
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// bigAnswer отвечает на запрос n записями A.
+func bigAnswer(t *testing.T, query []byte, n int) []byte {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil {
+		t.Fatal(err)
+	}
+	m.Response = true
+	for i := 0; i < n; i++ {
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, byte(i >> 8), byte(i)}},
+		})
+	}
+	resp, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func parseMsg(t *testing.T, b []byte) dnsmessage.Message {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestUDPPayloadSize(t *testing.T) {
+	for _, tt := range []struct {
+		edns int
+		want int
+	}{{0, 512}, {1232, 1232}, {100, 512}, {4096, 4096}} {
+		if got := udpPayloadSize(buildQuery(t, 1, "example.com.", dnsmessage.TypeA, tt.edns)); got != tt.want {
+			t.Errorf("edns %d: size = %d, want %d", tt.edns, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateDNSResponse(t *testing.T) {
+	q := buildQuery(t, 7, "big.example.", dnsmessage.TypeA, 1232)
+	resp := bigAnswer(t, q, 100)
+	if len(resp) <= 1232 {
+		t.Fatalf("test response too small: %d", len(resp))
+	}
+	if got := truncateDNSResponse(resp, 4096); len(got) != len(resp) {
+		t.Error("response that fits must not be touched")
+	}
+	tr := truncateDNSResponse(resp, udpPayloadSize(q))
+	m := parseMsg(t, tr)
+	if !m.Truncated || m.ID != 7 || len(m.Answers) != 0 || len(m.Questions) != 1 || m.Questions[0].Name.String() != "big.example." {
+		t.Errorf("truncated = %+v", m.Header)
+	}
+	if len(m.Additionals) != 1 || m.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+		t.Errorf("OPT must be kept: %+v", m.Additionals)
+	}
+}
+
+func TestDNSTCPPipelining(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveDNSTCP(ctx, ln, func(q []byte, _ net.Addr) []byte {
+		m := parseMsg(t, q)
+		if m.ID == 1 {
+			time.Sleep(200 * time.Millisecond) // первый запрос медленный
+		}
+		return bigAnswer(t, q, 1)
+	})
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for id := uint16(1); id <= 2; id++ {
+		if err := writeDNSTCP(c, buildQuery(t, id, "example.com.", dnsmessage.TypeA, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ids []uint16
+	for i := 0; i < 2; i++ {
+		resp, err := readDNSTCP(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, parseMsg(t, resp).ID)
+	}
+	if ids[0] != 2 || ids[1] != 1 {
+		t.Errorf("response order = %v, want [2 1]: second query must not wait for the first", ids)
+	}
+}
+
+// fakeUpstream — DNS сервер на одном порту: по UDP отвечает TC, по TCP — полным ответом.
+func fakeUpstream(t *testing.T, answers int) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip("tcp port busy:", err)
+	}
+	t.Cleanup(func() { pc.Close(); ln.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(truncateDNSResponse(bigAnswer(t, buf[:n], answers), dnsMinUDPSize), addr)
+		}
+	}()
+	go serveDNSTCP(context.Background(), ln, func(q []byte, _ net.Addr) []byte { return bigAnswer(t, q, answers) })
+	return pc.LocalAddr().String()
+}
+
+func TestDNSProxyTCPAndTruncation(t *testing.T) {
+	upstream := fakeUpstream(t, 100)
+
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().String()
+	probe.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go startDNSProxy(ctx, addr, "127.0.0.1:1", testUpstreams(upstream), nil)
+
+	var tcp net.Conn
+	for i := 0; ; i++ {
+		if tcp, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer tcp.Close()
+	tcp.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// По TCP — полный ответ (прокси сам дошёл до апстрима по TCP после TC).
+	writeDNSTCP(tcp, buildQuery(t, 11, "big.example.", dnsmessage.TypeA, 0))
+	resp, err := readDNSTCP(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := parseMsg(t, resp); m.Truncated || len(m.Answers) != 100 {
+		t.Errorf("tcp answer: tc=%v answers=%d", m.Truncated, len(m.Answers))
+	}
+
+	// По UDP без EDNS — TC и пустой ответ.
+	udp, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.SetDeadline(time.Now().Add(10 * time.Second))
+	udp.Write(buildQuery(t, 12, "big.example.", dnsmessage.TypeA, 0))
+	buf := make([]byte, 65535)
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > dnsMinUDPSize {
+		t.Errorf("udp answer is %d bytes", n)
+	}
+	if m := parseMsg(t, buf[:n]); !m.Truncated || m.ID != 12 {
+		t.Errorf("udp answer: %+v", m.Header)
+	}
+}
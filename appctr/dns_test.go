@@ -0,0 +1,95 @@
+package appctr
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// rawQuery собирает запрос с произвольным заголовком и вопросами.
+func rawQuery(t *testing.T, h dnsmessage.Header, names ...string) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	for _, n := range names {
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(n), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	}
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestProcessDNSQueryRCode(t *testing.T) {
+	socksAddr, _ := fakeTailnet(t)
+	live := []string{fakeUpstream(t, 1)}
+	dead := []string{"127.0.0.1:1"}
+
+	oneQuestion := rawQuery(t, dnsmessage.Header{ID: 42, RecursionDesired: true}, "example.com.")
+	cut := oneQuestion[:len(oneQuestion)-3]
+
+	tests := []struct {
+		name      string
+		query     []byte
+		upstreams []string
+		noAnswer  bool
+		rcode     dnsmessage.RCode
+		answers   int
+		soa       bool
+	}{
+		{name: "shorter than header", query: []byte{0, 42, 1}, noAnswer: true},
+		{name: "response bit set", query: rawQuery(t, dnsmessage.Header{ID: 42, Response: true}, "example.com."), noAnswer: true},
+		{name: "no questions", query: rawQuery(t, dnsmessage.Header{ID: 42}), rcode: dnsmessage.RCodeRefused},
+		{name: "two questions", query: rawQuery(t, dnsmessage.Header{ID: 42}, "a.example.", "b.example."), rcode: dnsmessage.RCodeRefused},
+		{name: "cut question", query: cut, rcode: dnsmessage.RCodeRefused},
+		{name: "unknown tailnet name", query: buildQuery(t, 42, "ghost.tail1.ts.net.", dnsmessage.TypeA, 0), upstreams: live, rcode: dnsmessage.RCodeNameError, soa: true},
+		{name: "unknown tailnet name aaaa", query: buildQuery(t, 42, "ghost.tail1.ts.net.", dnsmessage.TypeAAAA, 0), upstreams: live, rcode: dnsmessage.RCodeNameError, soa: true},
+		{name: "known tailnet name", query: buildQuery(t, 42, "phone.tail1.ts.net.", dnsmessage.TypeA, 0), upstreams: dead, rcode: dnsmessage.RCodeSuccess, answers: 1},
+		{name: "public name upstream ok", query: buildQuery(t, 42, "example.com.", dnsmessage.TypeA, 0), upstreams: live, rcode: dnsmessage.RCodeSuccess, answers: 1},
+		{name: "public name all upstreams fail", query: buildQuery(t, 42, "example.org.", dnsmessage.TypeA, 0), upstreams: dead, rcode: dnsmessage.RCodeServerFailure},
+		{name: "no upstreams", query: buildQuery(t, 42, "example.net.", dnsmessage.TypeA, 0), rcode: dnsmessage.RCodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dnsAnswers.flush()
+			resp := processDNSQuery(tt.query, "", testUpstreams(tt.upstreams...), socksAddr)
+			if tt.noAnswer {
+				if resp != nil {
+					t.Fatalf("answered %x", resp)
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatal("no answer")
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.ID != 42 || !h.Response || h.RCode != tt.rcode {
+				t.Fatalf("header = %+v, want rcode %v", h, tt.rcode)
+			}
+			if tt.rcode == dnsmessage.RCodeRefused {
+				return
+			}
+			m := parseMsg(t, resp)
+			if len(m.Answers) != tt.answers {
+				t.Errorf("answers = %d, want %d", len(m.Answers), tt.answers)
+			}
+			hasSOA := len(m.Authorities) == 1 && m.Authorities[0].Header.Type == dnsmessage.TypeSOA
+			if hasSOA != tt.soa {
+				t.Errorf("authorities = %v", m.Authorities)
+			}
+		})
+	}
+
+	// SERVFAIL не кэшируется, NXDOMAIN с SOA — кэшируется.
+	dnsAnswers.flush()
+	processDNSQuery(buildQuery(t, 1, "example.org.", dnsmessage.TypeA, 0), "", testUpstreams(dead...), socksAddr)
+	processDNSQuery(buildQuery(t, 1, "ghost.tail1.ts.net.", dnsmessage.TypeA, 0), "", testUpstreams(dead...), socksAddr)
+	if n := dnsAnswers.stats().Entries; n != 1 {
+		t.Errorf("cache entries = %d, want 1", n)
+	}
+}
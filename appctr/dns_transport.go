@@ -0,0 +1,359 @@
+package appctr
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Протоколы апстримов. В DnsFallbacks задаются схемой URL:
+//
+//	8.8.8.8:53, udp://8.8.8.8       — обычный DNS по UDP (с переходом на TCP при TC)
+//	tcp://8.8.8.8                   — DNS по TCP (RFC 7766)
+//	tls://dns.google                — DNS over TLS (RFC 7858), порт 853
+//	https://dns.google/dns-query    — DNS over HTTPS (RFC 8484), POST, HTTP/2
+//
+// После # можно указать bootstrap IP через запятую, чтобы не резолвить имя
+// сервера системным DNS: tls://dns.google#8.8.8.8,8.8.4.4.
+const (
+	dnsProtoUDP   = "udp"
+	dnsProtoTCP   = "tcp"
+	dnsProtoTLS   = "tls"
+	dnsProtoHTTPS = "https"
+)
+
+const (
+	// Сколько простаивающих TCP/TLS соединений держать на апстрим.
+	dnsStreamMaxIdle = 4
+	// Соединение, простоявшее дольше, закрываем: сервер, скорее всего, уже закрыл его.
+	dnsStreamIdleTimeout = 20 * time.Second
+)
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type idleDNSConn struct {
+	conn net.Conn
+	used time.Time
+}
+
+// parseDNSUpstream разбирает одну запись из DnsFallbacks или DohFallback.
+func parseDNSUpstream(s string) (*dnsUpstream, error) {
+	s = strings.TrimSpace(s)
+	u := &dnsUpstream{addr: s, score: 1}
+	var d net.Dialer
+	u.dial = d.DialContext
+
+	raw, boot, _ := strings.Cut(s, "#")
+	if boot != "" {
+		for _, b := range strings.Split(boot, ",") {
+			ip, err := netip.ParseAddr(strings.TrimSpace(b))
+			if err != nil {
+				return nil, fmt.Errorf("dns upstream %q: bad bootstrap ip: %w", s, err)
+			}
+			u.bootstrap = append(u.bootstrap, ip)
+		}
+	}
+	if ip, err := netip.ParseAddr(raw); err == nil {
+		raw = "udp://" + netip.AddrPortFrom(ip, 53).String()
+	} else if !strings.Contains(raw, "://") {
+		raw = "udp://" + raw
+	}
+	pu, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("dns upstream %q: %w", s, err)
+	}
+	if pu.Hostname() == "" {
+		return nil, fmt.Errorf("dns upstream %q: no host", s)
+	}
+	u.proto = pu.Scheme
+	port := pu.Port()
+	switch u.proto {
+	case dnsProtoUDP, dnsProtoTCP:
+		if port == "" {
+			port = "53"
+		}
+	case dnsProtoTLS:
+		if port == "" {
+			port = "853"
+		}
+	case dnsProtoHTTPS:
+		u.url = raw
+		if port == "" {
+			port = "443"
+		}
+	default:
+		return nil, fmt.Errorf("dns upstream %q: unknown scheme %q", s, pu.Scheme)
+	}
+	u.host = net.JoinHostPort(pu.Hostname(), port)
+	u.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if u.proto == dnsProtoTLS {
+		u.tlsConfig.ServerName = pu.Hostname()
+	}
+	return u, nil
+}
+
+func (u *dnsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	switch u.proto {
+	case dnsProtoHTTPS:
+		return u.exchangeDoH(ctx, query)
+	case dnsProtoTCP, dnsProtoTLS:
+		return u.exchangeStream(ctx, query)
+	}
+	if _, via := u.dialer(); via {
+		return u.exchangeStream(ctx, query)
+	}
+	resp, err := forwardDNSviaUDP(ctx, query, u.host)
+	if err == nil && isTruncated(resp) {
+		// Ответ не влез в UDP — берём полный по TCP у того же сервера.
+		if full, terr := forwardDNSviaTCP(query, u.host); terr == nil {
+			resp = full
+		}
+	}
+	return resp, err
+}
+
+func (u *dnsUpstream) dialer() (dialContextFunc, bool) {
+	u.poolMu.Lock()
+	defer u.poolMu.Unlock()
+	return u.dial, u.viaSOCKS
+}
+
+// setDialer меняет маршрут до апстрима и закрывает открытые по старому соединения.
+func (u *dnsUpstream) setDialer(dial dialContextFunc, viaSOCKS bool) {
+	u.poolMu.Lock()
+	u.dial, u.viaSOCKS = dial, viaSOCKS
+	u.poolMu.Unlock()
+	u.closeIdle()
+}
+
+// dialServer соединяется с addr, подставляя bootstrap IP вместо имени.
+func (u *dnsUpstream) dialServer(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial, _ := u.dialer()
+	if len(u.bootstrap) == 0 {
+		return dial(ctx, network, addr)
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range u.bootstrap {
+		c, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (u *dnsUpstream) dialStream(ctx context.Context) (net.Conn, error) {
+	c, err := u.dialServer(ctx, "tcp", u.host)
+	if err != nil || u.proto != dnsProtoTLS {
+		return c, err
+	}
+	tc := tls.Client(c, u.tlsConfig)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// takeIdle достаёт последнее свежее простаивающее соединение.
+func (u *dnsUpstream) takeIdle() net.Conn {
+	u.poolMu.Lock()
+	defer u.poolMu.Unlock()
+	for len(u.idle) > 0 {
+		ic := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if time.Since(ic.used) < dnsStreamIdleTimeout {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+	return nil
+}
+
+func (u *dnsUpstream) putIdle(c net.Conn) {
+	c.SetDeadline(time.Time{})
+	u.poolMu.Lock()
+	defer u.poolMu.Unlock()
+	if len(u.idle) >= dnsStreamMaxIdle {
+		c.Close()
+		return
+	}
+	u.idle = append(u.idle, idleDNSConn{conn: c, used: time.Now()})
+}
+
+// exchangeStream отправляет запрос по TCP или TLS, переиспользуя соединения.
+// Если сервер закрыл простаивавшее соединение, запрос повторяется по новому.
+func (u *dnsUpstream) exchangeStream(ctx context.Context, query []byte) ([]byte, error) {
+	for {
+		c := u.takeIdle()
+		reused := c != nil
+		if !reused {
+			var err error
+			if c, err = u.dialStream(ctx); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := exchangeOnConn(ctx, c, query)
+		if err == nil {
+			u.putIdle(c)
+			return resp, nil
+		}
+		c.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func exchangeOnConn(ctx context.Context, c net.Conn, query []byte) ([]byte, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+	if err := writeDNSTCP(c, query); err != nil {
+		return nil, err
+	}
+	resp, err := readDNSStreamReply(c, query)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// httpClient — свой клиент на апстрим: keep-alive и HTTP/2 держат одно
+// соединение на все запросы, а не открывают новое на каждый.
+func (u *dnsUpstream) httpClient() *http.Client {
+	u.clientOnce.Do(func() {
+		c := &http.Client{Transport: &http.Transport{
+			DialContext:         u.dialServer,
+			TLSClientConfig:     u.tlsConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: dnsStreamMaxIdle,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: dnsUpstreamDoHTimeout,
+		}}
+		u.poolMu.Lock()
+		u.client = c
+		u.poolMu.Unlock()
+	})
+	u.poolMu.Lock()
+	defer u.poolMu.Unlock()
+	return u.client
+}
+
+func (u *dnsUpstream) exchangeDoH(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh status: %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 0xffff))
+}
+
+// closeIdle закрывает простаивающие соединения апстрима.
+func (u *dnsUpstream) closeIdle() {
+	u.poolMu.Lock()
+	for _, ic := range u.idle {
+		ic.conn.Close()
+	}
+	u.idle = nil
+	client := u.client
+	u.poolMu.Unlock()
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+}
+
+func forwardDNSviaUDP(ctx context.Context, query []byte, server string) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if dnsReplyMatches(query, buf[:n]) {
+			return buf[:n], nil
+		}
+		// Чужой или поддельный ответ: ждём настоящий до дедлайна.
+		dnsLog.Debug("Dropped mismatched DNS reply", "server", server)
+	}
+}
+
+// readDNSStreamReply читает сообщения из TCP/TLS потока, пока не придёт
+// ответ на query; остальные отбрасывает.
+func readDNSStreamReply(c net.Conn, query []byte) ([]byte, error) {
+	for {
+		resp, err := readDNSTCP(c)
+		if err != nil || dnsReplyMatches(query, resp) {
+			return resp, err
+		}
+		dnsLog.Debug("Dropped mismatched DNS reply", "server", c.RemoteAddr().String())
+	}
+}
+
+// dnsReplyMatches проверяет, что resp — ответ на query: тот же ID и тот же
+// вопрос (RFC 5452 4.3). Регистр имени не сравниваем: не все серверы
+// сохраняют 0x20.
+func dnsReplyMatches(query, resp []byte) bool {
+	var qp, rp dnsmessage.Parser
+	qh, err := qp.Start(query)
+	if err != nil {
+		return false
+	}
+	rh, err := rp.Start(resp)
+	if err != nil || !rh.Response || rh.ID != qh.ID {
+		return false
+	}
+	qq, qerr := qp.Question()
+	rq, rerr := rp.Question()
+	if qerr != nil || rerr != nil {
+		return qerr != nil && rerr != nil
+	}
+	return qq.Type == rq.Type && qq.Class == rq.Class && strings.EqualFold(qq.Name.String(), rq.Name.String())
+}
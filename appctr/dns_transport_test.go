@@ -0,0 +1,348 @@
+package appctr
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/socks5"
+)
+
+// standInDoH — локальный DoH сервер с HTTP/2 и сертификатом httptest
+// (example.com, 127.0.0.1). Возвращает сервер и пул для проверки сертификата;
+// в conns, если он задан, считаются TCP соединения.
+func standInDoH(t *testing.T, h http.HandlerFunc, conns *atomic.Int32) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(h)
+	srv.EnableHTTP2 = true
+	if conns != nil {
+		srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+			if s == http.StateNew {
+				conns.Add(1)
+			}
+		}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return srv, pool
+}
+
+func trustUpstreams(p *dnsUpstreams, pool *x509.CertPool) {
+	for _, u := range p.list {
+		u.tlsConfig.RootCAs = pool
+	}
+}
+
+// standInDoT — локальный DNS over TLS сервер, отвечающий 192.0.2.4. При
+// oneShot закрывает соединение после первого ответа. Считает соединения.
+func standInDoT(t *testing.T, oneShot bool) (string, *x509.CertPool, *atomic.Int32) {
+	t.Helper()
+	https, pool := standInDoH(t, nil, nil)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: https.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var conns atomic.Int32
+	handle := func(q []byte, _ net.Addr) []byte { return answerWithIP(q, 4) }
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			if !oneShot {
+				go handleDNSTCPConn(context.Background(), c, handle)
+				continue
+			}
+			go func() {
+				defer c.Close()
+				if q, err := readDNSTCP(c); err == nil {
+					writeDNSTCP(c, handle(q, c.RemoteAddr()))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), pool, &conns
+}
+
+func TestParseDNSUpstream(t *testing.T) {
+	tests := []struct {
+		in, proto, host, url, sni string
+		bootstrap                 int
+	}{
+		{in: "8.8.8.8:53", proto: dnsProtoUDP, host: "8.8.8.8:53"},
+		{in: " 1.1.1.1 ", proto: dnsProtoUDP, host: "1.1.1.1:53"},
+		{in: "2606:4700:4700::1111", proto: dnsProtoUDP, host: "[2606:4700:4700::1111]:53"},
+		{in: "udp://9.9.9.9:5353", proto: dnsProtoUDP, host: "9.9.9.9:5353"},
+		{in: "tcp://8.8.4.4", proto: dnsProtoTCP, host: "8.8.4.4:53"},
+		{in: "tls://dns.google", proto: dnsProtoTLS, host: "dns.google:853", sni: "dns.google"},
+		{in: "tls://one.one.one.one:8853#1.1.1.1,1.0.0.1", proto: dnsProtoTLS, host: "one.one.one.one:8853", sni: "one.one.one.one", bootstrap: 2},
+		{in: "https://dns.google/dns-query", proto: dnsProtoHTTPS, host: "dns.google:443", url: "https://dns.google/dns-query"},
+		{in: "https://dns.quad9.net/dns-query#9.9.9.9", proto: dnsProtoHTTPS, host: "dns.quad9.net:443", url: "https://dns.quad9.net/dns-query", bootstrap: 1},
+	}
+	for _, tt := range tests {
+		u, err := parseDNSUpstream(tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if u.proto != tt.proto || u.host != tt.host || u.url != tt.url || u.tlsConfig.ServerName != tt.sni || len(u.bootstrap) != tt.bootstrap {
+			t.Errorf("%q = proto %s host %s url %s sni %s bootstrap %v", tt.in, u.proto, u.host, u.url, u.tlsConfig.ServerName, u.bootstrap)
+		}
+	}
+	for _, bad := range []string{"", "quic://dns.adguard.com", "tls://", "tls://dns.google#not-an-ip", "http://[::1"} {
+		if _, err := parseDNSUpstream(bad); err == nil {
+			t.Errorf("%q parsed without error", bad)
+		}
+	}
+
+	p := newDNSUpstreams([]string{"8.8.8.8", "quic://bad"}, "https://1.1.1.1/dns-query", "")
+	if len(p.list) != 2 || p.list[1].proto != dnsProtoHTTPS {
+		t.Errorf("newDNSUpstreams kept %d upstreams", len(p.list))
+	}
+}
+
+func TestUpstreamDoTReusesConnection(t *testing.T) {
+	addr, pool, conns := standInDoT(t, false)
+	p := newDNSUpstreams([]string{"tls://" + addr}, "none", "")
+	trustUpstreams(p, pool)
+	defer p.close()
+	for i := range 3 {
+		resp, err := p.exchange(buildQuery(t, uint16(i), "example.com.", dnsmessage.TypeA, 0))
+		if err != nil || answerIP(t, resp) != 4 {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+}
+
+func TestUpstreamDoTRedialsClosedConnection(t *testing.T) {
+	addr, pool, conns := standInDoT(t, true)
+	p := newDNSUpstreams([]string{"tls://" + addr}, "none", "")
+	trustUpstreams(p, pool)
+	defer p.close()
+	for i := range 3 {
+		resp, err := p.exchange(buildQuery(t, uint16(i), "example.com.", dnsmessage.TypeA, 0))
+		if err != nil || answerIP(t, resp) != 4 {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if n := conns.Load(); n != 3 {
+		t.Errorf("connections = %d, want 3", n)
+	}
+	if st := p.stats()[0]; st.Failures != 0 {
+		t.Errorf("closed idle connection counted as failure: %+v", st)
+	}
+}
+
+func TestUpstreamDoTRejectsUntrustedCert(t *testing.T) {
+	addr, _, _ := standInDoT(t, false)
+	p := newDNSUpstreams([]string{"tls://" + addr}, "none", "")
+	if _, err := p.exchange(buildQuery(t, 1, "example.com.", dnsmessage.TypeA, 0)); err == nil {
+		t.Fatal("self-signed DoT server accepted")
+	}
+}
+
+func TestUpstreamDoHPostHTTP2Bootstrap(t *testing.T) {
+	var conns atomic.Int32
+	srv, pool := standInDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Method != "POST" || r.Header.Get("Accept") != "application/dns-message" {
+			http.Error(w, r.Proto+" "+r.Method, http.StatusBadRequest)
+			return
+		}
+		q, _ := io.ReadAll(r.Body)
+		w.Write(answerWithIP(q, 5))
+	}, &conns)
+	// Имя из сертификата httptest; резолвится только через bootstrap.
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	url := "https://example.com:" + port + "/dns-query#127.0.0.1"
+	p := newDNSUpstreams(nil, url, "")
+	trustUpstreams(p, pool)
+	defer p.close()
+	for i := range 3 {
+		resp, err := p.exchange(buildQuery(t, uint16(i), "example.com.", dnsmessage.TypeA, 0))
+		if err != nil || answerIP(t, resp) != 5 {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+	if st := p.stats()[0]; !strings.HasPrefix(st.Addr, "https://example.com:") {
+		t.Errorf("stats addr = %s", st.Addr)
+	}
+}
+
+func TestUpstreamTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveDNSTCP(ctx, ln, func(q []byte, _ net.Addr) []byte { return answerWithIP(q, 6) })
+	p := newDNSUpstreams([]string{"tcp://" + ln.Addr().String()}, "none", "")
+	defer p.close()
+	resp, err := p.exchange(buildQuery(t, 1, "example.com.", dnsmessage.TypeA, 0))
+	if err != nil || answerIP(t, resp) != 6 {
+		t.Fatalf("tcp upstream: %v", err)
+	}
+}
+
+// recordingSOCKS5 — SOCKS5 сервер, пересылающий напрямую и записывающий адреса.
+func recordingSOCKS5(t *testing.T) (string, chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	seen := make(chan string, 16)
+	ss := &socks5.Server{Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		seen <- addr
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}}
+	go ss.Serve(ln)
+	return ln.Addr().String(), seen
+}
+
+func TestUpstreamsViaExitNode(t *testing.T) {
+	socksAddr, seen := recordingSOCKS5(t)
+	plain := fakeUpstream(t, 1)
+	srv, pool := standInDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		q, _ := io.ReadAll(r.Body)
+		w.Write(answerWithIP(q, 7))
+	}, nil)
+
+	var exit atomic.Bool
+	route := func(p *dnsUpstreams) *dnsUpstreams {
+		p.exitSocks, p.exitActive = socksAddr, exit.Load
+		trustUpstreams(p, pool)
+		t.Cleanup(p.close)
+		return p
+	}
+	p := route(newDNSUpstreams([]string{plain}, "none", ""))
+	dohOnly := route(newDNSUpstreams(nil, srv.URL, ""))
+	q := buildQuery(t, 1, "example.com.", dnsmessage.TypeA, 0)
+
+	query := func(p *dnsUpstreams) {
+		t.Helper()
+		if _, err := p.exchange(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	noDials := func() {
+		t.Helper()
+		select {
+		case addr := <-seen:
+			t.Fatalf("SOCKS5 dial to %s without exit node", addr)
+		default:
+		}
+	}
+
+	query(p)
+	query(dohOnly)
+	noDials()
+
+	// С exit node UDP апстрим спрашивается по TCP через SOCKS5, DoH — тоже.
+	exit.Store(true)
+	query(p)
+	if addr := <-seen; addr != plain {
+		t.Errorf("SOCKS5 dial to %s, want %s", addr, plain)
+	}
+	query(dohOnly)
+	if addr := <-seen; addr != srv.Listener.Addr().String() {
+		t.Errorf("DoH SOCKS5 dial to %s", addr)
+	}
+
+	exit.Store(false)
+	query(p)
+	query(dohOnly)
+	noDials()
+}
+
+// spoofedReplies — ответы на q, которые клиент должен отбросить, и
+// последним настоящий.
+func spoofedReplies(t *testing.T, q []byte) [][]byte {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	wrongID := m
+	wrongID.ID++
+	wrongName := m
+	wrongName.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName("evil.example."), Type: m.Questions[0].Type, Class: m.Questions[0].Class}}
+	var out [][]byte
+	for _, mm := range []dnsmessage.Message{wrongID, wrongName} {
+		b, _ := mm.Pack()
+		out = append(out, answerWithIP(b, 66))
+	}
+	out = append(out, q) // сам запрос: не ответ
+	return append(out, answerWithIP(q, 7))
+}
+
+func TestUpstreamDropsMismatchedReplies(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		for _, r := range spoofedReplies(t, buf[:n]) {
+			pc.WriteTo(r, addr)
+		}
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		q, err := readDNSTCP(c)
+		if err != nil {
+			return
+		}
+		for _, r := range spoofedReplies(t, q) {
+			writeDNSTCP(c, r)
+		}
+		io.Copy(io.Discard, c)
+	}()
+
+	for _, addr := range []string{pc.LocalAddr().String(), "tcp://" + ln.Addr().String()} {
+		p := newDNSUpstreams([]string{addr}, "none", "")
+		resp, err := p.exchange(buildQuery(t, 1, "Example.COM.", dnsmessage.TypeA, 0))
+		p.close()
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if answerIP(t, resp) != 7 {
+			t.Errorf("%s: accepted a mismatched reply", addr)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package appctr
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Стратегии выбора апстрима для fallback DNS (StartOptions.DnsStrategy).
+const (
+	DNSStrategySequential = "sequential" // по порядку, как в DnsFallbacks
+	DNSStrategyParallel   = "parallel"   // всем сразу, берём первый ответ
+	DNSStrategyRoundRobin = "roundrobin" // каждый запрос начинает со следующего
+	DNSStrategyFastest    = "fastest"    // сначала самый быстрый по замерам
+)
+
+const (
+	dnsUpstreamUDPTimeout = 3 * time.Second
+	// Для TLS и HTTPS: нужен запас на рукопожатие.
+	dnsUpstreamDoHTimeout = 5 * time.Second
+	// После стольких ошибок подряд апстрим уходит в карантин.
+	dnsQuarantineAfter = 3
+	dnsQuarantineMin   = 30 * time.Second
+	dnsQuarantineMax   = 5 * time.Minute
+	// Вес нового замера в скользящих средних score и rtt.
+	dnsHealthAlpha = 0.2
+)
+
+// dnsUpstream — один fallback резолвер со статистикой здоровья.
+type dnsUpstream struct {
+	addr      string // как задан в настройках
+	proto     string // dnsProtoUDP, dnsProtoTCP, dnsProtoTLS или dnsProtoHTTPS
+	host      string // host:port сервера
+	url       string // для DoH
+	bootstrap []netip.Addr
+	tlsConfig *tls.Config
+
+	poolMu     sync.Mutex
+	dial       dialContextFunc
+	viaSOCKS   bool          // UDP через SOCKS5 не ходит — тогда запрос идёт по TCP
+	idle       []idleDNSConn // TCP/TLS соединения для повторного использования
+	clientOnce sync.Once
+	client     *http.Client // DoH
+
+	mu               sync.Mutex
+	score            float64       // доля успешных ответов (EWMA), 1 — здоров
+	rtt              time.Duration // EWMA задержки успешных ответов, 0 — ещё не мерили
+	failStreak       int
+	quarantines      int // карантинов подряд: каждый следующий вдвое длиннее
+	quarantinedUntil time.Time
+	queries          int64
+	failures         int64
+}
+
+func (u *dnsUpstream) timeout() time.Duration {
+	if u.proto == dnsProtoTLS || u.proto == dnsProtoHTTPS {
+		return dnsUpstreamDoHTimeout
+	}
+	return dnsUpstreamUDPTimeout
+}
+
+// report учитывает результат запроса в score, rtt и карантине.
+func (u *dnsUpstream) report(now time.Time, rtt time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queries++
+	if err == nil {
+		u.score += dnsHealthAlpha * (1 - u.score)
+		if u.rtt == 0 {
+			u.rtt = rtt
+		} else {
+			u.rtt += time.Duration(dnsHealthAlpha * float64(rtt-u.rtt))
+		}
+		u.failStreak, u.quarantines = 0, 0
+		u.quarantinedUntil = time.Time{}
+		return
+	}
+	u.failures++
+	u.score -= dnsHealthAlpha * u.score
+	u.failStreak++
+	if u.failStreak >= dnsQuarantineAfter {
+		d := min(dnsQuarantineMin<<u.quarantines, dnsQuarantineMax)
+		u.quarantines++
+		u.quarantinedUntil = now.Add(d)
+		dnsLog.Warn("DNS upstream quarantined", "upstream", u.addr, "for", d, "fails", u.failStreak)
+	}
+}
+
+func (u *dnsUpstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.quarantinedUntil)
+}
+
+// cost — чем меньше, тем раньше апстрим пробуется в DNSStrategyFastest.
+// Ещё не замеренные идут первыми, чтобы получить замер.
+func (u *dnsUpstream) cost() float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.rtt == 0 {
+		return 0
+	}
+	return float64(u.rtt) / max(u.score, 0.05)
+}
+
+type dnsUpstreamStats struct {
+	Addr             string
+	Proto            string
+	Score            float64
+	RTTMs            int64
+	Queries          int64
+	Failures         int64
+	QuarantinedUntil time.Time `json:",omitzero"`
+}
+
+func (u *dnsUpstream) stats() dnsUpstreamStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return dnsUpstreamStats{
+		Addr: u.addr, Proto: u.proto, Score: u.score, RTTMs: u.rtt.Milliseconds(),
+		Queries: u.queries, Failures: u.failures, QuarantinedUntil: u.quarantinedUntil,
+	}
+}
+
+// dnsUpstreams — набор fallback резолверов и стратегия обхода.
+type dnsUpstreams struct {
+	strategy string
+	list     []*dnsUpstream
+	next     atomic.Uint32 // начало для round-robin
+	now      func() time.Time
+
+	// exitSocks — адрес SOCKS5 демона, если fallback запросы должны идти
+	// через exit node, пока он выбран; пусто — всегда напрямую.
+	exitSocks  string
+	exitActive func() bool
+	viaExit    atomic.Bool
+
+	// dnssec проверяет ответы fallback апстримов; nil — без валидации.
+	dnssec *dnssecValidator
+}
+
+// newDNSUpstreams собирает апстримы из DnsFallbacks и DohFallback ("none" —
+// без DoH). DoH идёт последним, как и раньше. Записи с ошибкой пропускаются.
+func newDNSUpstreams(fallbacks []string, dohUrl, strategy string) *dnsUpstreams {
+	switch strategy {
+	case DNSStrategySequential, DNSStrategyParallel, DNSStrategyRoundRobin, DNSStrategyFastest:
+	case "":
+		strategy = DNSStrategySequential
+	default:
+		dnsLog.Warn("Unknown DNS strategy, using sequential", "strategy", strategy)
+		strategy = DNSStrategySequential
+	}
+	p := &dnsUpstreams{strategy: strategy, now: time.Now, exitActive: exitNodeActive}
+	if dohUrl != "" && dohUrl != "none" {
+		fallbacks = append(slices.Clip(fallbacks), dohUrl)
+	}
+	for _, f := range fallbacks {
+		u, err := parseDNSUpstream(f)
+		if err != nil {
+			dnsLog.Warn("Skipping DNS upstream", "err", err)
+			continue
+		}
+		p.list = append(p.list, u)
+	}
+	return p
+}
+
+// order возвращает апстримы в порядке опроса по стратегии. Апстримы в
+// карантине пропускаются, пока есть хоть один здоровый.
+func (p *dnsUpstreams) order() []*dnsUpstream {
+	now := p.now()
+	var ok, quarantined []*dnsUpstream
+	for _, u := range p.list {
+		if u.available(now) {
+			ok = append(ok, u)
+		} else {
+			quarantined = append(quarantined, u)
+		}
+	}
+	if len(ok) == 0 {
+		return quarantined
+	}
+	switch p.strategy {
+	case DNSStrategyRoundRobin:
+		i := int(p.next.Add(1)-1) % len(ok)
+		ok = slices.Concat(ok[i:], ok[:i])
+	case DNSStrategyFastest:
+		slices.SortStableFunc(ok, func(a, b *dnsUpstream) int {
+			ca, cb := a.cost(), b.cost()
+			switch {
+			case ca < cb:
+				return -1
+			case ca > cb:
+				return 1
+			}
+			return 0
+		})
+	}
+	return ok
+}
+
+func (p *dnsUpstreams) try(ctx context.Context, u *dnsUpstream, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout())
+	defer cancel()
+	start := p.now()
+	resp, err := u.exchange(ctx, query)
+	if err != nil && ctx.Err() == context.Canceled {
+		// Отменили снаружи (проиграл гонку в parallel) — не ошибка апстрима.
+		return nil, err
+	}
+	now := p.now()
+	u.report(now, now.Sub(start), err)
+	if err != nil {
+		dnsLog.Debug("Fallback DNS failed", "upstream", u.addr, "err", err)
+	}
+	return resp, err
+}
+
+// updateRoute переключает апстримы на SOCKS5 демона, когда выбран exit node,
+// и обратно. Старые соединения закрываются, чтобы не ходить мимо exit node.
+func (p *dnsUpstreams) updateRoute() {
+	if p.exitSocks == "" {
+		return
+	}
+	via := p.exitActive()
+	if p.viaExit.Swap(via) == via {
+		return
+	}
+	var d net.Dialer
+	dial := dialContextFunc(d.DialContext)
+	if via {
+		sd, err := socks5Dialer(p.exitSocks)
+		if err != nil {
+			dnsLog.Error("SOCKS5 dialer for DNS fallbacks failed", "err", err)
+			p.viaExit.Store(false)
+			return
+		}
+		dial = sd.(proxy.ContextDialer).DialContext
+		dnsLog.Info("Exit node selected, DNS fallbacks go through SOCKS5", "socks5", socks5Host(p.exitSocks))
+	} else {
+		dnsLog.Info("Exit node cleared, DNS fallbacks go direct")
+	}
+	for _, u := range p.list {
+		u.setDialer(dial, via)
+	}
+}
+
+// exchange отправляет запрос апстримам по стратегии и возвращает первый ответ.
+func (p *dnsUpstreams) exchange(query []byte) ([]byte, error) {
+	resp, _, err := p.exchangeFrom(query)
+	return resp, err
+}
+
+// exchangeFrom — как exchange, но сообщает, какой апстрим ответил.
+func (p *dnsUpstreams) exchangeFrom(query []byte) ([]byte, *dnsUpstream, error) {
+	p.updateRoute()
+	order := p.order()
+	if len(order) == 0 {
+		return nil, nil, errors.New("no dns upstreams")
+	}
+	if p.strategy != DNSStrategyParallel || len(order) == 1 {
+		var errs []error
+		for _, u := range order {
+			resp, err := p.try(context.Background(), u, query)
+			if err == nil {
+				return resp, u, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", u.addr, err))
+		}
+		return nil, nil, errors.Join(errs...)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		resp []byte
+		from *dnsUpstream
+		err  error
+	}
+	results := make(chan result, len(order))
+	for _, u := range order {
+		go func() {
+			resp, err := p.try(ctx, u, query)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", u.addr, err)
+			}
+			results <- result{resp, u, err}
+		}()
+	}
+	var errs []error
+	for range order {
+		r := <-results
+		if r.err == nil {
+			return r.resp, r.from, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// close закрывает соединения, которые апстримы держат открытыми.
+func (p *dnsUpstreams) close() {
+	for _, u := range p.list {
+		u.closeIdle()
+	}
+}
+
+func (p *dnsUpstreams) stats() []dnsUpstreamStats {
+	out := make([]dnsUpstreamStats, 0, len(p.list))
+	for _, u := range p.list {
+		out = append(out, u.stats())
+	}
+	return out
+}
+
+// activeUpstreams — апстримы запущенного DNS прокси, для статистики.
+var activeUpstreams atomic.Pointer[dnsUpstreams]
+
+// GetDNSUpstreamStats возвращает JSON-массив со здоровьем fallback резолверов
+// запущенного DNS прокси: score, средняя задержка, ошибки, конец карантина.
+func GetDNSUpstreamStats() string {
+	p := activeUpstreams.Load()
+	if p == nil {
+		return "[]"
+	}
+	data, _ := json.Marshal(p.stats())
+	return string(data)
+}
@@ -0,0 +1,242 @@
+package appctr
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testUpstreams(addrs ...string) *dnsUpstreams {
+	return newDNSUpstreams(addrs, "none", DNSStrategySequential)
+}
+
+// answerWithIP отвечает на запрос одной записью A с адресом 192.0.2.id.
+func answerWithIP(query []byte, id byte) []byte {
+	var m dnsmessage.Message
+	if m.Unpack(query) != nil || len(m.Questions) == 0 {
+		return nil
+	}
+	return dnsReply(&m, dnsmessage.RCodeSuccess, []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: m.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, id}},
+	}})
+}
+
+// standInUDP — локальный UDP резолвер, отвечающий 192.0.2.id через delay.
+func standInUDP(t *testing.T, id byte, delay time.Duration) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var hits atomic.Int32
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			hits.Add(1)
+			q := append([]byte(nil), buf[:n]...)
+			go func() {
+				time.Sleep(delay)
+				pc.WriteTo(answerWithIP(q, id), addr)
+			}()
+		}
+	}()
+	return pc.LocalAddr().String(), &hits
+}
+
+// deadUDP — адрес, на котором никто не слушает: ошибка приходит сразу (ICMP).
+func deadUDP(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+func answerIP(t *testing.T, resp []byte) byte {
+	t.Helper()
+	m := parseMsg(t, resp)
+	if len(m.Answers) != 1 {
+		t.Fatalf("answers = %d", len(m.Answers))
+	}
+	return m.Answers[0].Body.(*dnsmessage.AResource).A[3]
+}
+
+func upstreamStats(p *dnsUpstreams, addr string) dnsUpstreamStats {
+	for _, s := range p.stats() {
+		if s.Addr == addr {
+			return s
+		}
+	}
+	return dnsUpstreamStats{}
+}
+
+func TestUpstreamsSequentialQuarantine(t *testing.T) {
+	dead := deadUDP(t)
+	live, _ := standInUDP(t, 2, 0)
+	p := newDNSUpstreams([]string{dead, live}, "none", DNSStrategySequential)
+	clock := time.Now()
+	p.now = func() time.Time { return clock }
+	q := buildQuery(t, 1, "example.com.", dnsmessage.TypeA, 0)
+
+	for i := range dnsQuarantineAfter + 2 {
+		resp, err := p.exchange(q)
+		if err != nil || answerIP(t, resp) != 2 {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	st := upstreamStats(p, dead)
+	if st.Queries != dnsQuarantineAfter || st.QuarantinedUntil.IsZero() {
+		t.Fatalf("dead upstream not quarantined after %d failures: %+v", dnsQuarantineAfter, st)
+	}
+	if st.Score >= 1 || upstreamStats(p, live).Score != 1 {
+		t.Errorf("scores: dead %v, live %v", st.Score, upstreamStats(p, live).Score)
+	}
+
+	// После карантина апстрим пробуется снова, а повторный карантин вдвое длиннее.
+	clock = clock.Add(dnsQuarantineMin)
+	if _, err := p.exchange(q); err != nil {
+		t.Fatal(err)
+	}
+	st = upstreamStats(p, dead)
+	if st.Queries != dnsQuarantineAfter+1 || st.QuarantinedUntil.Sub(clock) != 2*dnsQuarantineMin {
+		t.Errorf("after quarantine: %+v", st)
+	}
+}
+
+func TestUpstreamsAllQuarantinedStillTried(t *testing.T) {
+	dead := deadUDP(t)
+	p := newDNSUpstreams([]string{dead}, "none", DNSStrategySequential)
+	q := buildQuery(t, 1, "example.com.", dnsmessage.TypeA, 0)
+	for range dnsQuarantineAfter + 1 {
+		if _, err := p.exchange(q); err == nil {
+			t.Fatal("dead upstream answered")
+		}
+	}
+	if st := upstreamStats(p, dead); st.Queries != dnsQuarantineAfter+1 {
+		t.Errorf("queries = %d", st.Queries)
+	}
+}
+
+func TestUpstreamsParallel(t *testing.T) {
+	slow, _ := standInUDP(t, 1, 500*time.Millisecond)
+	fast, fastHits := standInUDP(t, 2, 0)
+	p := newDNSUpstreams([]string{slow, fast}, "none", DNSStrategyParallel)
+	start := time.Now()
+	resp, err := p.exchange(buildQuery(t, 1, "example.com.", dnsmessage.TypeA, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answerIP(t, resp) != 2 || time.Since(start) > 400*time.Millisecond {
+		t.Errorf("parallel answer from %d after %v", answerIP(t, resp), time.Since(start))
+	}
+	if fastHits.Load() != 1 {
+		t.Errorf("fast hits = %d", fastHits.Load())
+	}
+	// Проигравший гонку отменяется и не записывается в ошибки.
+	time.Sleep(100 * time.Millisecond)
+	if st := upstreamStats(p, slow); st.Failures != 0 || st.Queries != 0 {
+		t.Errorf("slow upstream stats = %+v", st)
+	}
+}
+
+func TestUpstreamsRoundRobin(t *testing.T) {
+	a, aHits := standInUDP(t, 1, 0)
+	b, bHits := standInUDP(t, 2, 0)
+	p := newDNSUpstreams([]string{a, b}, "none", DNSStrategyRoundRobin)
+	q := buildQuery(t, 1, "example.com.", dnsmessage.TypeA, 0)
+	var got []byte
+	for range 4 {
+		resp, err := p.exchange(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, answerIP(t, resp))
+	}
+	if string(got) != string([]byte{1, 2, 1, 2}) || aHits.Load() != 2 || bHits.Load() != 2 {
+		t.Errorf("answers %v, hits %d/%d", got, aHits.Load(), bHits.Load())
+	}
+}
+
+func TestUpstreamsFastest(t *testing.T) {
+	slow, _ := standInUDP(t, 1, 50*time.Millisecond)
+	fast, _ := standInUDP(t, 2, 0)
+	p := newDNSUpstreams([]string{slow, fast}, "none", DNSStrategyFastest)
+	q := buildQuery(t, 1, "example.com.", dnsmessage.TypeA, 0)
+	var got []byte
+	for range 5 {
+		resp, err := p.exchange(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, answerIP(t, resp))
+	}
+	// Оба незамеренных пробуются по разу, дальше — только быстрый.
+	if string(got) != string([]byte{1, 2, 2, 2, 2}) {
+		t.Errorf("answers = %v", got)
+	}
+}
+
+func TestUpstreamsDoH(t *testing.T) {
+	var fail atomic.Bool
+	srv, pool := standInDoH(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		q, err := io.ReadAll(r.Body)
+		if err != nil || r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerWithIP(q, 3))
+	}, nil)
+
+	dead := deadUDP(t)
+	p := newDNSUpstreams([]string{dead}, srv.URL, DNSStrategySequential)
+	trustUpstreams(p, pool)
+	q := buildQuery(t, 1, "example.com.", dnsmessage.TypeA, 0)
+	resp, err := p.exchange(q)
+	if err != nil || answerIP(t, resp) != 3 {
+		t.Fatalf("doh fallback: %v", err)
+	}
+
+	fail.Store(true)
+	if _, err := p.exchange(q); err == nil {
+		t.Fatal("expected error from failing DoH")
+	}
+	if st := upstreamStats(p, srv.URL); st.Proto != dnsProtoHTTPS || st.Queries != 2 || st.Failures != 1 {
+		t.Errorf("doh stats = %+v", st)
+	}
+}
+
+func TestGetDNSUpstreamStats(t *testing.T) {
+	old := activeUpstreams.Load()
+	t.Cleanup(func() { activeUpstreams.Store(old) })
+	activeUpstreams.Store(nil)
+	if got := GetDNSUpstreamStats(); got != "[]" {
+		t.Errorf("no proxy: %s", got)
+	}
+	activeUpstreams.Store(newDNSUpstreams([]string{"192.0.2.1:53"}, "https://dns.example/dns-query", ""))
+	got := GetDNSUpstreamStats()
+	for _, want := range []string{`"Addr":"192.0.2.1:53"`, `"Proto":"https"`, `"Score":1`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("stats %s missing %s", got, want)
+		}
+	}
+}
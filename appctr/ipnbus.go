@@ -0,0 +1,274 @@
+package appctr
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BusListener получает события IPN bus: kind — "netmap", "peer", "prefs"
+// или "browse", payload — JSON (для "browse" — сам URL). Вызывается по
+// порядку из отдельной горутины, не из той, что читает IPN bus.
+type BusListener interface {
+	OnBusEvent(kind string, payload string)
+}
+
+// busPeer — нода в том виде, в котором её видит UI.
+type busPeer struct {
+	ID        string
+	Name      string
+	HostName  string
+	OS        string
+	Addresses []string
+	Online    bool
+	Removed   bool `json:",omitempty"`
+}
+
+type busNetMap struct {
+	Self   *busPeer
+	Peers  []busPeer
+	Domain string
+}
+
+var busMu sync.Mutex
+var busListener BusListener
+var busLastNetMap *localNetMap
+var busPeers map[string]busPeer
+var busLoginURL string
+var busExitNode bool
+
+func SetBusListener(l BusListener) {
+	busMu.Lock()
+	defer busMu.Unlock()
+	busListener = l
+}
+
+// GetNetMapJSON возвращает последний netmap из IPN bus (self, peers) без опроса CLI.
+func GetNetMapJSON() string {
+	busMu.Lock()
+	nm := busLastNetMap
+	busMu.Unlock()
+	if nm == nil {
+		return ""
+	}
+	data, _ := json.Marshal(summarizeNetMap(nm))
+	return string(data)
+}
+
+func currentNetMap() *localNetMap {
+	busMu.Lock()
+	defer busMu.Unlock()
+	return busLastNetMap
+}
+
+func resetBus() {
+	busMu.Lock()
+	defer busMu.Unlock()
+	busLastNetMap = nil
+	busPeers = nil
+	busLoginURL = ""
+	busExitNode = false
+	setSplitDNSConfig(nil)
+}
+
+// exitNodeActive сообщает, выбран ли exit node по последним prefs из IPN bus.
+func exitNodeActive() bool {
+	busMu.Lock()
+	defer busMu.Unlock()
+	return busExitNode
+}
+
+// watchIPNBus держит подписку на watch-ipn-bus, пока жив ctx, и переподключается,
+// если демон перезапустился или сокет ещё не появился.
+func watchIPNBus(ctx context.Context, lc *localClient) {
+	for ctx.Err() == nil {
+		err := runIPNBus(ctx, lc)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Debug("IPN bus watch ended, reconnecting", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+func runIPNBus(ctx context.Context, lc *localClient) error {
+	w, err := lc.WatchIPNBus(ctx, notifyInitialState|notifyInitialPrefs|notifyInitialNetMap|notifyRateLimit)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return err
+		}
+		handleNotify(n)
+	}
+}
+
+type busEvent struct {
+	kind    string
+	payload string
+}
+
+// Очередь событий для BusListener, как и для StateListener: IPN bus никогда
+// не ждёт Kotlin, а если листенер завис и очередь полна, старые события
+// выбрасываются.
+const maxPendingBusEvents = 256
+
+var pendingBusMu sync.Mutex
+var pendingBusEvents []busEvent
+var busWake = make(chan struct{}, 1)
+var busDispatchOnce sync.Once
+
+// sendBusEvents ставит события в очередь, если листенер задан.
+func sendBusEvents(events ...busEvent) {
+	busMu.Lock()
+	l := busListener
+	busMu.Unlock()
+	if l == nil || len(events) == 0 {
+		return
+	}
+	busDispatchOnce.Do(func() { go dispatchBusEvents() })
+	pendingBusMu.Lock()
+	for _, ev := range events {
+		if len(pendingBusEvents) == maxPendingBusEvents {
+			slog.Warn("Bus listener is not keeping up, dropping old event", "kind", pendingBusEvents[0].kind)
+			pendingBusEvents = pendingBusEvents[1:]
+		}
+		pendingBusEvents = append(pendingBusEvents, ev)
+	}
+	pendingBusMu.Unlock()
+	select {
+	case busWake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchBusEvents вызывает листенер из одной горутины, чтобы сохранить
+// порядок и не держать локи во время вызова в Kotlin.
+func dispatchBusEvents() {
+	for range busWake {
+		for {
+			pendingBusMu.Lock()
+			if len(pendingBusEvents) == 0 {
+				pendingBusMu.Unlock()
+				break
+			}
+			ev := pendingBusEvents[0]
+			pendingBusEvents = pendingBusEvents[1:]
+			pendingBusMu.Unlock()
+
+			busMu.Lock()
+			l := busListener
+			busMu.Unlock()
+			if l != nil {
+				l.OnBusEvent(ev.kind, ev.payload)
+			}
+		}
+	}
+}
+
+func handleNotify(n *localNotify) {
+	if n.State != nil {
+		st, reason := backendStateFromIPN(*n.State)
+		if st == StateRunning {
+			setLoginURL("")
+		}
+		setBackendState(st, reason)
+	}
+	if n.BrowseToURL != nil {
+		setLoginURL(*n.BrowseToURL)
+	}
+
+	var events []busEvent
+	busMu.Lock()
+	if n.Prefs != nil {
+		busExitNode = n.Prefs.ExitNodeID != "" || n.Prefs.ExitNodeIP.IsValid()
+		data, _ := json.Marshal(n.Prefs)
+		events = append(events, busEvent{"prefs", string(data)})
+	}
+	if n.NetMap != nil {
+		busLastNetMap = n.NetMap
+		setSplitDNSConfig(&n.NetMap.DNS)
+		sum := summarizeNetMap(n.NetMap)
+		for _, p := range diffPeers(busPeers, sum.Peers) {
+			data, _ := json.Marshal(p)
+			events = append(events, busEvent{"peer", string(data)})
+		}
+		busPeers = make(map[string]busPeer, len(sum.Peers))
+		for _, p := range sum.Peers {
+			busPeers[p.ID] = p
+		}
+		data, _ := json.Marshal(sum)
+		events = append(events, busEvent{"netmap", string(data)})
+	}
+	busMu.Unlock()
+	sendBusEvents(events...)
+}
+
+func toBusPeer(n *localNode) busPeer {
+	p := busPeer{
+		ID:       n.StableID,
+		Name:     strings.TrimSuffix(n.Name, "."),
+		HostName: n.Hostinfo.Hostname,
+		OS:       n.Hostinfo.OS,
+		Online:   n.Online != nil && *n.Online,
+	}
+	for _, a := range n.Addresses {
+		p.Addresses = append(p.Addresses, a.Addr().String())
+	}
+	return p
+}
+
+func summarizeNetMap(nm *localNetMap) busNetMap {
+	sum := busNetMap{Domain: nm.Domain, Peers: make([]busPeer, 0, len(nm.Peers))}
+	if nm.SelfNode != nil {
+		self := toBusPeer(nm.SelfNode)
+		sum.Self = &self
+	}
+	for _, n := range nm.Peers {
+		if n != nil {
+			sum.Peers = append(sum.Peers, toBusPeer(n))
+		}
+	}
+	return sum
+}
+
+// diffPeers возвращает ноды, которые появились, пропали (Removed)
+// или сменили онлайн-статус относительно прошлого netmap.
+func diffPeers(old map[string]busPeer, cur []busPeer) []busPeer {
+	if old == nil {
+		return nil // первый netmap — это снимок, а не дельта
+	}
+	var changed []busPeer
+	seen := make(map[string]bool, len(cur))
+	for _, p := range cur {
+		seen[p.ID] = true
+		if prev, ok := old[p.ID]; !ok || prev.Online != p.Online {
+			changed = append(changed, p)
+		}
+	}
+	var gone []string
+	for id := range old {
+		if !seen[id] {
+			gone = append(gone, id)
+		}
+	}
+	sort.Strings(gone)
+	for _, id := range gone {
+		p := old[id]
+		p.Online = false
+		p.Removed = true
+		changed = append(changed, p)
+	}
+	return changed
+}
@@ -0,0 +1,193 @@
+package appctr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingBus struct {
+	mu     sync.Mutex
+	events [][2]string
+}
+
+func (b *recordingBus) OnBusEvent(kind string, payload string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, [2]string{kind, payload})
+}
+
+// wait ждёт, пока листенер получит n событий: они доставляются асинхронно.
+func (b *recordingBus) wait(t *testing.T, n int) [][2]string {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		b.mu.Lock()
+		events := slices.Clone(b.events)
+		b.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d bus events %v, want %d", len(events), events, n)
+		}
+	}
+}
+
+func node(id, name string, online bool, addr string) map[string]any {
+	return map[string]any{
+		"StableID":  id,
+		"Name":      name + ".tail1.ts.net.",
+		"Addresses": []string{addr + "/32"},
+		"Online":    online,
+		"Hostinfo":  map[string]string{"Hostname": name, "OS": "linux"},
+	}
+}
+
+func TestIPNBusDeltas(t *testing.T) {
+	resetBus()
+	bus := &recordingBus{}
+	SetBusListener(bus)
+	t.Cleanup(func() { SetBusListener(nil); resetBus() })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/watch-ipn-bus", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"Prefs": map[string]any{"CorpDNS": true, "RouteAll": false},
+			"NetMap": map[string]any{
+				"SelfNode": node("self", "phone", true, "100.64.0.1"),
+				"Peers":    []any{node("a", "nas", true, "100.64.0.2"), node("b", "laptop", false, "100.64.0.3")},
+			},
+		})
+		writeJSON(w, map[string]any{"BrowseToURL": "https://login.tailscale.com/a/xyz"})
+		writeJSON(w, map[string]any{
+			"NetMap": map[string]any{
+				"SelfNode": node("self", "phone", true, "100.64.0.1"),
+				"Peers":    []any{node("a", "nas", false, "100.64.0.2"), node("c", "pi", true, "100.64.0.4")},
+			},
+		})
+	})
+	lc := fakeLocalAPI(t, mux)
+	runIPNBus(context.Background(), lc)
+
+	var kinds []string
+	var peers []busPeer
+	for _, ev := range bus.wait(t, 7) {
+		kinds = append(kinds, ev[0])
+		if ev[0] == "peer" {
+			var p busPeer
+			if err := json.Unmarshal([]byte(ev[1]), &p); err != nil {
+				t.Fatal(err)
+			}
+			peers = append(peers, p)
+		}
+		if ev[0] == "browse" && ev[1] != "https://login.tailscale.com/a/xyz" {
+			t.Errorf("browse payload = %q", ev[1])
+		}
+	}
+	want := []string{"prefs", "netmap", "browse", "peer", "peer", "peer", "netmap"}
+	if len(kinds) != len(want) {
+		t.Fatalf("events = %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Fatalf("events = %v, want %v", kinds, want)
+		}
+	}
+
+	// a ушла в офлайн, c появилась, b пропала из netmap.
+	if peers[0].ID != "a" || peers[0].Online || peers[0].Removed {
+		t.Errorf("peer[0] = %+v", peers[0])
+	}
+	if peers[1].ID != "c" || !peers[1].Online || peers[1].Addresses[0] != "100.64.0.4" {
+		t.Errorf("peer[1] = %+v", peers[1])
+	}
+	if peers[2].ID != "b" || !peers[2].Removed {
+		t.Errorf("peer[2] = %+v", peers[2])
+	}
+
+	var sum busNetMap
+	if err := json.Unmarshal([]byte(GetNetMapJSON()), &sum); err != nil {
+		t.Fatal(err)
+	}
+	if sum.Self == nil || sum.Self.Name != "phone.tail1.ts.net" || len(sum.Peers) != 2 {
+		t.Errorf("netmap = %+v", sum)
+	}
+}
+
+func TestIPNBusExitNode(t *testing.T) {
+	resetBus()
+	t.Cleanup(resetBus)
+	handleNotify(&localNotify{Prefs: &localPrefs{ExitNodeID: "nexit"}})
+	if !exitNodeActive() {
+		t.Error("exit node by id not seen")
+	}
+	// NetMap без Prefs не сбрасывает выбор.
+	handleNotify(&localNotify{NetMap: &localNetMap{}})
+	if !exitNodeActive() {
+		t.Error("exit node lost on netmap update")
+	}
+	handleNotify(&localNotify{Prefs: &localPrefs{}})
+	if exitNodeActive() {
+		t.Error("exit node still active after clearing")
+	}
+	handleNotify(&localNotify{Prefs: &localPrefs{ExitNodeIP: netip.MustParseAddr("100.64.0.9")}})
+	resetBus()
+	if exitNodeActive() {
+		t.Error("exit node survived resetBus")
+	}
+}
+
+type blockingBus struct {
+	release chan struct{}
+	mu      sync.Mutex
+	last    string
+}
+
+func (b *blockingBus) OnBusEvent(kind string, payload string) {
+	<-b.release
+	b.mu.Lock()
+	b.last = payload
+	b.mu.Unlock()
+}
+
+func TestBusListenerDoesNotBlockNotify(t *testing.T) {
+	resetBus()
+	b := &blockingBus{release: make(chan struct{})}
+	SetBusListener(b)
+	t.Cleanup(func() { SetBusListener(nil); resetBus() })
+
+	done := make(chan struct{})
+	go func() {
+		for i := range 3 * maxPendingBusEvents {
+			handleNotify(&localNotify{Prefs: &localPrefs{ControlURL: strconv.Itoa(i)}})
+		}
+		handleNotify(&localNotify{Prefs: &localPrefs{ControlURL: "last"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("IPN bus blocked on a stuck listener")
+	}
+
+	// Отпустили листенер — он догоняет и видит последние prefs.
+	close(b.release)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		b.mu.Lock()
+		last := b.last
+		b.mu.Unlock()
+		if strings.Contains(last, `"ControlURL":"last"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("last delivered event = %q", last)
+		}
+	}
+}
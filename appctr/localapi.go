@@ -0,0 +1,412 @@
+package appctr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// localAPIHost — фиктивный хост, который ждёт tailscaled в запросах к LocalAPI.
+const localAPIHost = "local-tailscaled.sock"
+
+var errPeerNotFound = errors.New("peer not found")
+
+// localAPIError — ответ LocalAPI с неожиданным HTTP статусом.
+type localAPIError struct {
+	Status int
+	Msg    string
+}
+
+func (e *localAPIError) Error() string {
+	return fmt.Sprintf("localapi: %d %s", e.Status, e.Msg)
+}
+
+func isLocalAPIStatus(err error, status int) bool {
+	var le *localAPIError
+	return errors.As(err, &le) && le.Status == status
+}
+
+// localClient ходит в LocalAPI tailscaled по unix-сокету вместо запуска CLI.
+type localClient struct {
+	socket string
+	hc     *http.Client
+}
+
+func newLocalClient(socket string) *localClient {
+	return &localClient{
+		socket: socket,
+		hc: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+				MaxIdleConns:    4,
+				IdleConnTimeout: 30 * time.Second,
+			},
+		},
+	}
+}
+
+func (lc *localClient) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+localAPIHost+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := lc.hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("localapi %s: %w", path, err)
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		defer res.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, &localAPIError{Status: res.StatusCode, Msg: errorFromBody(data)}
+	}
+	return res, nil
+}
+
+// send выполняет запрос с JSON телом in и декодирует ответ в out (если не nil).
+func (lc *localClient) send(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	res, err := lc.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("localapi %s: bad json: %w", path, err)
+	}
+	return nil
+}
+
+func errorFromBody(data []byte) string {
+	var j struct{ Error string }
+	if err := json.Unmarshal(data, &j); err == nil && j.Error != "" {
+		return j.Error
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// --- типы ответов (только нужные нам поля) ---
+
+type localStatus struct {
+	BackendState   string
+	HaveNodeKey    bool
+	AuthURL        string
+	TailscaleIPs   []netip.Addr
+	Self           *localPeer
+	Health         []string
+	MagicDNSSuffix string
+	CurrentTailnet *localTailnet
+	Peer           map[string]*localPeer
+}
+
+type localTailnet struct {
+	Name            string
+	MagicDNSSuffix  string
+	MagicDNSEnabled bool
+}
+
+type localPeer struct {
+	ID             string
+	PublicKey      string
+	HostName       string
+	DNSName        string
+	OS             string
+	TailscaleIPs   []netip.Addr
+	CurAddr        string
+	Relay          string
+	RxBytes        int64
+	TxBytes        int64
+	LastSeen       time.Time
+	LastHandshake  time.Time
+	Online         bool
+	ExitNode       bool
+	ExitNodeOption bool
+	Active         bool
+}
+
+type localPrefs struct {
+	ControlURL             string
+	RouteAll               bool
+	ExitNodeID             string
+	ExitNodeIP             netip.Addr
+	ExitNodeAllowLANAccess bool
+	CorpDNS                bool
+	WantRunning            bool
+	LoggedOut              bool
+	ShieldsUp              bool
+	AdvertiseTags          []string
+	Hostname               string
+	AdvertiseRoutes        []netip.Prefix
+	NoSNAT                 bool
+}
+
+// localMaskedPrefs — тело PATCH /prefs: меняются только поля с XxxSet=true.
+type localMaskedPrefs struct {
+	localPrefs
+	ControlURLSet             bool `json:",omitempty"`
+	RouteAllSet               bool `json:",omitempty"`
+	ExitNodeIDSet             bool `json:",omitempty"`
+	ExitNodeIPSet             bool `json:",omitempty"`
+	ExitNodeAllowLANAccessSet bool `json:",omitempty"`
+	CorpDNSSet                bool `json:",omitempty"`
+	WantRunningSet            bool `json:",omitempty"`
+	ShieldsUpSet              bool `json:",omitempty"`
+	AdvertiseTagsSet          bool `json:",omitempty"`
+	HostnameSet               bool `json:",omitempty"`
+	AdvertiseRoutesSet        bool `json:",omitempty"`
+}
+
+type localWhoIs struct {
+	Node *struct {
+		ID        int64
+		StableID  string
+		Name      string
+		Addresses []netip.Prefix
+	}
+	UserProfile *struct {
+		ID          int64
+		LoginName   string
+		DisplayName string
+	}
+}
+
+type localPingResult struct {
+	IP             string
+	NodeIP         string
+	NodeName       string
+	Err            string
+	LatencySeconds float64
+	Endpoint       string
+	DERPRegionID   int
+	DERPRegionCode string
+	IsLocalIP      bool
+}
+
+// Маски watch-ipn-bus (см. ipn.NotifyWatchOpt).
+const (
+	notifyInitialState  = 1 << 1
+	notifyInitialPrefs  = 1 << 2
+	notifyInitialNetMap = 1 << 3
+	notifyRateLimit     = 1 << 8
+)
+
+type localNotify struct {
+	Version       string
+	ErrMessage    *string
+	LoginFinished *struct{}
+	State         *int
+	Prefs         *localPrefs
+	NetMap        *localNetMap
+	BrowseToURL   *string
+}
+
+type localNetMap struct {
+	SelfNode *localNode
+	Peers    []*localNode
+	DNS      localDNSConfig
+	Domain   string
+}
+
+type localNode struct {
+	ID        int64
+	StableID  string
+	Name      string
+	Addresses []netip.Prefix
+	Online    *bool
+	Hostinfo  struct {
+		Hostname string
+		OS       string
+	}
+}
+
+type localDNSConfig struct {
+	Resolvers         []localResolver
+	Routes            map[string][]localResolver
+	FallbackResolvers []localResolver
+	Domains           []string
+}
+
+type localResolver struct {
+	Addr                string
+	BootstrapResolution []netip.Addr
+}
+
+// --- методы ---
+
+func (lc *localClient) Status(ctx context.Context) (*localStatus, error) {
+	var st localStatus
+	if err := lc.send(ctx, "GET", "/localapi/v0/status", nil, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (lc *localClient) Prefs(ctx context.Context) (*localPrefs, error) {
+	var p localPrefs
+	if err := lc.send(ctx, "GET", "/localapi/v0/prefs", nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (lc *localClient) EditPrefs(ctx context.Context, mp *localMaskedPrefs) (*localPrefs, error) {
+	var p localPrefs
+	if err := lc.send(ctx, "PATCH", "/localapi/v0/prefs", mp, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// StartWithAuthKey запускает state machine демона с ключом, не трогая prefs.
+func (lc *localClient) StartWithAuthKey(ctx context.Context, authKey string) error {
+	return lc.send(ctx, "POST", "/localapi/v0/start", map[string]string{"AuthKey": authKey}, nil)
+}
+
+func (lc *localClient) StartLoginInteractive(ctx context.Context) error {
+	return lc.send(ctx, "POST", "/localapi/v0/login-interactive", nil, nil)
+}
+
+func (lc *localClient) WhoIs(ctx context.Context, addr string) (*localWhoIs, error) {
+	var w localWhoIs
+	err := lc.send(ctx, "GET", "/localapi/v0/whois?addr="+url.QueryEscape(addr), nil, &w)
+	if isLocalAPIStatus(err, http.StatusNotFound) {
+		return nil, errPeerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// Ping пингует tailnet адрес; pingType — "disco", "TSMP", "ICMP" или "peerapi".
+func (lc *localClient) Ping(ctx context.Context, ip netip.Addr, pingType string) (*localPingResult, error) {
+	v := url.Values{}
+	v.Set("ip", ip.String())
+	v.Set("type", pingType)
+	var r localPingResult
+	if err := lc.send(ctx, "POST", "/localapi/v0/ping?"+v.Encode(), nil, &r); err != nil {
+		return nil, err
+	}
+	if r.Err != "" {
+		return &r, errors.New(r.Err)
+	}
+	return &r, nil
+}
+
+// QueryDNS резолвит имя через DNS форвардер демона и возвращает сырой DNS ответ.
+func (lc *localClient) QueryDNS(ctx context.Context, name, qtype string) ([]byte, error) {
+	v := url.Values{}
+	v.Set("name", name)
+	v.Set("type", qtype)
+	var r struct{ Bytes []byte }
+	if err := lc.send(ctx, "GET", "/localapi/v0/dns-query?"+v.Encode(), nil, &r); err != nil {
+		return nil, err
+	}
+	return r.Bytes, nil
+}
+
+// ipnBusWatcher читает поток ipn.Notify из watch-ipn-bus.
+type ipnBusWatcher struct {
+	res *http.Response
+	dec *json.Decoder
+}
+
+func (lc *localClient) WatchIPNBus(ctx context.Context, mask int) (*ipnBusWatcher, error) {
+	res, err := lc.do(ctx, "GET", fmt.Sprintf("/localapi/v0/watch-ipn-bus?mask=%d", mask), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ipnBusWatcher{res: res, dec: json.NewDecoder(res.Body)}, nil
+}
+
+func (w *ipnBusWatcher) Next() (*localNotify, error) {
+	var n localNotify
+	if err := w.dec.Decode(&n); err != nil {
+		return nil, err
+	}
+	if n.ErrMessage != nil {
+		return nil, errors.New(*n.ErrMessage)
+	}
+	return &n, nil
+}
+
+func (w *ipnBusWatcher) Close() error { return w.res.Body.Close() }
+
+// NetMap берёт текущий netmap одним сообщением из watch-ipn-bus (как `dns status`).
+func (lc *localClient) NetMap(ctx context.Context) (*localNetMap, error) {
+	w, err := lc.WatchIPNBus(ctx, notifyInitialNetMap)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	n, err := w.Next()
+	if err != nil {
+		return nil, err
+	}
+	if n.NetMap == nil {
+		return nil, errors.New("no network map yet")
+	}
+	return n.NetMap, nil
+}
+
+// findPeer ищет ноду по имени так же, как `tailscale ip <name>`:
+// по HostName, полному DNSName или его первой метке.
+func (st *localStatus) findPeer(name string) *localPeer {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	match := func(p *localPeer) bool {
+		if p == nil {
+			return false
+		}
+		dns := strings.TrimSuffix(p.DNSName, ".")
+		short, _, _ := strings.Cut(dns, ".")
+		return strings.EqualFold(p.HostName, name) ||
+			strings.EqualFold(dns, name) ||
+			strings.EqualFold(short, name)
+	}
+	if match(st.Self) {
+		return st.Self
+	}
+	for _, p := range st.Peer {
+		if match(p) {
+			return p
+		}
+	}
+	return nil
+}
+
+func currentLocalClient() *localClient {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if lapi == nil || lapi.socket != PC.Socket() {
+		lapi = newLocalClient(PC.Socket())
+	}
+	return lapi
+}
@@ -0,0 +1,160 @@
+package appctr
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeLocalAPI поднимает HTTP сервер на unix-сокете во временной папке.
+func fakeLocalAPI(t *testing.T, mux *http.ServeMux) *localClient {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "ts.sock")
+	serveLocalAPI(t, sock, mux)
+	return newLocalClient(sock)
+}
+
+func serveLocalAPI(t *testing.T, sock string, mux *http.ServeMux) {
+	t.Helper()
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestLocalClientStatus(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != localAPIHost {
+			t.Errorf("host = %q", r.Host)
+		}
+		writeJSON(w, map[string]any{
+			"BackendState": "Running",
+			"Self":         map[string]any{"HostName": "phone", "DNSName": "phone.tail1.ts.net.", "TailscaleIPs": []string{"100.64.0.1"}},
+			"Peer": map[string]any{
+				"nodekey:1": map[string]any{"HostName": "NAS", "DNSName": "nas.tail1.ts.net.", "TailscaleIPs": []string{"100.64.0.2", "fd7a:115c:a1e0::2"}, "Online": true},
+			},
+		})
+	})
+	lc := fakeLocalAPI(t, mux)
+
+	st, err := lc.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.BackendState != "Running" {
+		t.Errorf("BackendState = %q", st.BackendState)
+	}
+	for _, name := range []string{"nas", "NAS", "nas.tail1.ts.net", "nas.tail1.ts.net."} {
+		p := st.findPeer(name)
+		if p == nil || len(p.TailscaleIPs) != 2 || p.TailscaleIPs[0] != netip.MustParseAddr("100.64.0.2") {
+			t.Errorf("findPeer(%q) = %+v", name, p)
+		}
+	}
+	if p := st.findPeer("phone"); p != st.Self {
+		t.Errorf("findPeer(phone) = %+v, want self", p)
+	}
+	if p := st.findPeer("google.com"); p != nil {
+		t.Errorf("findPeer(google.com) = %+v, want nil", p)
+	}
+}
+
+func TestLocalClientErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/whois", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"Error":"no match for IP:port"}`, http.StatusNotFound)
+	})
+	mux.HandleFunc("/localapi/v0/prefs", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, map[string]string{"Error": "access denied"})
+	})
+	mux.HandleFunc("/localapi/v0/ping", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Query().Get("type") != "disco" {
+			t.Errorf("ping request %s %s", r.Method, r.URL)
+		}
+		writeJSON(w, map[string]any{"IP": "100.64.0.9", "Err": "timeout"})
+	})
+	lc := fakeLocalAPI(t, mux)
+	ctx := context.Background()
+
+	if _, err := lc.WhoIs(ctx, "100.64.0.9"); err != errPeerNotFound {
+		t.Errorf("WhoIs err = %v, want errPeerNotFound", err)
+	}
+	_, err := lc.Prefs(ctx)
+	if !isLocalAPIStatus(err, http.StatusForbidden) {
+		t.Errorf("Prefs err = %v, want 403", err)
+	}
+	if le, ok := err.(*localAPIError); !ok || le.Msg != "access denied" {
+		t.Errorf("Prefs err = %#v", err)
+	}
+	if _, err := lc.Ping(ctx, netip.MustParseAddr("100.64.0.9"), "disco"); err == nil || err.Error() != "timeout" {
+		t.Errorf("Ping err = %v", err)
+	}
+}
+
+func TestLocalClientQueryDNS(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartAnswers()
+	name := dnsmessage.MustNewName("host.corp.example.")
+	b.AResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 30}, dnsmessage.AResource{A: [4]byte{10, 0, 0, 7}})
+	resp, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Get("name") != "host.corp.example" || q.Get("type") != "A" {
+			t.Errorf("dns-query %v", r.URL)
+		}
+		writeJSON(w, map[string]any{"Bytes": resp})
+	})
+	lc := fakeLocalAPI(t, mux)
+
+	got, err := lc.QueryDNS(context.Background(), "host.corp.example", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(got); len(ips) != 1 || ips[0] != "10.0.0.7" {
+		t.Errorf("answerIPs = %v", ips)
+	}
+}
+
+func TestLocalClientNetMap(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/watch-ipn-bus", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("mask") != "8" {
+			t.Errorf("mask = %q", r.URL.Query().Get("mask"))
+		}
+		writeJSON(w, map[string]any{
+			"NetMap": map[string]any{
+				"DNS": map[string]any{
+					"Routes": map[string]any{"corp.example.": []map[string]string{{"Addr": "10.0.0.53"}}},
+				},
+			},
+		})
+	})
+	lc := fakeLocalAPI(t, mux)
+
+	nm, err := lc.NetMap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := nm.DNS.Routes["corp.example."]; len(r) != 1 || r[0].Addr != "10.0.0.53" {
+		t.Errorf("routes = %+v", nm.DNS.Routes)
+	}
+}
@@ -2,52 +2,208 @@ package appctr
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"log/slog"
+	"maps"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Источники записей в логе.
+const (
+	LogSourceAppctr     = "appctr"
+	LogSourceTailscaled = "tailscaled"
+	LogSourceDNS        = "dns"
+	LogSourceWebUI      = "webui"
+)
+
+// logSourceKey — атрибут slog, в котором логгер передаёт источник записи.
+const logSourceKey = "logsrc"
+
+var (
+	dnsLog = slog.New(newDualHandler()).With(logSourceKey, LogSourceDNS)
+	webLog = slog.New(newDualHandler()).With(logSourceKey, LogSourceWebUI)
+)
+
+// logRecord — одна запись лога. Seq растёт монотонно и не сбрасывается ClearLogs.
+type logRecord struct {
+	Seq    int64
+	Time   time.Time
+	Level  slog.Level
+	Source string
+	Msg    string
+	Attrs  map[string]string `json:",omitempty"`
+}
+
+func (r *logRecord) String() string { return r.format("15:04:05") }
+
+func (r *logRecord) format(timeLayout string) string {
+	var sb strings.Builder
+	sb.WriteString(r.Time.Local().Format(timeLayout))
+	sb.WriteString(" [")
+	sb.WriteString(r.Level.String())
+	sb.WriteString("] ")
+	if r.Source != LogSourceAppctr {
+		sb.WriteString(r.Source)
+		sb.WriteString(": ")
+	}
+	sb.WriteString(r.Msg)
+	for _, k := range slices.Sorted(maps.Keys(r.Attrs)) {
+		sb.WriteString(" ")
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.WriteString(r.Attrs[k])
+	}
+	return sb.String()
+}
+
+// logQuery — фильтр для выборки из LogManager. Нулевые поля не фильтруют,
+// кроме MinLevel: ноль — это INFO.
+type logQuery struct {
+	MinLevel slog.Level
+	Source   string
+	Contains string // без учёта регистра, по сообщению и атрибутам
+	Since    time.Time
+	Until    time.Time
+	AfterSeq int64
+	Limit    int // с AfterSeq — первые Limit записей, иначе последние
+}
+
+func (q *logQuery) match(r *logRecord) bool {
+	if r.Seq <= q.AfterSeq || r.Level < q.MinLevel {
+		return false
+	}
+	if q.Source != "" && r.Source != q.Source {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && r.Time.After(q.Until) {
+		return false
+	}
+	if q.Contains != "" && !strings.Contains(strings.ToLower(r.String()), strings.ToLower(q.Contains)) {
+		return false
+	}
+	return true
+}
+
+// LogManager — кольцевой буфер структурированных записей.
 type LogManager struct {
-	mu      sync.RWMutex
-	logs    []string
-	maxSize int
+	mu   sync.RWMutex
+	recs ring[logRecord]
 }
 
-var logManager = &LogManager{
-	logs:    make([]string, 0, 10000),
-	maxSize: 10000,
+func newLogManager(size int) *LogManager {
+	return &LogManager{recs: newRing[logRecord](size)}
 }
 
-func (lm *LogManager) AddLog(entry string) {
+var logManager = newLogManager(10000)
+
+func (lm *LogManager) add(r logRecord) {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
-	if len(lm.logs) >= lm.maxSize {
-		lm.logs = lm.logs[len(lm.logs)/2:]
-	}
-	lm.logs = append(lm.logs, entry)
+	seq, slot := lm.recs.push(r)
+	slot.Seq = seq
 }
 
-func (lm *LogManager) GetLogs() string {
+// query возвращает подходящие записи от старых к новым и Seq последней
+// просмотренной записи — курсор для следующего запроса с AfterSeq.
+func (lm *LogManager) query(q logQuery) ([]logRecord, int64) {
 	lm.mu.RLock()
 	defer lm.mu.RUnlock()
-	return strings.Join(lm.logs, "\n")
+	limit := 0
+	if q.AfterSeq > 0 {
+		limit = q.Limit
+	}
+	out, next := lm.recs.since(q.AfterSeq, limit, q.match)
+	if q.AfterSeq == 0 && q.Limit > 0 && len(out) > q.Limit {
+		out = out[len(out)-q.Limit:]
+	}
+	return out, next
+}
+
+func (lm *LogManager) GetLogs() string {
+	recs, _ := lm.query(logQuery{MinLevel: minLogLevel()})
+	lines := make([]string, len(recs))
+	for i := range recs {
+		lines[i] = recs[i].String()
+	}
+	return strings.Join(lines, "\n")
 }
 
 func (lm *LogManager) ClearLogs() {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
-	lm.logs = make([]string, 0, lm.maxSize)
+	lm.recs.reset()
 }
 
 func GetLogs() string { return logManager.GetLogs() }
 func ClearLogs()      { logManager.ClearLogs() }
 
+// QueryLogs возвращает JSON-массив записей. Пустые строки и нули не фильтруют;
+// minLevel — DEBUG/INFO/WARN/ERROR, время — unix ms, limit — последние N записей.
+func QueryLogs(minLevel, source, contains string, sinceUnixMs, untilUnixMs int64, limit int32) string {
+	q := logQuery{MinLevel: slog.LevelDebug, Source: source, Contains: contains, Limit: int(limit)}
+	if minLevel != "" {
+		_ = q.MinLevel.UnmarshalText([]byte(minLevel))
+	}
+	if sinceUnixMs > 0 {
+		q.Since = time.UnixMilli(sinceUnixMs)
+	}
+	if untilUnixMs > 0 {
+		q.Until = time.UnixMilli(untilUnixMs)
+	}
+	recs, _ := logManager.query(q)
+	if recs == nil {
+		recs = []logRecord{}
+	}
+	data, _ := json.Marshal(recs)
+	return string(data)
+}
+
+// maxLogsSince — сколько записей отдаёт один вызов GetLogsSince.
+const maxLogsSince = 1000
+
+// GetLogsSince отдаёт записи новее курсора seq (0 — с начала буфера) с учётом
+// SetLogLevel. Next — курсор для следующего вызова; Truncated — часть записей
+// после seq уже вытеснена из буфера.
+func GetLogsSince(seq int64) string {
+	recs, next := logManager.query(logQuery{MinLevel: minLogLevel(), AfterSeq: seq, Limit: maxLogsSince})
+	logManager.mu.RLock()
+	truncated := logManager.recs.truncated(seq)
+	logManager.mu.RUnlock()
+	if recs == nil {
+		recs = []logRecord{}
+	}
+	data, _ := json.Marshal(struct {
+		Records   []logRecord
+		Next      int64
+		Truncated bool
+	}{recs, next, truncated})
+	return string(data)
+}
+
+// minLogLevel: при SetLogLevel >= 1 отладочные записи не показываются,
+// но остаются в буфере и доступны через QueryLogs.
+func minLogLevel() slog.Level {
+	// Без stateMu: логируют и под ним.
+	if atomic.LoadInt32(&currentLogLevel) >= 1 {
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
+
 // --- slog handler ---
 
 type dualHandler struct {
 	textHandler slog.Handler
+	attrs       []slog.Attr
+	group       string
 }
 
 func newDualHandler() *dualHandler {
@@ -61,35 +217,104 @@ func newDualHandler() *dualHandler {
 func (h *dualHandler) Enabled(_ context.Context, _ slog.Level) bool { return true }
 
 func (h *dualHandler) Handle(ctx context.Context, r slog.Record) error {
-	var sb strings.Builder
-	sb.WriteString(r.Message)
+	rec := logRecord{Time: r.Time, Level: r.Level, Source: LogSourceAppctr, Msg: r.Message}
+	add := func(key string, v slog.Value) {
+		if key == logSourceKey {
+			rec.Source = v.String()
+			return
+		}
+		if rec.Attrs == nil {
+			rec.Attrs = make(map[string]string)
+		}
+		rec.Attrs[key] = v.String()
+	}
+	// В h.attrs группа уже учтена в ключах.
+	for _, a := range h.attrs {
+		add(a.Key, a.Value)
+	}
 	r.Attrs(func(a slog.Attr) bool {
-		sb.WriteString(" ")
-		sb.WriteString(a.Key)
-		sb.WriteString("=")
-		sb.WriteString(fmt.Sprintf("%v", a.Value.Any()))
+		add(h.group+a.Key, a.Value)
 		return true
 	})
+	logManager.add(rec)
 
-	msg := sb.String()
-	var entry string
-	if len(msg) > 4 && msg[:2] == "20" && msg[4] == '/' {
-		entry = fmt.Sprintf("[%s] %s", r.Level.String(), msg)
-	} else {
-		timestamp := r.Time.Local().Format("15:04:05")
-		entry = fmt.Sprintf("%s [%s] %s", timestamp, r.Level.String(), msg)
+	if r.Level < minLogLevel() {
+		return nil
 	}
-
-	logManager.AddLog(entry)
+	writeLogFile(rec.format("2006-01-02 15:04:05.000"))
 	return h.textHandler.Handle(ctx, r)
 }
 
 func (h *dualHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return &dualHandler{textHandler: h.textHandler.WithAttrs(attrs)}
+	nh := *h
+	nh.textHandler = h.textHandler.WithAttrs(attrs)
+	nh.attrs = slices.Clone(h.attrs)
+	for _, a := range attrs {
+		if a.Key != logSourceKey {
+			a.Key = h.group + a.Key
+		}
+		nh.attrs = append(nh.attrs, a)
+	}
+	return &nh
 }
 
 func (h *dualHandler) WithGroup(name string) slog.Handler {
-	return &dualHandler{textHandler: h.textHandler.WithGroup(name)}
+	nh := *h
+	nh.textHandler = h.textHandler.WithGroup(name)
+	nh.group = h.group + name + "."
+	return &nh
+}
+
+// noisyDaemonLines — строки tailscaled, которые пишутся с уровнем DEBUG.
+var noisyDaemonLines = []string{"magicsock", "netcheck", "ratelimit", "udp proxy: received", "logtail"}
+
+// logDaemonLine пишет строку вывода внешнего процесса (tailscaled, CLI, Web UI).
+// Таймстамп пакета log в начале строки становится временем записи.
+func logDaemonLine(source, text string) {
+	t := time.Now()
+	const layout = "2006/01/02 15:04:05 "
+	if len(text) >= len(layout) && strings.HasPrefix(text, "20") {
+		if ts, err := time.ParseInLocation(layout, text[:len(layout)], time.Local); err == nil {
+			t, text = ts, text[len(layout):]
+		}
+	}
+
+	level := slog.LevelInfo
+	lower := strings.ToLower(text)
+	for _, s := range noisyDaemonLines {
+		if strings.Contains(lower, s) {
+			level = slog.LevelDebug
+			break
+		}
+	}
+
+	r := slog.NewRecord(t, level, text, 0)
+	r.AddAttrs(slog.String(logSourceKey, source))
+	_ = slog.Default().Handler().Handle(context.Background(), r)
+}
+
+// lineWriter превращает вывод процесса в записи лога построчно.
+type lineWriter struct {
+	source string
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := slices.Index(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimRight(string(w.buf[:i]), " \t\r"); line != "" {
+			logDaemonLine(w.source, line)
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
 }
 
 func init() {
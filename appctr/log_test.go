@@ -0,0 +1,170 @@
+package appctr
+
+import (
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogManagerRing(t *testing.T) {
+	lm := newLogManager(3)
+	for i := 0; i < 5; i++ {
+		lm.add(logRecord{Msg: string(rune('a' + i))})
+	}
+	recs, next := lm.query(logQuery{})
+	if len(recs) != 3 || recs[0].Seq != 3 || recs[2].Msg != "e" || next != 5 {
+		t.Fatalf("recs = %+v, next = %d", recs, next)
+	}
+	lm.ClearLogs()
+	if recs, next := lm.query(logQuery{}); len(recs) != 0 || next != 5 {
+		t.Fatalf("after clear: %+v, next = %d", recs, next)
+	}
+	lm.add(logRecord{Msg: "f"})
+	if recs, _ := lm.query(logQuery{}); len(recs) != 1 || recs[0].Seq != 6 {
+		t.Fatalf("seq must survive ClearLogs: %+v", recs)
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	base := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	lm := newLogManager(100)
+	lm.add(logRecord{Time: base, Level: slog.LevelDebug, Source: LogSourceTailscaled, Msg: "magicsock: derp-1 connected"})
+	lm.add(logRecord{Time: base.Add(time.Minute), Level: slog.LevelInfo, Source: LogSourceAppctr, Msg: "tailscale is up"})
+	lm.add(logRecord{Time: base.Add(2 * time.Minute), Level: slog.LevelError, Source: LogSourceDNS, Msg: "SOCKS5 TCP DNS failed", Attrs: map[string]string{"server": "10.0.0.53"}})
+	lm.add(logRecord{Time: base.Add(3 * time.Minute), Level: slog.LevelWarn, Source: LogSourceWebUI, Msg: "Web UI stopped"})
+
+	tests := []struct {
+		name string
+		q    logQuery
+		want []int64
+	}{
+		{"all", logQuery{MinLevel: slog.LevelDebug}, []int64{1, 2, 3, 4}},
+		{"level", logQuery{MinLevel: slog.LevelWarn}, []int64{3, 4}},
+		{"source", logQuery{MinLevel: slog.LevelDebug, Source: LogSourceTailscaled}, []int64{1}},
+		{"substring in attrs", logQuery{MinLevel: slog.LevelDebug, Contains: "10.0.0.53"}, []int64{3}},
+		{"substring ignores case", logQuery{MinLevel: slog.LevelDebug, Contains: "MAGICSOCK"}, []int64{1}},
+		{"time range", logQuery{MinLevel: slog.LevelDebug, Since: base.Add(time.Minute), Until: base.Add(2 * time.Minute)}, []int64{2, 3}},
+		{"limit keeps newest", logQuery{MinLevel: slog.LevelDebug, Limit: 2}, []int64{3, 4}},
+		{"after seq with limit keeps oldest", logQuery{MinLevel: slog.LevelDebug, AfterSeq: 1, Limit: 2}, []int64{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recs, _ := lm.query(tt.q)
+			var got []int64
+			for _, r := range recs {
+				got = append(got, r.Seq)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLogCursorSkipsFiltered(t *testing.T) {
+	lm := newLogManager(100)
+	lm.add(logRecord{Level: slog.LevelInfo, Msg: "one"})
+	lm.add(logRecord{Level: slog.LevelDebug, Msg: "noise"})
+	lm.add(logRecord{Level: slog.LevelDebug, Msg: "noise"})
+
+	recs, next := lm.query(logQuery{MinLevel: slog.LevelInfo, AfterSeq: 0, Limit: 10})
+	if len(recs) != 1 || next != 3 {
+		t.Fatalf("recs = %+v, next = %d", recs, next)
+	}
+	// Курсор продвинулся за отфильтрованные записи — повторно их не сканируем.
+	if recs, next := lm.query(logQuery{MinLevel: slog.LevelInfo, AfterSeq: next}); len(recs) != 0 || next != 3 {
+		t.Fatalf("recs = %+v, next = %d", recs, next)
+	}
+}
+
+func TestLogSourcesAndDaemonLines(t *testing.T) {
+	logManager.mu.RLock()
+	from := logManager.recs.seq
+	logManager.mu.RUnlock()
+
+	dnsLog.WithGroup("q").Info("cache miss", "name", "example.com")
+	logDaemonLine(LogSourceTailscaled, "2026/01/02 10:00:00 magicsock: endpoints changed")
+	logDaemonLine(LogSourceTailscaled, "wgengine: Reconfig done")
+	w := &lineWriter{source: LogSourceWebUI}
+	w.Write([]byte("web server running on: \nhttp://127.0.0.1:8080\r\n"))
+
+	recs, _ := logManager.query(logQuery{MinLevel: slog.LevelDebug, AfterSeq: from})
+	if len(recs) != 5 {
+		t.Fatalf("got %d records: %+v", len(recs), recs)
+	}
+	if r := recs[0]; r.Source != LogSourceDNS || r.Attrs["q.name"] != "example.com" {
+		t.Errorf("dns record = %+v", r)
+	}
+	if r := recs[1]; r.Level != slog.LevelDebug || r.Msg != "magicsock: endpoints changed" ||
+		!r.Time.Equal(time.Date(2026, 1, 2, 10, 0, 0, 0, time.Local)) {
+		t.Errorf("noisy daemon line = %+v", r)
+	}
+	if r := recs[2]; r.Level != slog.LevelInfo || r.Source != LogSourceTailscaled {
+		t.Errorf("daemon line = %+v", r)
+	}
+	if r := recs[3]; r.Source != LogSourceWebUI || r.Msg != "web server running on:" || recs[4].Msg != "http://127.0.0.1:8080" {
+		t.Errorf("web ui line = %+v", r)
+	}
+
+	// При уровне по умолчанию отладочные строки скрыты, но не потеряны.
+	var page struct {
+		Records []logRecord
+		Next    int64
+	}
+	if err := json.Unmarshal([]byte(GetLogsSince(from)), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 4 || page.Next != recs[4].Seq {
+		t.Errorf("GetLogsSince = %+v", page)
+	}
+	var all []logRecord
+	if err := json.Unmarshal([]byte(QueryLogs("DEBUG", LogSourceTailscaled, "magicsock", 0, 0, 0)), &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 || all[len(all)-1].Seq != recs[1].Seq {
+		t.Errorf("QueryLogs = %+v", all)
+	}
+}
+
+// Stop логирует, держа stateMu; обработчик лога не должен его брать.
+func TestStartStopWhileLogging(t *testing.T) {
+	SetLogLevel(0)
+	defer SetLogLevel(1)
+	dir := t.TempDir()
+	Start(&StartOptions{
+		ExecPath:   filepath.Join(dir, "libtailscaled.so"),
+		SocketPath: filepath.Join(dir, "tailscaled.sock"),
+		StatePath:  filepath.Join(dir, "state"),
+		DnsProxy:   "127.0.0.1:0",
+	})
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		stateMu.Lock()
+		started := dnsProxyCancel != nil
+		stateMu.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("DNS proxy did not start")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Stop deadlocked")
+	}
+}
@@ -0,0 +1,247 @@
+package appctr
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const logFileName = "appctr.log"
+
+// rotatingFile — лог-файл с ротацией по размеру: appctr.log, appctr.log.1[.gz], ...
+// Хранится не больше maxFiles ротированных файлов.
+type rotatingFile struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxFiles int
+	compress bool
+
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+func newRotatingFile(dir string, maxSize int64, maxFiles int, compress bool) *rotatingFile {
+	return &rotatingFile{dir: dir, maxSize: maxSize, maxFiles: maxFiles, compress: compress}
+}
+
+func (w *rotatingFile) path(i int) string {
+	if i == 0 {
+		return filepath.Join(w.dir, logFileName)
+	}
+	return filepath.Join(w.dir, fmt.Sprintf("%s.%d", logFileName, i))
+}
+
+func (w *rotatingFile) open() error {
+	if err := os.MkdirAll(w.dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path(0), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, st.Size()
+	return nil
+}
+
+func (w *rotatingFile) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate сдвигает appctr.log.N -> N+1, удаляя вышедшие за maxFiles,
+// и начинает новый appctr.log. Вызывается под w.mu.
+func (w *rotatingFile) rotate() error {
+	w.f.Close()
+	w.f = nil
+	for _, ext := range []string{"", ".gz"} {
+		os.Remove(w.path(w.maxFiles) + ext)
+	}
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			os.Rename(w.path(i)+ext, w.path(i+1)+ext)
+		}
+	}
+	if w.maxFiles > 0 {
+		if err := os.Rename(w.path(0), w.path(1)); err != nil {
+			return err
+		}
+		if w.compress {
+			if err := gzipFile(w.path(1)); err != nil {
+				return err
+			}
+		}
+	} else {
+		os.Remove(w.path(0))
+	}
+	return w.open()
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	err = errors.Join(err, zw.Close(), dst.Close())
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (w *rotatingFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// files возвращает существующие файлы лога от старых к новым.
+func (w *rotatingFile) files() []string {
+	var out []string
+	for i := w.maxFiles; i >= 0; i-- {
+		for _, ext := range []string{".gz", ""} {
+			if i == 0 && ext != "" {
+				continue
+			}
+			if _, err := os.Stat(w.path(i) + ext); err == nil {
+				out = append(out, w.path(i)+ext)
+			}
+		}
+	}
+	return out
+}
+
+// addToZip кладёт файлы лога в архив под префиксом dir.
+func (w *rotatingFile) addToZip(zw *zip.Writer, dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f != nil {
+		w.f.Sync()
+	}
+	for _, p := range w.files() {
+		if err := addFileToZip(zw, p, dir+"/"+filepath.Base(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFileToZip(zw *zip.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(st)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if strings.HasSuffix(name, ".gz") {
+		hdr.Method = zip.Store
+	} else {
+		hdr.Method = zip.Deflate
+	}
+	dst, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+var (
+	logFileMu sync.Mutex
+	logFile   *rotatingFile
+)
+
+// setLogFile переключает запись лога на файлы в dir; нули — значения по умолчанию.
+func setLogFile(dir string, maxKB, maxFiles int32, compress bool) {
+	if maxKB <= 0 {
+		maxKB = 1024
+	}
+	if maxFiles <= 0 {
+		maxFiles = 5
+	}
+	logFileMu.Lock()
+	defer logFileMu.Unlock()
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = newRotatingFile(dir, int64(maxKB)*1024, int(maxFiles), compress)
+}
+
+func writeLogFile(line string) {
+	logFileMu.Lock()
+	w := logFile
+	logFileMu.Unlock()
+	if w != nil {
+		w.Write([]byte(line + "\n"))
+	}
+}
+
+// BundleLogs пишет текущий и ротированные лог-файлы в один zip по пути path.
+func BundleLogs(path string) error {
+	logFileMu.Lock()
+	w := logFile
+	logFileMu.Unlock()
+	if w == nil {
+		return errors.New("log files are not configured yet")
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	zw.SetComment("appctr logs " + time.Now().Format(time.RFC3339))
+	err = w.addToZip(zw, "logs")
+	return errors.Join(err, zw.Close(), f.Close())
+}
@@ -0,0 +1,99 @@
+package appctr
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	w := newRotatingFile(dir, 100, 2, true)
+	defer w.Close()
+	line := strings.Repeat("x", 39) + "\n" // 40 байт: по 2 строки на файл
+	for i := 0; i < 9; i++ {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for _, p := range w.files() {
+		names = append(names, filepath.Base(p))
+	}
+	want := []string{"appctr.log.2.gz", "appctr.log.1.gz", "appctr.log"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "appctr.log.3.gz")); !os.IsNotExist(err) {
+		t.Errorf("retention: appctr.log.3.gz exists (%v)", err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "appctr.log.1.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(zr)
+	if string(data) != line+line {
+		t.Errorf("rotated content = %q", data)
+	}
+
+	// Открытие существующего файла продолжает его, а не перезаписывает.
+	w.Close()
+	w2 := newRotatingFile(dir, 100, 2, true)
+	defer w2.Close()
+	w2.Write([]byte(line))
+	if st, _ := os.Stat(filepath.Join(dir, "appctr.log")); st.Size() != 80 {
+		t.Errorf("appctr.log size = %d, want 80", st.Size())
+	}
+	if _, err := w.Write([]byte(line)); err == nil {
+		t.Error("write to closed file succeeded")
+	}
+}
+
+func TestBundleLogs(t *testing.T) {
+	dir := t.TempDir()
+	setLogFile(filepath.Join(dir, "logs"), 1, 3, false)
+	t.Cleanup(func() {
+		logFileMu.Lock()
+		logFile.Close()
+		logFile = nil
+		logFileMu.Unlock()
+	})
+	for i := 0; i < 100; i++ {
+		writeLogFile("bundle test line " + strings.Repeat("y", 40))
+	}
+
+	out := filepath.Join(dir, "logs.zip")
+	if err := BundleLogs(out); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"logs/appctr.log.3", "logs/appctr.log.2", "logs/appctr.log.1", "logs/appctr.log"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("zip entries = %v, want %v", names, want)
+	}
+	rc, _ := zr.File[3].Open()
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if !strings.HasPrefix(string(data), "bundle test line") {
+		t.Errorf("current log = %q", data)
+	}
+}
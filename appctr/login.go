@@ -0,0 +1,119 @@
+package appctr
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+const defaultLoginTimeout = 10 * time.Minute
+
+// GetLoginURL возвращает URL для интерактивного логина, пока нода его ждёт.
+func GetLoginURL() string {
+	busMu.Lock()
+	defer busMu.Unlock()
+	return busLoginURL
+}
+
+// setLoginURL запоминает URL логина и отдаёт его BusListener событием "browse".
+func setLoginURL(url string) {
+	busMu.Lock()
+	changed := url != busLoginURL
+	busLoginURL = url
+	busMu.Unlock()
+	if !changed || url == "" {
+		return
+	}
+	slog.Info("Login required", "url", url)
+	setBackendState(StateNeedsLogin, "waiting for login in browser")
+	sendBusEvents(busEvent{"browse", url})
+}
+
+func loginTimeout(opt *StartOptions) time.Duration {
+	if opt.LoginTimeoutSec > 0 {
+		return time.Duration(opt.LoginTimeoutSec) * time.Second
+	}
+	return defaultLoginTimeout
+}
+
+// loginInteractive просит демон начать логин через LocalAPI и ждёт, пока
+// пользователь залогинится по ссылке, но не дольше loginTimeout. Ссылку демон
+// присылает в IPN bus (BrowseToURL), её подхватывает watchIPNBus. Prefs здесь
+// не трогаются; с DoReset ExtraUpArgs сначала применяются как при `up --reset`.
+func loginInteractive(ctx context.Context, lc *localClient, opt *StartOptions) bool {
+	timeout := loginTimeout(opt)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if opt.DoReset {
+		if err := resetPrefs(ctx, lc, opt); err != nil {
+			slog.Error("Resetting prefs before login failed", "err", err)
+		}
+	}
+
+	slog.Info("Starting interactive login", "timeout", timeout)
+	setBackendState(StateConnecting, "")
+	err := lc.StartLoginInteractive(ctx)
+	if err == nil {
+		err = waitForState(ctx, StateRunning)
+	}
+	if err == nil {
+		slog.Info("Interactive login finished")
+		setLoginURL("")
+		return true
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.Error("Interactive login timed out", "timeout", timeout)
+		setLoginURL("")
+		setBackendState(StateFailed, "login timed out")
+	} else {
+		slog.Info("Interactive login cancelled", "err", err)
+	}
+	return false
+}
+
+// loginWithAuthKey — `up --reset --auth-key` через LocalAPI для бэкенда без CLI.
+func loginWithAuthKey(ctx context.Context, lc *localClient, opt *StartOptions) error {
+	if opt.DoReset {
+		if err := resetPrefs(ctx, lc, opt); err != nil {
+			return err
+		}
+	}
+	slog.Info("Starting with auth key via LocalAPI")
+	setBackendState(StateConnecting, "")
+	if err := lc.StartWithAuthKey(ctx, opt.AuthKey); err != nil {
+		return err
+	}
+	return waitBackendRunning(ctx, lc, noResetUpTimeout)
+}
+
+// waitForState ждёт нужного состояния; Failed и Stopped считаются ошибкой.
+func waitForState(ctx context.Context, want State) error {
+	t := time.NewTicker(500 * time.Millisecond)
+	defer t.Stop()
+	for {
+		st, reason := currentState()
+		switch st {
+		case want:
+			return nil
+		case StateFailed, StateStopped:
+			return errors.New(st.String() + ": " + reason)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
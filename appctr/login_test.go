@@ -0,0 +1,151 @@
+package appctr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLoginAPI — LocalAPI, который по login-interactive шлёт в IPN bus ссылку,
+// а после loggedIn — Running.
+func fakeLoginAPI(t *testing.T, loggedIn chan struct{}) (*localClient, *map[string]any) {
+	t.Helper()
+	var mu sync.Mutex
+	var patch map[string]any
+	started := make(chan struct{})
+	var once sync.Once
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/login-interactive", func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(started) })
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/localapi/v0/watch-ipn-bus", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"State": 2}) // NeedsLogin
+		w.(http.Flusher).Flush()
+		select {
+		case <-started:
+		case <-r.Context().Done():
+			return
+		}
+		writeJSON(w, map[string]any{"BrowseToURL": "https://login.example.com/a/123"})
+		w.(http.Flusher).Flush()
+		select {
+		case <-loggedIn:
+		case <-r.Context().Done():
+			return
+		}
+		writeJSON(w, map[string]any{"State": 6}) // Running
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/localapi/v0/prefs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" {
+			mu.Lock()
+			json.NewDecoder(r.Body).Decode(&patch)
+			mu.Unlock()
+		}
+		writeJSON(w, map[string]any{"RouteAll": true, "CorpDNS": true, "Hostname": "old"})
+	})
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"BackendState": "NeedsLogin"})
+	})
+	lc := fakeLocalAPI(t, mux)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go runIPNBus(ctx, lc)
+	return lc, &patch
+}
+
+func TestLoginInteractive(t *testing.T) {
+	resetBus()
+	setState(StateStarting, "")
+	t.Cleanup(func() { setState(StateStopped, ""); resetBus() })
+
+	loggedIn := make(chan struct{})
+	lc, patch := fakeLoginAPI(t, loggedIn)
+	done := make(chan bool)
+	go func() { done <- loginInteractive(context.Background(), lc, &StartOptions{LoginTimeoutSec: 10}) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for GetLoginURL() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("login URL was not taken from the IPN bus")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if GetLoginURL() != "https://login.example.com/a/123" {
+		t.Fatalf("GetLoginURL() = %q", GetLoginURL())
+	}
+	if st, _ := currentState(); st != StateNeedsLogin {
+		t.Fatalf("state = %s, want NeedsLogin", st)
+	}
+
+	close(loggedIn)
+	if !<-done {
+		t.Fatal("loginInteractive failed")
+	}
+	if st, _ := currentState(); st != StateRunning || GetLoginURL() != "" {
+		t.Fatalf("state = %s, url = %q", st, GetLoginURL())
+	}
+	if *patch != nil {
+		t.Errorf("prefs changed without DoReset: %v", *patch)
+	}
+}
+
+func TestLoginInteractiveDoResetResetsPrefs(t *testing.T) {
+	resetBus()
+	setState(StateStarting, "")
+	t.Cleanup(func() { setState(StateStopped, ""); resetBus() })
+
+	loggedIn := make(chan struct{})
+	close(loggedIn)
+	lc, patch := fakeLoginAPI(t, loggedIn)
+	if !loginInteractive(context.Background(), lc, &StartOptions{LoginTimeoutSec: 10, DoReset: true, ExtraUpArgs: "--hostname=phone"}) {
+		t.Fatal("loginInteractive failed")
+	}
+	// Hostname из аргументов, accept-routes сброшен к умолчанию, accept-dns уже true.
+	p := *patch
+	if p["Hostname"] != "phone" || p["RouteAllSet"] != true || p["RouteAll"] == true || p["CorpDNSSet"] == true {
+		t.Errorf("reset patch = %v", p)
+	}
+}
+
+func TestLoginInteractiveTimeout(t *testing.T) {
+	resetBus()
+	setState(StateStarting, "")
+	t.Cleanup(func() { setState(StateStopped, ""); resetBus() })
+
+	lc, _ := fakeLoginAPI(t, make(chan struct{}))
+	if loginInteractive(context.Background(), lc, &StartOptions{LoginTimeoutSec: 1}) {
+		t.Fatal("login must time out")
+	}
+	if st, reason := currentState(); st != StateFailed || reason != "login timed out" {
+		t.Fatalf("state = %s (%s)", st, reason)
+	}
+}
+
+func TestLoginInteractiveCancelled(t *testing.T) {
+	resetBus()
+	setState(StateStarting, "")
+	t.Cleanup(func() { setState(StateStopped, ""); resetBus() })
+
+	lc, _ := fakeLoginAPI(t, make(chan struct{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	if loginInteractive(ctx, lc, &StartOptions{}) {
+		t.Fatal("login must be cancelled")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("cancellation did not stop the login")
+	}
+	if st, _ := currentState(); st == StateFailed {
+		t.Fatal("cancellation must not mark the state as failed")
+	}
+}
@@ -0,0 +1,35 @@
+//go:build android && tsnet
+
+// Тот же фикс, что patches/fix_android_netmon.go для tailscaled: без него
+// netmon внутри процесса (tsnet) не видит интерфейсы на Android 11+.
+
+package appctr
+
+import (
+	"fmt"
+
+	"github.com/wlynxg/anet"
+	"tailscale.com/net/netmon"
+)
+
+func init() {
+	netmon.RegisterInterfaceGetter(func() ([]netmon.Interface, error) {
+		ifs, err := anet.Interfaces()
+		if err != nil {
+			return nil, fmt.Errorf("anet.Interfaces: %w", err)
+		}
+		ret := make([]netmon.Interface, len(ifs))
+		for i := range ifs {
+			addrs, err := anet.InterfaceAddrsByInterface(&ifs[i])
+			if err != nil {
+				return nil, fmt.Errorf("ifs[%d].Addrs: %w", i, err)
+			}
+			ret[i] = netmon.Interface{
+				Interface: &ifs[i],
+				AltAddrs:  addrs,
+			}
+		}
+
+		return ret, nil
+	})
+}
@@ -2,8 +2,11 @@ package appctr
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"sync"
@@ -28,11 +31,11 @@ func newPathControl(execPath, socketPath, statePath string) pathControl {
 }
 
 func (p pathControl) TailscaledSo() string   { return p.execPath }
-func (p pathControl) Tailscaled() string      { return filepath.Join(p.dataDir, "tailscaled") }
-func (p pathControl) TailscaleCliSo() string  { return filepath.Join(p.execDir, "libtailscale_cli.so") }
-func (p pathControl) Tailscale() string       { return filepath.Join(p.dataDir, "tailscale") }
-func (p pathControl) Socket() string          { return p.socketPath }
-func (p *pathControl) State() string          { return p.statePath }
+func (p pathControl) Tailscaled() string     { return filepath.Join(p.dataDir, "tailscaled") }
+func (p pathControl) TailscaleCliSo() string { return filepath.Join(p.execDir, "libtailscale_cli.so") }
+func (p pathControl) Tailscale() string      { return filepath.Join(p.dataDir, "tailscale") }
+func (p pathControl) Socket() string         { return p.socketPath }
+func (p *pathControl) State() string         { return p.statePath }
 
 func (p pathControl) DataDir(s ...string) string {
 	if len(s) == 0 {
@@ -42,22 +45,19 @@ func (p pathControl) DataDir(s ...string) string {
 }
 
 func rm(path ...string) {
-	if len(path) == 0 {
-		return
+	for _, p := range path {
+		err := os.RemoveAll(p)
+		slog.Info("rm", "path", p, "err", err)
 	}
-	args := []string{"-rf"}
-	args = append(args, path...)
-	data, err := exec.Command("/system/bin/rm", args...).CombinedOutput()
-	slog.Info("rm", "cmd", args, "output", string(data), "err", err)
 }
 
 func ln(src, dst string) {
-	c := exec.Command("/system/bin/ln", "-s", src, dst)
-	data, err := c.CombinedOutput()
-	slog.Info("ln", "cmd", c.String(), "output", string(data), "err", err)
+	err := os.Symlink(src, dst)
+	slog.Info("ln", "src", src, "dst", dst, "err", err)
 }
 
-func tailscaledCmd(p pathControl, socks5host string, httphost string) error {
+// tailscaledCmd запускает tailscaled и ждёт его выхода.
+func tailscaledCmd(ctx context.Context, p pathControl, socks5host string, httphost string) error {
 	rm(p.Tailscale(), p.Tailscaled())
 	ln(p.TailscaleCliSo(), p.Tailscale())
 	ln(p.TailscaledSo(), p.Tailscaled())
@@ -85,30 +85,29 @@ func tailscaledCmd(p pathControl, socks5host string, httphost string) error {
 		return err
 	}
 
+	// Проверка ctx под stateMu: Stop() не должен разминуться с рестартом.
 	stateMu.Lock()
+	if err := ctx.Err(); err != nil {
+		stateMu.Unlock()
+		return err
+	}
 	cmd = c
+	err = c.Start()
 	stateMu.Unlock()
-
-	if err := c.Start(); err != nil {
+	if err != nil {
 		return err
 	}
 
 	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		s := bufio.NewScanner(stdOut)
-		for s.Scan() {
-			logWithFilter(s.Text())
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		s := bufio.NewScanner(stdErr)
-		for s.Scan() {
-			logWithFilter(s.Text())
-		}
-	}()
-
+	for _, r := range []io.Reader{stdOut, stdErr} {
+		wg.Go(func() {
+			s := bufio.NewScanner(r)
+			for s.Scan() {
+				logDaemonLine(LogSourceTailscaled, s.Text())
+			}
+		})
+	}
+	// Wait закрывает пайпы: сначала дочитываем их.
+	wg.Wait()
 	return c.Wait()
 }
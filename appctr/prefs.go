@@ -0,0 +1,433 @@
+package appctr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errNeedsReset — желаемые настройки нельзя применить через EditPrefs
+// (смена login-server, тегов или неизвестный флаг), нужен `up --reset`.
+var errNeedsReset = errors.New("settings require tailscale up --reset")
+
+var errLoginTimedOut = errors.New("login timed out")
+
+// noResetUpTimeout — сколько ждать Running без --reset, прежде чем считать,
+// что демон завис (i/o timeout из README). Сбрасывать prefs сами не будем:
+// это делается только по DoReset.
+var noResetUpTimeout = 45 * time.Second
+
+// appliedFlagsFile — значения флагов ExtraUpArgs, применённых в прошлый раз.
+// Лежит в state dir: без --reset применяются только флаги, изменившиеся с тех
+// пор, а prefs, поменянные в консоли или через CLI, остаются.
+const appliedFlagsFile = "applied_up_flags.json"
+
+var exitRoutes = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+
+// upFlags — флаги из ExtraUpArgs. Применяются только явно указанные:
+// всё, что не упомянуто, остаётся как в текущих prefs (например, из консоли).
+type upFlags struct {
+	hostname         string
+	loginServer      string
+	acceptRoutes     bool
+	acceptDNS        bool
+	shieldsUp        bool
+	exitNode         string
+	exitNodeAllowLAN bool
+	advertiseExit    bool
+	advertiseRoutes  string
+	advertiseTags    string
+
+	set      map[string]bool
+	values   map[string]string // значения всех флагов в виде строк
+	defaults map[string]string
+	known    []string // все флаги, которые мы умеем применять
+}
+
+func parseUpArgs(args string) (*upFlags, error) {
+	f := &upFlags{set: map[string]bool{}, values: map[string]string{}, defaults: map[string]string{}}
+	fs := flag.NewFlagSet("up", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&f.hostname, "hostname", "", "")
+	fs.StringVar(&f.loginServer, "login-server", "", "")
+	fs.BoolVar(&f.acceptRoutes, "accept-routes", false, "")
+	fs.BoolVar(&f.acceptDNS, "accept-dns", true, "")
+	fs.BoolVar(&f.shieldsUp, "shields-up", false, "")
+	fs.StringVar(&f.exitNode, "exit-node", "", "")
+	fs.BoolVar(&f.exitNodeAllowLAN, "exit-node-allow-lan-access", false, "")
+	fs.BoolVar(&f.advertiseExit, "advertise-exit-node", false, "")
+	fs.StringVar(&f.advertiseRoutes, "advertise-routes", "", "")
+	fs.StringVar(&f.advertiseTags, "advertise-tags", "", "")
+	if err := fs.Parse(strings.Fields(args)); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNeedsReset, err)
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("%w: unexpected argument %q", errNeedsReset, fs.Arg(0))
+	}
+	fs.Visit(func(fl *flag.Flag) { f.set[fl.Name] = true })
+	fs.VisitAll(func(fl *flag.Flag) {
+		f.known = append(f.known, fl.Name)
+		f.values[fl.Name] = fl.Value.String()
+		f.defaults[fl.Name] = fl.DefValue
+	})
+	return f, nil
+}
+
+// dropUnchanged снимает флаги, значение которых не изменилось с прошлого
+// применения, а если флаг ещё не применяли — совпадает со значением по
+// умолчанию. Возвращает снятые флаги для лога.
+func (f *upFlags) dropUnchanged(applied map[string]string) []string {
+	var dropped []string
+	for _, name := range slices.Sorted(maps.Keys(f.set)) {
+		last, ok := applied[name]
+		if !ok {
+			last = f.defaults[name]
+		}
+		if f.values[name] == last {
+			delete(f.set, name)
+			dropped = append(dropped, name)
+		}
+	}
+	return dropped
+}
+
+func appliedFlagsPath(opt *StartOptions) string {
+	if opt.StatePath == "" {
+		return ""
+	}
+	return filepath.Join(opt.StatePath, appliedFlagsFile)
+}
+
+// loadAppliedFlags читает значения флагов из прошлого применения; nil — их нет.
+func loadAppliedFlags(path string) map[string]string {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Reading applied up flags failed", "path", path, "err", err)
+		}
+		return nil
+	}
+	var applied map[string]string
+	if err := json.Unmarshal(data, &applied); err != nil {
+		slog.Warn("Applied up flags are corrupt, ignoring", "path", path, "err", err)
+		return nil
+	}
+	return applied
+}
+
+// saveAppliedFlags запоминает значения заданных в f флагов поверх прошлых.
+func saveAppliedFlags(path string, f *upFlags) {
+	if path == "" {
+		return
+	}
+	applied := loadAppliedFlags(path)
+	if applied == nil {
+		applied = map[string]string{}
+	}
+	for name := range f.set {
+		applied[name] = f.values[name]
+	}
+	data, _ := json.Marshal(applied)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		slog.Warn("Saving applied up flags failed", "path", path, "err", err)
+	}
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// diffPrefs строит PATCH только для тех флагов, значение которых отличается от текущего.
+// Возвращает маску и список изменённых флагов для лога.
+func diffPrefs(cur *localPrefs, st *localStatus, f *upFlags) (*localMaskedPrefs, []string, error) {
+	mp := &localMaskedPrefs{}
+	var changed []string
+	loggedIn := st != nil && st.HaveNodeKey && st.BackendState != "NeedsLogin"
+
+	if f.set["hostname"] && f.hostname != cur.Hostname {
+		mp.Hostname, mp.HostnameSet = f.hostname, true
+		changed = append(changed, "hostname")
+	}
+	if f.set["login-server"] && strings.TrimSuffix(f.loginServer, "/") != strings.TrimSuffix(cur.ControlURL, "/") {
+		if loggedIn {
+			return nil, nil, fmt.Errorf("%w: login-server changed", errNeedsReset)
+		}
+		mp.ControlURL, mp.ControlURLSet = f.loginServer, true
+		changed = append(changed, "login-server")
+	}
+	if f.set["accept-routes"] && f.acceptRoutes != cur.RouteAll {
+		mp.RouteAll, mp.RouteAllSet = f.acceptRoutes, true
+		changed = append(changed, "accept-routes")
+	}
+	if f.set["accept-dns"] && f.acceptDNS != cur.CorpDNS {
+		mp.CorpDNS, mp.CorpDNSSet = f.acceptDNS, true
+		changed = append(changed, "accept-dns")
+	}
+	if f.set["shields-up"] && f.shieldsUp != cur.ShieldsUp {
+		mp.ShieldsUp, mp.ShieldsUpSet = f.shieldsUp, true
+		changed = append(changed, "shields-up")
+	}
+	if f.set["exit-node"] {
+		want, err := parseExitNode(f.exitNode)
+		if err != nil {
+			return nil, nil, err
+		}
+		if want != currentExitNodeIP(cur, st) {
+			mp.ExitNodeIP, mp.ExitNodeIPSet = want, true
+			mp.ExitNodeID, mp.ExitNodeIDSet = "", true
+			changed = append(changed, "exit-node")
+		}
+	}
+	if f.set["exit-node-allow-lan-access"] && f.exitNodeAllowLAN != cur.ExitNodeAllowLANAccess {
+		mp.ExitNodeAllowLANAccess, mp.ExitNodeAllowLANAccessSet = f.exitNodeAllowLAN, true
+		changed = append(changed, "exit-node-allow-lan-access")
+	}
+	if f.set["advertise-routes"] || f.set["advertise-exit-node"] {
+		want, err := desiredRoutes(cur.AdvertiseRoutes, f)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !samePrefixes(want, cur.AdvertiseRoutes) {
+			mp.AdvertiseRoutes, mp.AdvertiseRoutesSet = want, true
+			changed = append(changed, "advertise-routes")
+		}
+	}
+	if f.set["advertise-tags"] {
+		want := splitList(f.advertiseTags)
+		if !slices.Equal(slices.Sorted(slices.Values(want)), slices.Sorted(slices.Values(cur.AdvertiseTags))) {
+			if loggedIn {
+				return nil, nil, fmt.Errorf("%w: advertise-tags changed", errNeedsReset)
+			}
+			mp.AdvertiseTags, mp.AdvertiseTagsSet = want, true
+			changed = append(changed, "advertise-tags")
+		}
+	}
+	return mp, changed, nil
+}
+
+func parseExitNode(s string) (netip.Addr, error) {
+	if s == "" {
+		return netip.Addr{}, nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		// Имя ноды резолвит только CLI.
+		return netip.Addr{}, fmt.Errorf("%w: exit-node %q is not an IP", errNeedsReset, s)
+	}
+	return ip, nil
+}
+
+// currentExitNodeIP — IP выбранного exit node: демон хранит его как ExitNodeID,
+// поэтому ищем ноду в status.
+func currentExitNodeIP(cur *localPrefs, st *localStatus) netip.Addr {
+	if cur.ExitNodeIP.IsValid() {
+		return cur.ExitNodeIP
+	}
+	if cur.ExitNodeID == "" || st == nil {
+		return netip.Addr{}
+	}
+	for _, p := range st.Peer {
+		if p != nil && p.ID == cur.ExitNodeID && len(p.TailscaleIPs) > 0 {
+			return p.TailscaleIPs[0]
+		}
+	}
+	return netip.Addr{}
+}
+
+func desiredRoutes(cur []netip.Prefix, f *upFlags) ([]netip.Prefix, error) {
+	hasExit := false
+	var routes []netip.Prefix
+	for _, r := range cur {
+		if slices.Contains(exitRoutes, r) {
+			hasExit = true
+		} else {
+			routes = append(routes, r)
+		}
+	}
+	if f.set["advertise-routes"] {
+		routes = routes[:0]
+		for _, s := range splitList(f.advertiseRoutes) {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad route %q: %w", s, err)
+			}
+			routes = append(routes, p.Masked())
+		}
+	}
+	if f.set["advertise-exit-node"] {
+		hasExit = f.advertiseExit
+	}
+	if hasExit {
+		routes = append(routes, exitRoutes...)
+	}
+	return routes, nil
+}
+
+func samePrefixes(a, b []netip.Prefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	cmp := func(x, y netip.Prefix) int { return strings.Compare(x.String(), y.String()) }
+	return slices.Equal(slices.SortedFunc(slices.Values(a), cmp), slices.SortedFunc(slices.Values(b), cmp))
+}
+
+// upWithoutReset поднимает ноду через LocalAPI, сохраняя prefs из консоли:
+// применяются только флаги, изменившиеся с прошлого старта и отличающиеся от
+// текущих prefs, логин — только если он реально нужен.
+func upWithoutReset(ctx context.Context, lc *localClient, opt *StartOptions) error {
+	f, err := parseUpArgs(opt.ExtraUpArgs)
+	if err != nil {
+		return err
+	}
+	path := appliedFlagsPath(opt)
+	if same := f.dropUnchanged(loadAppliedFlags(path)); len(same) > 0 {
+		slog.Info("Up flags unchanged since last apply, keeping current prefs", "flags", same)
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	cur, err := lc.Prefs(reqCtx)
+	if err != nil {
+		return err
+	}
+	st, err := lc.Status(reqCtx)
+	if err != nil {
+		return err
+	}
+
+	mp, changed, err := diffPrefs(cur, st, f)
+	if err != nil {
+		return err
+	}
+	if !cur.WantRunning {
+		mp.WantRunning, mp.WantRunningSet = true, true
+		changed = append(changed, "want-running")
+	}
+	if len(changed) > 0 {
+		slog.Info("Applying changed prefs", "changed", changed)
+		if _, err := lc.EditPrefs(reqCtx, mp); err != nil {
+			return err
+		}
+	} else {
+		slog.Info("Prefs already match, nothing to change")
+	}
+	saveAppliedFlags(path, f)
+
+	interactive := false
+	if st.BackendState == "NeedsLogin" || !st.HaveNodeKey {
+		if opt.AuthKey != "" {
+			slog.Info("Node needs login, using auth key")
+			if err := lc.StartWithAuthKey(reqCtx, opt.AuthKey); err != nil {
+				return err
+			}
+		} else {
+			interactive = true
+		}
+		if !st.HaveNodeKey || interactive {
+			if err := lc.StartLoginInteractive(reqCtx); err != nil {
+				return err
+			}
+		}
+	}
+
+	timeout := noResetUpTimeout
+	if interactive {
+		timeout = loginTimeout(opt)
+	}
+	setBackendState(StateConnecting, "")
+	err = waitBackendRunning(ctx, lc, timeout)
+	if interactive && errors.Is(err, context.DeadlineExceeded) {
+		return errLoginTimedOut
+	}
+	return err
+}
+
+// resetPrefs — `up --reset` через LocalAPI: флаги из ExtraUpArgs применяются,
+// а все остальные известные возвращаются к значениям по умолчанию.
+func resetPrefs(ctx context.Context, lc *localClient, opt *StartOptions) error {
+	f, err := parseUpArgs(opt.ExtraUpArgs)
+	if err != nil {
+		return err
+	}
+	for _, name := range f.known {
+		f.set[name] = true
+	}
+	cur, err := lc.Prefs(ctx)
+	if err != nil {
+		return err
+	}
+	st, err := lc.Status(ctx)
+	if err != nil {
+		return err
+	}
+	mp, changed, err := diffPrefs(cur, st, f)
+	if err != nil {
+		return err
+	}
+	if len(changed) > 0 {
+		slog.Info("Resetting prefs", "changed", changed)
+		if _, err := lc.EditPrefs(ctx, mp); err != nil {
+			return err
+		}
+	}
+	saveAppliedFlags(appliedFlagsPath(opt), f)
+	return nil
+}
+
+// rememberResetFlags записывает флаги после `tailscale up --reset` через CLI:
+// после сброса все известные флаги имеют значения из ExtraUpArgs или по умолчанию.
+func rememberResetFlags(opt *StartOptions) {
+	f, err := parseUpArgs(opt.ExtraUpArgs)
+	if err != nil {
+		return
+	}
+	for _, name := range f.known {
+		f.set[name] = true
+	}
+	saveAppliedFlags(appliedFlagsPath(opt), f)
+}
+
+// waitBackendRunning опрашивает status, пока демон не дойдёт до Running.
+// Попутно подхватывает AuthURL, если демон ждёт логина.
+func waitBackendRunning(ctx context.Context, lc *localClient, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		st, err := lc.Status(ctx)
+		if err == nil {
+			switch st.BackendState {
+			case "Running":
+				setLoginURL("")
+				return nil
+			case "NeedsLogin":
+				if st.AuthURL != "" {
+					setLoginURL(st.AuthURL)
+				}
+			}
+		}
+		if !sleepCtx(ctx, 500*time.Millisecond) {
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package appctr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCLI кладёт shell-скрипт на место симлинка tailscale.
+func fakeCLI(t *testing.T, script string) pathControl {
+	t.Helper()
+	p := fakeDaemon(t, "exit 0")
+	if err := os.WriteFile(p.Tailscale(), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Так ExtraUpArgs собирает TailscaledService.kt.
+const appUpArgs = "--hostname=phone --accept-routes=true --accept-dns=false --exit-node=100.64.0.5 --exit-node-allow-lan-access=true --advertise-exit-node=true "
+
+// То же с выключенными переключателями и без exit node.
+const appUpArgsOff = "--hostname=phone --accept-routes=false --accept-dns=true --exit-node= --exit-node-allow-lan-access=false --advertise-exit-node=false "
+
+func TestParseUpArgs(t *testing.T) {
+	f, err := parseUpArgs(appUpArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.hostname != "phone" || !f.acceptRoutes || f.acceptDNS || f.exitNode != "100.64.0.5" || !f.exitNodeAllowLAN || !f.advertiseExit {
+		t.Errorf("flags = %+v", f)
+	}
+	if f.set["shields-up"] || f.set["login-server"] {
+		t.Errorf("unset flags marked as set: %v", f.set)
+	}
+
+	for _, args := range []string{"--ssh", "--operator=shell", "up"} {
+		if _, err := parseUpArgs(args); !errors.Is(err, errNeedsReset) {
+			t.Errorf("parseUpArgs(%q) err = %v, want errNeedsReset", args, err)
+		}
+	}
+}
+
+func TestDiffPrefs(t *testing.T) {
+	running := &localStatus{BackendState: "Running", HaveNodeKey: true, Peer: map[string]*localPeer{
+		"k1": {ID: "n1", TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.5")}},
+	}}
+	base := localPrefs{
+		ControlURL:      "https://controlplane.tailscale.com",
+		Hostname:        "phone",
+		CorpDNS:         true,
+		ExitNodeID:      "n1",
+		ShieldsUp:       true,
+		AdvertiseRoutes: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")},
+	}
+
+	tests := []struct {
+		name    string
+		args    string
+		want    []string
+		wantErr error
+	}{
+		{"nothing mentioned keeps console prefs", "", nil, nil},
+		{"same values are not re-applied", "--hostname=phone --exit-node=100.64.0.5 --accept-dns", nil, nil},
+		{"only changed flags", "--hostname=phone --accept-routes --accept-dns=false", []string{"accept-routes", "accept-dns"}, nil},
+		{"exit node cleared", "--exit-node=", []string{"exit-node"}, nil},
+		{"advertise exit node keeps routes", "--advertise-exit-node", []string{"advertise-routes"}, nil},
+		{"login server needs reset", "--login-server=https://hs.example.com", nil, errNeedsReset},
+		{"tags need reset", "--advertise-tags=tag:phone", nil, errNeedsReset},
+		{"exit node by name needs reset", "--exit-node=nas", nil, errNeedsReset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseUpArgs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cur := base
+			mp, changed, err := diffPrefs(&cur, running, f)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(changed, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("changed = %v, want %v", changed, tt.want)
+			}
+			if mp.ShieldsUpSet {
+				t.Error("shields-up was not mentioned but is being changed")
+			}
+			if tt.name == "advertise exit node keeps routes" && len(mp.AdvertiseRoutes) != 3 {
+				t.Errorf("routes = %v", mp.AdvertiseRoutes)
+			}
+		})
+	}
+}
+
+// Выключенный в приложении переключатель должен выключаться и без --reset.
+func TestDiffPrefsTurnsTogglesOff(t *testing.T) {
+	off, err := parseUpArgs(appUpArgsOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &localStatus{BackendState: "Running", HaveNodeKey: true}
+	// Prefs после старта с appUpArgs.
+	cur := localPrefs{
+		Hostname:               "phone",
+		RouteAll:               true,
+		ExitNodeIP:             netip.MustParseAddr("100.64.0.5"),
+		ExitNodeAllowLANAccess: true,
+		AdvertiseRoutes:        exitRoutes,
+	}
+	mp, changed, err := diffPrefs(&cur, st, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "accept-routes,accept-dns,exit-node,exit-node-allow-lan-access,advertise-routes"
+	if strings.Join(changed, ",") != want {
+		t.Errorf("changed = %v, want %s", changed, want)
+	}
+	if mp.RouteAll || !mp.CorpDNS || mp.ExitNodeIP.IsValid() || mp.ExitNodeAllowLANAccess || len(mp.AdvertiseRoutes) != 0 {
+		t.Errorf("prefs after turning off = %+v", mp.localPrefs)
+	}
+}
+
+func TestRegisterRejectsFlagsThatNeedReset(t *testing.T) {
+	setState(StateStarting, "")
+	t.Cleanup(func() { setState(StateStopped, "") })
+
+	p := fakeCLI(t, `echo "$@" > "$(dirname "$0")/cli-args"`)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/prefs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"WantRunning": true})
+	})
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"BackendState": "Running", "HaveNodeKey": true})
+	})
+	serveLocalAPI(t, p.Socket(), mux)
+
+	registerMachineWithAuthKey(context.Background(), p, &StartOptions{AuthKey: "tskey-123", ExtraUpArgs: "--ssh"}, true)
+	if _, err := os.Stat(p.DataDir("cli-args")); err == nil {
+		t.Error("prefs were reset for an unknown flag without DoReset")
+	}
+	if st, reason := currentState(); st != StateFailed || !strings.Contains(reason, "Force Hard Reset") {
+		t.Errorf("state = %s (%s), want Failed", st, reason)
+	}
+}
+
+func TestUpWithoutResetAppliesOnlyChanges(t *testing.T) {
+	var mu sync.Mutex
+	var patch map[string]any
+	var started bool
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/prefs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" {
+			mu.Lock()
+			json.NewDecoder(r.Body).Decode(&patch)
+			mu.Unlock()
+		}
+		writeJSON(w, map[string]any{"WantRunning": true, "CorpDNS": true, "ShieldsUp": true, "ExitNodeID": "n1"})
+	})
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"BackendState": "Running", "HaveNodeKey": true})
+	})
+	mux.HandleFunc("/localapi/v0/start", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		started = true
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	lc := fakeLocalAPI(t, mux)
+
+	opt := &StartOptions{AuthKey: "tskey-123", ExtraUpArgs: "--accept-routes --accept-dns"}
+	if err := upWithoutReset(context.Background(), lc, opt); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if patch["RouteAllSet"] != true || patch["RouteAll"] != true {
+		t.Errorf("patch = %v, want RouteAll", patch)
+	}
+	for _, k := range []string{"CorpDNSSet", "ShieldsUpSet", "ExitNodeIDSet", "ExitNodeIPSet", "WantRunningSet", "HostnameSet"} {
+		if _, ok := patch[k]; ok {
+			t.Errorf("patch touches %s: %v", k, patch)
+		}
+	}
+	if started {
+		t.Error("auth key must not be used when the node is already logged in")
+	}
+}
+
+// Дедлок из README: демон после рестарта без --reset так и не доходит до
+// Running. Без DoReset prefs не сбрасываются: старт падает с подсказкой.
+func TestRegisterDoesNotResetOnDeadlock(t *testing.T) {
+	old := noResetUpTimeout
+	noResetUpTimeout = 300 * time.Millisecond
+	t.Cleanup(func() { noResetUpTimeout = old })
+
+	setState(StateStarting, "")
+	t.Cleanup(func() { setState(StateStopped, "") })
+
+	p := fakeCLI(t, `echo "$@" > "$(dirname "$0")/cli-args"`)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/prefs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" {
+			t.Error("prefs edited on a deadlocked daemon")
+		}
+		writeJSON(w, map[string]any{"WantRunning": true})
+	})
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"BackendState": "Starting", "HaveNodeKey": true})
+	})
+	serveLocalAPI(t, p.Socket(), mux)
+
+	registerMachineWithAuthKey(context.Background(), p, &StartOptions{AuthKey: "tskey-123"}, true)
+
+	if _, err := os.Stat(p.DataDir("cli-args")); err == nil {
+		t.Error("tailscale up --reset was run without DoReset")
+	}
+	if st, reason := currentState(); st != StateFailed || !strings.Contains(reason, "Force Hard Reset") {
+		t.Errorf("state = %s (%s), want Failed with a DoReset hint", st, reason)
+	}
+}
+
+// Флаги приложения применяются, только когда они изменились в приложении:
+// exit node, выключенный в консоли, не возвращается на каждом старте.
+func TestUpWithoutResetAppliesOnlyAppChanges(t *testing.T) {
+	var mu sync.Mutex
+	prefs := map[string]any{"WantRunning": true, "CorpDNS": true}
+	var patches []map[string]any
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/prefs", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == "PATCH" {
+			var patch map[string]any
+			json.NewDecoder(r.Body).Decode(&patch)
+			patches = append(patches, patch)
+			for k, v := range patch {
+				if !strings.HasSuffix(k, "Set") && patch[k+"Set"] == true {
+					prefs[k] = v
+				}
+			}
+		}
+		writeJSON(w, prefs)
+	})
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"BackendState": "Running", "HaveNodeKey": true})
+	})
+	lc := fakeLocalAPI(t, mux)
+	dir := t.TempDir()
+	up := func(args string) map[string]any {
+		t.Helper()
+		mu.Lock()
+		patches = nil
+		mu.Unlock()
+		if err := upWithoutReset(context.Background(), lc, &StartOptions{StatePath: dir, ExtraUpArgs: args}); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(patches) == 0 {
+			return nil
+		}
+		return patches[0]
+	}
+
+	// Первый старт: значения по умолчанию не трогают prefs, остальные применяются.
+	patch := up(appUpArgs)
+	if patch["ExitNodeIP"] != "100.64.0.5" || patch["RouteAll"] != true || patch["CorpDNSSet"] != true {
+		t.Errorf("first start patch = %v", patch)
+	}
+
+	// Exit node и accept-routes выключили в консоли; приложение их не меняло.
+	mu.Lock()
+	prefs["ExitNodeIP"], prefs["RouteAll"] = "", false
+	mu.Unlock()
+	if patch := up(appUpArgs); patch != nil {
+		t.Errorf("unchanged app flags patched prefs: %v", patch)
+	}
+
+	// Exit node сменили в приложении — это применяется, accept-routes нет.
+	patch = up(strings.Replace(appUpArgs, "--exit-node=100.64.0.5", "--exit-node=100.64.0.6", 1))
+	if patch["ExitNodeIP"] != "100.64.0.6" || patch["RouteAllSet"] != nil {
+		t.Errorf("patch after app change = %v", patch)
+	}
+}
+
+// У tsnet нет CLI: `up --reset --auth-key` делается через LocalAPI.
+func TestRegisterWithoutCLI(t *testing.T) {
+	setState(StateStarting, "")
+	t.Cleanup(func() { setState(StateStopped, "") })
+
+	p := fakeCLI(t, `echo "$@" > "$(dirname "$0")/cli-args"`)
+	var mu sync.Mutex
+	var authKey string
+	var patch map[string]any
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/prefs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" {
+			mu.Lock()
+			json.NewDecoder(r.Body).Decode(&patch)
+			mu.Unlock()
+		}
+		writeJSON(w, map[string]any{"WantRunning": true, "RouteAll": true})
+	})
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if authKey == "" {
+			writeJSON(w, map[string]any{"BackendState": "NeedsLogin"})
+			return
+		}
+		writeJSON(w, map[string]any{"BackendState": "Running", "HaveNodeKey": true})
+	})
+	mux.HandleFunc("/localapi/v0/start", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		authKey = body["AuthKey"]
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	serveLocalAPI(t, p.Socket(), mux)
+
+	registerMachineWithAuthKey(context.Background(), p, &StartOptions{AuthKey: "tskey-123", DoReset: true}, false)
+
+	if _, err := os.Stat(p.DataDir("cli-args")); err == nil {
+		t.Error("tailscale CLI was run for a backend without CLI")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if authKey != "tskey-123" {
+		t.Errorf("auth key sent = %q", authKey)
+	}
+	if patch["RouteAllSet"] != true {
+		t.Errorf("DoReset did not reset prefs: %v", patch)
+	}
+	if st, _ := currentState(); st != StateRunning {
+		t.Errorf("state = %s, want Running", st)
+	}
+}
@@ -0,0 +1,130 @@
+package appctr
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// pipe копирует данные в обе стороны, пока одна из них не закроется.
+func pipe(a, b io.ReadWriter) {
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(a, b)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(b, a)
+		errc <- err
+	}()
+	<-errc
+}
+
+// connListener — net.Listener без порта: соединения в него кладёт сам процесс
+// через dial. Так фронт SOCKS5 достаёт до сервера tsnet, не открывая его
+// другим приложениям на loopback.
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return connListenerAddr{} }
+
+// dial отдаёт слушателю один конец пары и возвращает другой. Серверу конец
+// представляется адресом local: на нём он поднимает UDP ASSOCIATE.
+func (l *connListener) dial(ctx context.Context, local net.Addr) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- localAddrConn{server, local}:
+		return client, nil
+	case <-l.closed:
+	case <-ctx.Done():
+	}
+	client.Close()
+	server.Close()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, net.ErrClosed
+}
+
+type connListenerAddr struct{}
+
+func (connListenerAddr) Network() string { return "pipe" }
+func (connListenerAddr) String() string  { return "in-process" }
+
+type localAddrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c localAddrConn) LocalAddr() net.Addr { return c.local }
+
+// httpProxyHandler — HTTP прокси как у tailscaled (--outbound-http-proxy-listen):
+// абсолютные URL через ReverseProxy, CONNECT через hijack.
+func httpProxyHandler(dial dialFunc) http.Handler {
+	rp := &httputil.ReverseProxy{
+		Director:  func(r *http.Request) {},
+		Transport: &http.Transport{DialContext: dial},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			if strings.HasPrefix(r.RequestURI, "/") || r.RequestURI == "*" {
+				http.Error(w, "bogus RequestURI; must be absolute URL or CONNECT", http.StatusBadRequest)
+				return
+			}
+			rp.ServeHTTP(w, r)
+			return
+		}
+
+		c, err := dial(r.Context(), "tcp", r.RequestURI)
+		if err != nil {
+			w.Header().Set("Tailscale-Connect-Error", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer c.Close()
+
+		cc, ccbuf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer cc.Close()
+		io.WriteString(cc, "HTTP/1.1 200 OK\r\n\r\n")
+
+		var src io.Reader = cc
+		if ccbuf.Reader.Buffered() > 0 {
+			src = ccbuf
+		}
+		pipe(struct {
+			io.Reader
+			io.Writer
+		}{src, cc}, c)
+	})
+}
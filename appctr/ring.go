@@ -0,0 +1,67 @@
+package appctr
+
+// ring — кольцевой буфер записей с монотонными номерами: у i-й записи от
+// старых к новым номер seq-n+1+i. Номера не сбрасываются reset. Не
+// потокобезопасен, владелец держит свой мьютекс.
+type ring[T any] struct {
+	buf   []T
+	start int // индекс самой старой записи
+	n     int
+	seq   int64 // номер последней добавленной записи
+}
+
+func newRing[T any](size int) ring[T] {
+	return ring[T]{buf: make([]T, size)}
+}
+
+// push добавляет v, вытесняя самую старую запись при полном буфере.
+// Возвращает номер записи и её место в буфере, чтобы номер можно было
+// сохранить в ней самой.
+func (r *ring[T]) push(v T) (int64, *T) {
+	r.seq++
+	i := r.start
+	if r.n < len(r.buf) {
+		i = (r.start + r.n) % len(r.buf)
+		r.n++
+	} else {
+		r.start = (r.start + 1) % len(r.buf)
+	}
+	r.buf[i] = v
+	return r.seq, &r.buf[i]
+}
+
+// oldest — номер самой старой записи в буфере.
+func (r *ring[T]) oldest() int64 { return r.seq - int64(r.n) + 1 }
+
+// truncated сообщает, что часть записей после afterSeq уже вытеснена.
+func (r *ring[T]) truncated(afterSeq int64) bool {
+	return afterSeq > 0 && afterSeq+1 < r.oldest()
+}
+
+// since возвращает записи новее afterSeq от старых к новым, для которых keep
+// вернул true, но не больше limit (0 — без ограничения). Второе значение —
+// номер последней просмотренной записи, курсор для следующего вызова.
+func (r *ring[T]) since(afterSeq int64, limit int, keep func(*T) bool) ([]T, int64) {
+	var out []T
+	next := max(afterSeq, r.oldest()-1)
+	for i := 0; i < r.n; i++ {
+		seq := r.oldest() + int64(i)
+		if seq <= afterSeq {
+			continue
+		}
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		next = seq
+		if v := &r.buf[(r.start+i)%len(r.buf)]; keep == nil || keep(v) {
+			out = append(out, *v)
+		}
+	}
+	return out, next
+}
+
+// reset удаляет все записи; номера продолжаются с прежнего.
+func (r *ring[T]) reset() {
+	clear(r.buf)
+	r.start, r.n = 0, 0
+}
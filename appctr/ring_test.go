@@ -0,0 +1,36 @@
+package appctr
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	r := newRing[int](3)
+	for v := 1; v <= 5; v++ {
+		if seq, slot := r.push(v * 10); seq != int64(v) || *slot != v*10 {
+			t.Fatalf("push %d: seq %d, slot %d", v, seq, *slot)
+		}
+	}
+	if got, next := r.since(0, 0, nil); !slices.Equal(got, []int{30, 40, 50}) || next != 5 {
+		t.Errorf("since(0) = %v, %d", got, next)
+	}
+	if got, next := r.since(3, 1, nil); !slices.Equal(got, []int{40}) || next != 4 {
+		t.Errorf("since(3, 1) = %v, %d", got, next)
+	}
+	odd := func(v *int) bool { return *v%20 != 0 }
+	if got, next := r.since(0, 0, odd); !slices.Equal(got, []int{30, 50}) || next != 5 {
+		t.Errorf("since(0, odd) = %v, %d", got, next)
+	}
+	if !r.truncated(1) || r.truncated(2) || r.truncated(0) {
+		t.Errorf("truncated: oldest %d", r.oldest())
+	}
+
+	r.reset()
+	if got, next := r.since(0, 0, nil); len(got) != 0 || next != 5 {
+		t.Errorf("after reset: %v, %d", got, next)
+	}
+	if seq, _ := r.push(60); seq != 6 {
+		t.Errorf("seq after reset = %d, want 6", seq)
+	}
+}
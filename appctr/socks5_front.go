@@ -0,0 +1,356 @@
+package appctr
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SOCKS5 фронт с логином и паролем (RFC 1929) перед SOCKS5 тейлнета. Сам
+// фронт только проверяет клиента, а запрос CONNECT или UDP ASSOCIATE как есть
+// уходит серверу tsnet внутри процесса, без порта, который увидели бы другие
+// приложения. HTTP прокси с фронтом пускает по тем же логинам (httpProxy).
+// У tailscaled оба прокси только на TCP без пароля, поэтому exec фронт не
+// поддерживает.
+
+const (
+	socks5Version     = 0x05
+	socks5AuthNone    = 0x00
+	socks5AuthUserPwd = 0x02
+	socks5NoMethods   = 0xff
+	socks5UserPwdVer  = 0x01
+	// Сколько даём клиенту на приветствие и логин.
+	socks5HandshakeTimeout = 10 * time.Second
+)
+
+// socks5Credentials — пароль по имени пользователя.
+type socks5Credentials map[string]string
+
+// parseSocks5Credentials разбирает Socks5Credentials: "user:password" через
+// запятую или перевод строки. Имя не может содержать ':', пароль — ',';
+// оба от 1 до 255 байт (RFC 1929).
+func parseSocks5Credentials(s string) (socks5Credentials, error) {
+	creds := socks5Credentials{}
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		user, pass, ok := strings.Cut(entry, ":")
+		if !ok || len(user) == 0 || len(user) > 255 || len(pass) == 0 || len(pass) > 255 {
+			return nil, fmt.Errorf("bad SOCKS5 credential %q: want user:password, each 1-255 bytes", user)
+		}
+		if _, dup := creds[user]; dup {
+			return nil, fmt.Errorf("duplicate SOCKS5 user %q", user)
+		}
+		creds[user] = pass
+	}
+	if len(creds) == 0 {
+		return nil, errors.New("no SOCKS5 credentials")
+	}
+	return creds, nil
+}
+
+// socks5Front принимает клиентов с логином и паролем и проксирует их в
+// SOCKS5 тейлнета.
+type socks5Front struct {
+	// inProcess подключается к SOCKS5 tsnet текущего запуска.
+	inProcess func(ctx context.Context, local net.Addr) (net.Conn, error)
+	creds     atomic.Pointer[socks5Credentials]
+	// Логин DNS прокси: он ходит в тейлнет через фронт. Есть в creds всегда.
+	internalUser, internalPass string
+
+	mu       sync.Mutex
+	sessions map[string]map[net.Conn]bool // открытые соединения по пользователю
+}
+
+// activeSocks5Front — фронт текущей сессии, для SetSocks5Credentials.
+var activeSocks5Front atomic.Pointer[socks5Front]
+
+func newSocks5Front(creds socks5Credentials) *socks5Front {
+	f := &socks5Front{internalUser: rand.Text(), internalPass: rand.Text(), sessions: map[string]map[net.Conn]bool{}}
+	f.storeCredentials(creds)
+	return f
+}
+
+// storeCredentials ставит creds вместе с внутренним логином и возвращает прежние.
+func (f *socks5Front) storeCredentials(creds socks5Credentials) socks5Credentials {
+	creds = maps.Clone(creds)
+	creds[f.internalUser] = f.internalPass
+	if old := f.creds.Swap(&creds); old != nil {
+		return *old
+	}
+	return nil
+}
+
+// internalAddr — адрес фронта с внутренним логином для DNS прокси:
+// user:password@host:port.
+func (f *socks5Front) internalAddr(addr *net.TCPAddr) string {
+	if addr.IP.IsUnspecified() {
+		addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: addr.Port}
+	}
+	return f.internalUser + ":" + f.internalPass + "@" + addr.String()
+}
+
+func (f *socks5Front) serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		f.closeSessions(func(string) bool { return true })
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go f.handle(ctx, c)
+	}
+}
+
+func (f *socks5Front) handle(ctx context.Context, c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	br := bufio.NewReader(c)
+	user, pass, err := f.authenticate(br, c)
+	if err != nil {
+		slog.Warn("SOCKS5 client rejected", "client", c.RemoteAddr().String(), "user", user, "err", err)
+		return
+	}
+
+	up, err := f.dialUpstream(ctx, c.LocalAddr())
+	if err != nil {
+		slog.Error("SOCKS5 upstream unavailable", "err", err)
+		// Ответ на ещё не прочитанный запрос: general SOCKS server failure.
+		c.Write([]byte{socks5Version, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer up.Close()
+	c.SetDeadline(time.Time{})
+
+	if !f.track(user, pass, c) {
+		return
+	}
+	defer f.untrack(user, c)
+	// Запрос клиента мог уже лежать в буфере вместе с логином.
+	pipe(struct {
+		io.Reader
+		io.Writer
+	}{br, c}, up)
+}
+
+// authenticate проводит выбор метода и RFC 1929 и возвращает логин клиента.
+func (f *socks5Front) authenticate(r *bufio.Reader, w io.Writer) (user, pass string, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", "", fmt.Errorf("SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", "", err
+	}
+	if !strings.Contains(string(methods), string(rune(socks5AuthUserPwd))) {
+		w.Write([]byte{socks5Version, socks5NoMethods})
+		return "", "", errors.New("client does not offer username/password auth")
+	}
+	if _, err := w.Write([]byte{socks5Version, socks5AuthUserPwd}); err != nil {
+		return "", "", err
+	}
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != socks5UserPwdVer {
+		return "", "", fmt.Errorf("auth version %d", hdr[0])
+	}
+	u := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, u); err != nil {
+		return "", "", err
+	}
+	plen, err := r.ReadByte()
+	if err != nil {
+		return string(u), "", err
+	}
+	p := make([]byte, plen)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return string(u), "", err
+	}
+	if !f.check(string(u), string(p)) {
+		w.Write([]byte{socks5UserPwdVer, 0x01})
+		return string(u), "", errors.New("bad username or password")
+	}
+	_, err = w.Write([]byte{socks5UserPwdVer, 0x00})
+	return string(u), string(p), err
+}
+
+func (f *socks5Front) check(user, pass string) bool {
+	want, ok := (*f.creds.Load())[user]
+	// Сравниваем и для неизвестного имени, чтобы время ответа его не выдавало.
+	return subtle.ConstantTimeCompare([]byte(want), []byte(pass)) == 1 && ok
+}
+
+// frontLogin — логин клиента HTTP прокси в контексте запроса, для dial.
+type frontLogin struct{ user, pass string }
+
+// httpProxy — HTTP прокси тейлнета (httpProxyHandler) за теми же логинами,
+// что и SOCKS5 (Proxy-Authorization: Basic). Соединения в тейлнет записаны
+// на пользователя, который их открыл, и рвутся вместе с его логином.
+func (f *socks5Front) httpProxy(dial dialFunc) http.Handler {
+	h := httpProxyHandler(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		login, _ := ctx.Value(frontLogin{}).(frontLogin)
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if !f.track(login.user, login.pass, c) {
+			c.Close()
+			return nil, errors.New("proxy login revoked")
+		}
+		return &trackedConn{Conn: c, untrack: func() { f.untrack(login.user, c) }}, nil
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+		user, pass, ok := auth.BasicAuth()
+		if !ok || !f.check(user, pass) {
+			if ok {
+				slog.Warn("HTTP proxy client rejected", "client", r.RemoteAddr, "user", user)
+			}
+			w.Header().Set("Proxy-Authenticate", `Basic realm="tailscale"`)
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), frontLogin{}, frontLogin{user, pass})))
+	})
+}
+
+// trackedConn снимает соединение с учёта при первом Close.
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	untrack func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.untrack)
+	return c.Conn.Close()
+}
+
+// dialUpstream подключается к SOCKS5 тейлнета без авторизации; local — адрес
+// фронта, на котором клиент ждёт UDP ASSOCIATE.
+func (f *socks5Front) dialUpstream(ctx context.Context, local net.Addr) (net.Conn, error) {
+	if f.inProcess == nil {
+		return nil, errors.New("no SOCKS5 server behind the front")
+	}
+	up, err := f.inProcess(ctx, local)
+	if err != nil {
+		return nil, err
+	}
+	up.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	var reply [2]byte
+	if _, err := up.Write([]byte{socks5Version, 1, socks5AuthNone}); err == nil {
+		_, err = io.ReadFull(up, reply[:])
+	}
+	if err != nil || reply != [2]byte{socks5Version, socks5AuthNone} {
+		up.Close()
+		return nil, fmt.Errorf("upstream greeting: %v %v", reply, err)
+	}
+	up.SetDeadline(time.Time{})
+	return up, nil
+}
+
+// track запоминает соединение user; false — логин отозвали или сменили,
+// пока шло подключение к демону.
+func (f *socks5Front) track(user, pass string, c net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.check(user, pass) {
+		return false
+	}
+	if f.sessions[user] == nil {
+		f.sessions[user] = map[net.Conn]bool{}
+	}
+	f.sessions[user][c] = true
+	return true
+}
+
+func (f *socks5Front) untrack(user string, c net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sessions[user], c)
+	if len(f.sessions[user]) == 0 {
+		delete(f.sessions, user)
+	}
+}
+
+func (f *socks5Front) closeSessions(match func(user string) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for user, conns := range f.sessions {
+		if match(user) {
+			for c := range conns {
+				c.Close()
+			}
+		}
+	}
+}
+
+// setCredentials меняет логины и рвёт соединения удалённых пользователей и
+// тех, у кого сменился пароль.
+func (f *socks5Front) setCredentials(creds socks5Credentials) {
+	f.mu.Lock()
+	old := f.storeCredentials(creds)
+	now := *f.creds.Load()
+	f.mu.Unlock()
+	f.closeSessions(func(user string) bool {
+		pass, ok := now[user]
+		return !ok || pass != old[user]
+	})
+}
+
+// SetSocks5Credentials меняет логины SOCKS5 фронта без перезапуска (формат как
+// у StartOptions.Socks5Credentials). Соединения отозванных логинов рвутся.
+// Включить или выключить фронт можно только перезапуском.
+func SetSocks5Credentials(creds string) error {
+	f := activeSocks5Front.Load()
+	if f == nil {
+		return errors.New("SOCKS5 authentication is not enabled")
+	}
+	parsed, err := parseSocks5Credentials(creds)
+	if err != nil {
+		return err
+	}
+	f.setCredentials(parsed)
+	slog.Info("SOCKS5 credentials updated", "users", len(parsed))
+	return nil
+}
+
+// listenSocks5Front открывает addr для фронта. Куда он ведёт, решает бэкенд
+// (newBackend).
+func listenSocks5Front(addr, creds string) (*socks5Front, net.Listener, error) {
+	parsed, err := parseSocks5Credentials(creds)
+	if err != nil {
+		return nil, nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newSocks5Front(parsed), ln, nil
+}
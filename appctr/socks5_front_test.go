@@ -0,0 +1,355 @@
+package appctr
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"tailscale.com/net/socks5"
+)
+
+// tcpEcho поднимает эхо-сервер и возвращает его адрес.
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return echo.Addr().String()
+}
+
+// testSocks5Front поднимает эхо-сервер, SOCKS5 без пароля внутри процесса, как
+// у tsnet, и фронт перед ним; возвращает фронт, его адрес и адрес эха.
+func testSocks5Front(t *testing.T, creds string) (*socks5Front, string, string) {
+	t.Helper()
+	echo := tcpEcho(t)
+	in := newConnListener()
+	var d net.Dialer
+	go (&socks5.Server{Logf: t.Logf, Dialer: d.DialContext}).Serve(in)
+	t.Cleanup(func() { in.Close() })
+
+	front, ln, err := listenSocks5Front("127.0.0.1:0", creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front.inProcess = in.dial
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go front.serve(ctx, ln)
+	return front, ln.Addr().String(), echo
+}
+
+func dialSocks5(addr, target string, auth *proxy.Auth) (net.Conn, error) {
+	d, err := proxy.SOCKS5("tcp", addr, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial("tcp", target)
+}
+
+// echoes проверяет, что соединение живое: эхо возвращает отправленное.
+func echoes(c net.Conn, msg string) bool {
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(c, msg); err != nil {
+		return false
+	}
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(c, buf)
+	return err == nil && string(buf) == msg
+}
+
+func TestSocks5FrontAuth(t *testing.T) {
+	_, addr, echo := testSocks5Front(t, "firefox:fox-pass, telegram:tg:pass")
+
+	tests := []struct {
+		name string
+		auth *proxy.Auth
+		ok   bool
+	}{
+		{"first user", &proxy.Auth{User: "firefox", Password: "fox-pass"}, true},
+		{"password with colon", &proxy.Auth{User: "telegram", Password: "tg:pass"}, true},
+		{"wrong password", &proxy.Auth{User: "firefox", Password: "tg:pass"}, false},
+		{"unknown user", &proxy.Auth{User: "chrome", Password: "fox-pass"}, false},
+		{"no auth", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := dialSocks5(addr, echo, tt.auth)
+			if !tt.ok {
+				if err == nil {
+					c.Close()
+					t.Fatal("connected without valid credentials")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if !echoes(c, "ping") {
+				t.Error("no data through the front")
+			}
+		})
+	}
+}
+
+func TestSocks5FrontRevoke(t *testing.T) {
+	front, addr, echo := testSocks5Front(t, "firefox:fox-pass,telegram:tg-pass")
+	fox, err := dialSocks5(addr, echo, &proxy.Auth{User: "firefox", Password: "fox-pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fox.Close()
+	tg, err := dialSocks5(addr, echo, &proxy.Auth{User: "telegram", Password: "tg-pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tg.Close()
+	if !echoes(fox, "a") || !echoes(tg, "b") {
+		t.Fatal("sessions not established")
+	}
+
+	activeSocks5Front.Store(front)
+	t.Cleanup(func() { activeSocks5Front.Store(nil) })
+	if err := SetSocks5Credentials("telegram:tg-pass"); err != nil {
+		t.Fatal(err)
+	}
+	// Сессия отозванного логина рвётся, остальные живут.
+	fox.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := fox.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("revoked session read: %v, want EOF", err)
+	}
+	if !echoes(tg, "c") {
+		t.Error("remaining session closed")
+	}
+	if c, err := dialSocks5(addr, echo, &proxy.Auth{User: "firefox", Password: "fox-pass"}); err == nil {
+		c.Close()
+		t.Error("revoked credentials accepted")
+	}
+
+	// Смена пароля тоже рвёт сессию.
+	if err := SetSocks5Credentials("telegram:new-pass"); err != nil {
+		t.Fatal(err)
+	}
+	tg.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := tg.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("session with changed password read: %v, want EOF", err)
+	}
+
+	if err := SetSocks5Credentials("broken"); err == nil {
+		t.Error("bad credentials accepted")
+	}
+	activeSocks5Front.Store(nil)
+	if err := SetSocks5Credentials("telegram:tg-pass"); err == nil {
+		t.Error("SetSocks5Credentials without a running front succeeded")
+	}
+}
+
+// UDP ASSOCIATE через фронт: сервер внутри процесса поднимает реле на адресе фронта.
+func TestSocks5FrontUDPAssociate(t *testing.T) {
+	_, addr, echo := testSocks5Front(t, "firefox:fox-pass")
+	c, err := dialSocks5(addr, echo, &proxy.Auth{User: "firefox", Password: "fox-pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c, "ping") {
+		t.Error("no data through the in-process front")
+	}
+
+	udpEcho, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := udpEcho.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buf[:n], from)
+		}
+	}()
+	ctl, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.Close()
+	ctl.SetDeadline(time.Now().Add(5 * time.Second))
+	ctl.Write([]byte{socks5Version, 1, socks5AuthUserPwd})
+	ctl.Write(append(append([]byte{socks5UserPwdVer, 7}, "firefox"...), append([]byte{8}, "fox-pass"...)...))
+	ctl.Write([]byte{socks5Version, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+2+10)
+	if _, err := io.ReadFull(ctl, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[4] != socks5Version || reply[5] != 0 || !net.IP(reply[8:12]).IsLoopback() {
+		t.Fatalf("UDP ASSOCIATE reply = %v", reply)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[8:12]), Port: int(reply[12])<<8 | int(reply[13])}
+	uc, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	target := udpEcho.LocalAddr().(*net.UDPAddr)
+	uc.Write(append([]byte{0, 0, 0, 1, 127, 0, 0, 1, byte(target.Port >> 8), byte(target.Port)}, "dgram"...))
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	n, err := uc.Read(buf)
+	if err != nil || n < 10 || string(buf[10:n]) != "dgram" {
+		t.Errorf("UDP through the in-process front: %q, %v", buf[:n], err)
+	}
+}
+
+// С фронтом HTTP прокси пускает только по логинам SOCKS5, а туннели CONNECT
+// рвутся, когда логин отзывают.
+func TestSocks5FrontHTTPProxy(t *testing.T) {
+	front, _, echo := testSocks5Front(t, "firefox:fox-pass")
+	var d net.Dialer
+	proxySrv := httptest.NewServer(front.httpProxy(d.DialContext))
+	defer proxySrv.Close()
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("proxy credentials forwarded to the site")
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer site.Close()
+
+	get := func(user *url.Userinfo) (int, string) {
+		u, _ := url.Parse(proxySrv.URL)
+		u.User = user
+		c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+		defer c.CloseIdleConnections()
+		resp, err := c.Get(site.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Error("407 without Proxy-Authenticate")
+		}
+		return resp.StatusCode, string(body)
+	}
+	if code, _ := get(nil); code != http.StatusProxyAuthRequired {
+		t.Errorf("no credentials: %d, want 407", code)
+	}
+	if code, _ := get(url.UserPassword("firefox", "wrong")); code != http.StatusProxyAuthRequired {
+		t.Errorf("wrong password: %d, want 407", code)
+	}
+	if code, body := get(url.UserPassword("firefox", "fox-pass")); code != http.StatusOK || body != "hello" {
+		t.Errorf("with credentials: %d %q", code, body)
+	}
+
+	c, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	auth := base64.StdEncoding.EncodeToString([]byte("firefox:fox-pass"))
+	io.WriteString(c, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\nProxy-Authorization: Basic "+auth+"\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	if _, err := io.WriteString(c, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("CONNECT tunnel: %q %v", buf, err)
+	}
+
+	front.setCredentials(socks5Credentials{"telegram": "tg-pass"})
+	if _, err := br.Read(buf); err != io.EOF {
+		t.Errorf("revoked tunnel read: %v, want EOF", err)
+	}
+	if code, _ := get(url.UserPassword("firefox", "fox-pass")); code != http.StatusProxyAuthRequired {
+		t.Errorf("revoked credentials: %d, want 407", code)
+	}
+}
+
+// Внутренний логин DNS прокси работает и переживает смену логинов.
+func TestSocks5FrontInternalLogin(t *testing.T) {
+	front, addr, echo := testSocks5Front(t, "firefox:fox-pass")
+	if a := front.internalAddr(&net.TCPAddr{IP: net.IPv6unspecified, Port: 1055}); socks5Host(a) != "127.0.0.1:1055" {
+		t.Errorf("internal addr for a wildcard listener = %s", socks5Host(a))
+	}
+	tcp, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal := front.internalAddr(tcp)
+
+	dial := func() (net.Conn, error) {
+		d, err := socks5Dialer(internal)
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial("tcp", echo)
+	}
+	c, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c, "a") {
+		t.Fatal("internal login rejected")
+	}
+
+	activeSocks5Front.Store(front)
+	t.Cleanup(func() { activeSocks5Front.Store(nil) })
+	if err := SetSocks5Credentials("telegram:tg-pass"); err != nil {
+		t.Fatal(err)
+	}
+	if !echoes(c, "b") {
+		t.Error("internal session closed by SetSocks5Credentials")
+	}
+	if c2, err := dial(); err != nil {
+		t.Errorf("internal login after SetSocks5Credentials: %v", err)
+	} else {
+		c2.Close()
+	}
+}
+
+func TestParseSocks5Credentials(t *testing.T) {
+	creds, err := parseSocks5Credentials(" firefox:a \n\ntelegram:b:c,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 2 || creds["firefox"] != "a" || creds["telegram"] != "b:c" {
+		t.Errorf("creds = %v", creds)
+	}
+	for _, bad := range []string{"", " , ", "firefox", ":pass", "firefox:", "a:1,a:2", "u:" + string(make([]byte, 256))} {
+		if _, err := parseSocks5Credentials(bad); err == nil {
+			t.Errorf("parseSocks5Credentials(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package appctr
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// State — жизненный цикл прокси с точки зрения приложения.
+type State int32
+
+const (
+	StateStopped State = iota
+	StateStarting
+	StateNeedsLogin
+	StateConnecting
+	StateRunning
+	StateStopping
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "Stopped"
+	case StateStarting:
+		return "Starting"
+	case StateNeedsLogin:
+		return "NeedsLogin"
+	case StateConnecting:
+		return "Connecting"
+	case StateRunning:
+		return "Running"
+	case StateStopping:
+		return "Stopping"
+	case StateFailed:
+		return "Failed"
+	}
+	return "Unknown"
+}
+
+// StateListener получает смены состояния (аналог Closer для gomobile).
+type StateListener interface {
+	OnStateChanged(state int32, name string, reason string)
+}
+
+type stateChange struct {
+	state  State
+	reason string
+}
+
+var lifecycleMu sync.Mutex
+var lifecycle State
+var lifecycleReason string
+var stateListener StateListener
+
+// Очередь событий для листенера. Если он завис и очередь полна, старые
+// события выбрасываются: последнее состояние листенер получит всегда, а
+// setState никогда не ждёт Kotlin.
+const maxPendingStates = 64
+
+var pendingStatesMu sync.Mutex
+var pendingStates []stateChange
+var stateWake = make(chan struct{}, 1)
+var stateDispatchOnce sync.Once
+
+// GetState возвращает текущее состояние (значение State).
+func GetState() int32 {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	return int32(lifecycle)
+}
+
+func GetStateName() string {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	return lifecycle.String()
+}
+
+// GetStateReason — причина для Failed/NeedsLogin, иначе пусто.
+func GetStateReason() string {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	return lifecycleReason
+}
+
+func SetStateListener(l StateListener) {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	stateListener = l
+}
+
+func currentState() (State, string) {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	return lifecycle, lifecycleReason
+}
+
+// setState безусловно меняет состояние. Используется Start/Stop и супервизором.
+func setState(s State, reason string) {
+	lifecycleMu.Lock()
+	changed := lifecycle != s || lifecycleReason != reason
+	lifecycle, lifecycleReason = s, reason
+	lifecycleMu.Unlock()
+	if changed {
+		notifyState(s, reason)
+	}
+}
+
+// setBackendState применяет состояние, пришедшее от демона (CLI, IPN bus).
+// Оно не перетирает Stopped/Stopping/Failed: выйти из них можно только через Start/Stop.
+func setBackendState(s State, reason string) {
+	lifecycleMu.Lock()
+	switch lifecycle {
+	case StateStopped, StateStopping, StateFailed:
+		lifecycleMu.Unlock()
+		return
+	}
+	changed := lifecycle != s || lifecycleReason != reason
+	lifecycle, lifecycleReason = s, reason
+	lifecycleMu.Unlock()
+	if changed {
+		notifyState(s, reason)
+	}
+}
+
+func notifyState(s State, reason string) {
+	slog.Info("State changed", "state", s.String(), "reason", reason)
+	stateDispatchOnce.Do(func() { go dispatchStates() })
+	pendingStatesMu.Lock()
+	if len(pendingStates) == maxPendingStates {
+		slog.Warn("State listener is not keeping up, dropping old event", "state", pendingStates[0].state.String())
+		pendingStates = pendingStates[1:]
+	}
+	pendingStates = append(pendingStates, stateChange{s, reason})
+	pendingStatesMu.Unlock()
+	select {
+	case stateWake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchStates вызывает листенер из одной горутины, чтобы сохранить порядок
+// и не держать локи во время вызова в Kotlin.
+func dispatchStates() {
+	for range stateWake {
+		for {
+			pendingStatesMu.Lock()
+			if len(pendingStates) == 0 {
+				pendingStatesMu.Unlock()
+				break
+			}
+			ev := pendingStates[0]
+			pendingStates = pendingStates[1:]
+			pendingStatesMu.Unlock()
+
+			lifecycleMu.Lock()
+			l := stateListener
+			lifecycleMu.Unlock()
+			if l != nil {
+				l.OnStateChanged(int32(ev.state), ev.state.String(), ev.reason)
+			}
+		}
+	}
+}
+
+// backendStateFromIPN переводит ipn.State демона в наше состояние.
+func backendStateFromIPN(st int) (State, string) {
+	switch st {
+	case 1: // InUseOtherUser
+		return StateFailed, "in use by another user"
+	case 2: // NeedsLogin
+		return StateNeedsLogin, ""
+	case 3: // NeedsMachineAuth
+		return StateNeedsLogin, "machine needs approval in the admin console"
+	case 5: // Starting
+		return StateConnecting, ""
+	case 6: // Running
+		return StateRunning, ""
+	}
+	// NoState, Stopped: демон жив, но `up` ещё не отработал.
+	return StateStarting, ""
+}
@@ -0,0 +1,146 @@
+package appctr
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingListener struct {
+	mu     sync.Mutex
+	states []string
+	ch     chan struct{}
+}
+
+func (l *recordingListener) OnStateChanged(state int32, name string, reason string) {
+	l.mu.Lock()
+	l.states = append(l.states, name)
+	l.mu.Unlock()
+	l.ch <- struct{}{}
+}
+
+func (l *recordingListener) wait(t *testing.T, n int) []string {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-l.ch:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %v, want %d events", l.states, n)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.states...)
+}
+
+func resetState(t *testing.T) *recordingListener {
+	t.Helper()
+	setState(StateStopped, "")
+	l := &recordingListener{ch: make(chan struct{}, 16)}
+	// Дождаться, пока диспетчер отдаст событие сброса старому листенеру.
+	time.Sleep(10 * time.Millisecond)
+	SetStateListener(l)
+	t.Cleanup(func() { SetStateListener(nil) })
+	return l
+}
+
+func TestBackendStateDoesNotLeaveFailed(t *testing.T) {
+	l := resetState(t)
+
+	setBackendState(StateRunning, "")
+	if GetState() != int32(StateStopped) {
+		t.Fatalf("backend state applied while stopped: %s", GetStateName())
+	}
+
+	setState(StateStarting, "")
+	setBackendState(StateConnecting, "")
+	setBackendState(StateFailed, "auth key rejected")
+	setBackendState(StateNeedsLogin, "")
+	if GetState() != int32(StateFailed) || GetStateReason() != "auth key rejected" {
+		t.Fatalf("state = %s (%s), want Failed", GetStateName(), GetStateReason())
+	}
+
+	got := l.wait(t, 3)
+	want := []string{"Starting", "Connecting", "Failed"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBackendStateFromIPNBus(t *testing.T) {
+	l := resetState(t)
+	setState(StateStarting, "")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/watch-ipn-bus", func(w http.ResponseWriter, r *http.Request) {
+		for _, st := range []int{2, 5, 6} { // NeedsLogin, Starting, Running
+			writeJSON(w, map[string]any{"State": st})
+			w.(http.Flusher).Flush()
+		}
+	})
+	lc := fakeLocalAPI(t, mux)
+
+	if err := runIPNBus(context.Background(), lc); err == nil {
+		t.Fatal("runIPNBus must end with an error when the stream closes")
+	}
+	got := l.wait(t, 4)
+	want := []string{"Starting", "NeedsLogin", "Connecting", "Running"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %v, want %v", got, want)
+		}
+	}
+}
+
+type blockingListener struct {
+	release chan struct{}
+	mu      sync.Mutex
+	last    string
+}
+
+func (l *blockingListener) OnStateChanged(state int32, name string, reason string) {
+	<-l.release
+	l.mu.Lock()
+	l.last = name + " " + reason
+	l.mu.Unlock()
+}
+
+func TestStateListenerDoesNotBlockSetState(t *testing.T) {
+	resetState(t)
+	l := &blockingListener{release: make(chan struct{})}
+	SetStateListener(l)
+
+	done := make(chan struct{})
+	go func() {
+		for i := range 3 * maxPendingStates {
+			setState(StateConnecting, strconv.Itoa(i))
+		}
+		setState(StateRunning, "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("setState blocked on a stuck listener")
+	}
+
+	// Отпустили листенер — он догоняет и видит последнее состояние.
+	close(l.release)
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		l.mu.Lock()
+		last := l.last
+		l.mu.Unlock()
+		if last == "Running " {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("last delivered state = %q, want Running", last)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,158 @@
+package appctr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// daemonExit — запись о падении tailscaled.
+type daemonExit struct {
+	Time     time.Time
+	Uptime   time.Duration
+	ExitCode int    // -1, если процесс убит сигналом или не стартовал
+	Signal   string `json:",omitempty"`
+	Err      string `json:",omitempty"`
+}
+
+func newDaemonExit(err error, started time.Time) daemonExit {
+	ex := daemonExit{Time: time.Now(), Uptime: time.Since(started), ExitCode: -1}
+	if err != nil {
+		ex.Err = err.Error()
+	} else {
+		ex.ExitCode = 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		ex.ExitCode = ee.ExitCode()
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			ex.Signal = ws.Signal().String()
+		}
+	}
+	return ex
+}
+
+const maxExitHistory = 20
+
+var exitHistoryMu sync.Mutex
+var exitHistory []daemonExit
+
+func recordDaemonExit(ex daemonExit) {
+	exitHistoryMu.Lock()
+	defer exitHistoryMu.Unlock()
+	exitHistory = append(exitHistory, ex)
+	if len(exitHistory) > maxExitHistory {
+		exitHistory = exitHistory[len(exitHistory)-maxExitHistory:]
+	}
+}
+
+func daemonExits() []daemonExit {
+	exitHistoryMu.Lock()
+	defer exitHistoryMu.Unlock()
+	return append([]daemonExit(nil), exitHistory...)
+}
+
+// GetDaemonExits возвращает историю падений tailscaled в виде JSON.
+func GetDaemonExits() string {
+	data, _ := json.Marshal(daemonExits())
+	return string(data)
+}
+
+// supervisor перезапускает упавший tailscaled с экспоненциальной задержкой.
+// Если за window случилось больше maxRestarts рестартов, он сдаётся и зовёт onGiveUp.
+type supervisor struct {
+	run func(ctx context.Context) error
+
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	maxRestarts  int
+	window       time.Duration
+	healthyAfter time.Duration // после такого аптайма backoff сбрасывается
+
+	onRestart func(ex daemonExit)
+	onGiveUp  func()
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	restarts []time.Time
+}
+
+func newSupervisor(run func(ctx context.Context) error) *supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &supervisor{
+		run:          run,
+		minBackoff:   1 * time.Second,
+		maxBackoff:   30 * time.Second,
+		maxRestarts:  5,
+		window:       5 * time.Minute,
+		healthyAfter: 1 * time.Minute,
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+}
+
+func (s *supervisor) start() { go s.loop() }
+
+// stop помечает остановку как штатную: выход демона после неё не считается падением.
+func (s *supervisor) stop() { s.cancel() }
+
+func (s *supervisor) loop() {
+	defer close(s.done)
+	backoff := s.minBackoff
+	for {
+		started := time.Now()
+		err := s.run(s.ctx)
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		ex := newDaemonExit(err, started)
+		recordDaemonExit(ex)
+		slog.Error("tailscaled exited", "code", ex.ExitCode, "signal", ex.Signal, "uptime", ex.Uptime.Round(time.Millisecond), "err", ex.Err)
+
+		if ex.Uptime >= s.healthyAfter {
+			backoff = s.minBackoff
+		}
+		if !s.allowRestart(time.Now()) {
+			slog.Error("tailscaled restart budget exhausted, giving up", "restarts", s.maxRestarts, "window", s.window)
+			if s.onGiveUp != nil {
+				s.onGiveUp()
+			}
+			return
+		}
+
+		slog.Info("Restarting tailscaled", "in", backoff)
+		if s.onRestart != nil {
+			s.onRestart(ex)
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.maxBackoff)
+	}
+}
+
+func (s *supervisor) allowRestart(now time.Time) bool {
+	kept := s.restarts[:0]
+	for _, t := range s.restarts {
+		if now.Sub(t) < s.window {
+			kept = append(kept, t)
+		}
+	}
+	s.restarts = kept
+	if len(s.restarts) >= s.maxRestarts {
+		return false
+	}
+	s.restarts = append(s.restarts, now)
+	return true
+}
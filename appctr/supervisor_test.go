@@ -0,0 +1,148 @@
+package appctr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeDaemon кладёт shell-скрипт вместо libtailscale.so и возвращает pathControl для него.
+func fakeDaemon(t *testing.T, script string) pathControl {
+	t.Helper()
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "lib", "libtailscale.so")
+	if err := os.MkdirAll(filepath.Dir(exe), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(exe, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(dir, "data")
+	if err := os.MkdirAll(data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return newPathControl(exe, filepath.Join(data, "tailscaled.sock"), filepath.Join(data, "state"))
+}
+
+func testSupervisor(p pathControl) *supervisor {
+	s := newSupervisor(func(ctx context.Context) error {
+		return tailscaledCmd(ctx, p, "127.0.0.1:0", "127.0.0.1:0")
+	})
+	s.minBackoff = 5 * time.Millisecond
+	s.maxBackoff = 20 * time.Millisecond
+	s.maxRestarts = 2
+	s.window = time.Minute
+	return s
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	start := len(daemonExits())
+	s := testSupervisor(fakeDaemon(t, "exit 3"))
+	gaveUp := make(chan struct{})
+	s.onGiveUp = func() { close(gaveUp) }
+	s.start()
+
+	select {
+	case <-gaveUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not give up")
+	}
+	<-s.done
+
+	exits := daemonExits()[start:]
+	if len(exits) != 3 {
+		t.Fatalf("got %d exits, want 3 (1 run + 2 restarts)", len(exits))
+	}
+	for _, ex := range exits {
+		if ex.ExitCode != 3 || ex.Signal != "" {
+			t.Errorf("exit = %+v", ex)
+		}
+	}
+}
+
+func TestSupervisorRecordsSignal(t *testing.T) {
+	start := len(daemonExits())
+	s := testSupervisor(fakeDaemon(t, "kill -9 $$"))
+	s.maxRestarts = 0
+	gaveUp := make(chan struct{})
+	s.onGiveUp = func() { close(gaveUp) }
+	s.start()
+
+	select {
+	case <-gaveUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not give up")
+	}
+	exits := daemonExits()[start:]
+	if len(exits) != 1 || exits[0].ExitCode != -1 || exits[0].Signal != "killed" {
+		t.Fatalf("exits = %+v", exits)
+	}
+}
+
+func TestSupervisorRestartsOnDemandCrash(t *testing.T) {
+	p := fakeDaemon(t, `while [ ! -f crash ]; do /bin/sleep 0.02; done; /bin/rm crash; exit 7`)
+	s := testSupervisor(p)
+	s.onGiveUp = func() { t.Error("unexpected give up") }
+	s.start()
+
+	start := len(daemonExits())
+	crash := func() {
+		if err := os.WriteFile(p.DataDir("crash"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := os.Stat(p.DataDir("crash")); os.IsNotExist(err) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("daemon did not crash")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	crash()
+	crash()
+
+	// Штатная остановка не считается падением и не вызывает onGiveUp.
+	time.Sleep(100 * time.Millisecond)
+	s.stop()
+	stateMu.Lock()
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+	stateMu.Unlock()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+
+	exits := daemonExits()[start:]
+	if len(exits) != 2 {
+		t.Fatalf("got %d exits, want 2", len(exits))
+	}
+	for _, ex := range exits {
+		if ex.ExitCode != 7 {
+			t.Errorf("exit = %+v", ex)
+		}
+	}
+}
+
+func TestSupervisorRestartBudget(t *testing.T) {
+	s := newSupervisor(nil)
+	s.maxRestarts = 2
+	s.window = time.Minute
+	now := time.Now()
+	if !s.allowRestart(now) || !s.allowRestart(now.Add(time.Second)) {
+		t.Fatal("first restarts must be allowed")
+	}
+	if s.allowRestart(now.Add(2 * time.Second)) {
+		t.Fatal("third restart inside window must be denied")
+	}
+	if !s.allowRestart(now.Add(2 * time.Minute)) {
+		t.Fatal("restart after window must be allowed")
+	}
+}